@@ -0,0 +1,119 @@
+package parsley
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// Node is what an action gets to see of the rule it is attached to.
+type Node struct {
+	Rule string
+	Text string
+	Loc  common.StringPos
+
+	// Children holds a value for everything the rule matched that wasn't discarded. Text
+	// matched by a regular expression is a string, a repetition or group is a []any, and
+	// a rule is whatever its action returned, or its Node if it has no action.
+	Children []any
+}
+
+// Action turns the match of a rule into a value.
+type Action func(n Node) (any, error)
+
+// ActionError is returned when an action fails, along with where its rule matched.
+type ActionError struct {
+	Rule string
+	Loc  common.StringPos
+	Err  error
+}
+
+func (e ActionError) Error() string {
+	return fmt.Sprintf("action for rule %s failed at %s: %v", e.Rule, e.Loc, e.Err)
+}
+
+func (e ActionError) Unwrap() error {
+	return e.Err
+}
+
+// Action attaches an action to a rule. Actions run bottom-up once the whole input has been
+// parsed, so they never run for matches that were later backtracked over.
+func (g *Grammar) Action(rule string, action Action) {
+	if g.actions == nil {
+		g.actions = map[string]Action{}
+	}
+
+	g.actions[rule] = action
+}
+
+// ParseValue parses contents and returns the value that the actions produced for the start
+// rule.
+func (g Grammar) ParseValue(contents string) (any, error) {
+	result, err := g.Parse(contents)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return g.value(result)
+}
+
+func (g Grammar) value(result common.EvaluateResult) (any, error) {
+	switch result := result.(type) {
+	case common.RuleResult:
+		// What an embedded grammar matched gets its value from that grammar's actions, the
+		// same as if it had been parsed on its own
+		if embedded, ok := result.Origin().(*Grammar); ok {
+			return embedded.value(common.NewRuleResult(result.Result(), result.Start(), result.Remaining(), "input"))
+		}
+
+		children, err := g.values(result.Result().Results())
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The start doesn't always hold on to everything the rule matched, like the start of
+		// what ParseReader returns
+		start := result.Start()
+		text := start.Val()[:min(max(result.Remaining().Pos()-start.Pos(), 0), len(start.Val()))]
+		trimmed := strings.TrimLeft(text, " \t\f\v\r\n")
+		node := Node{result.Identifier(), trimmed, start.FromStartPos(len(text) - len(trimmed)).Loc, children}
+		action, found := g.actions[result.Identifier()]
+
+		if !found {
+			return node, nil
+		}
+
+		val, err := action(node)
+
+		if err != nil {
+			return nil, ActionError{node.Rule, node.Loc, err}
+		}
+
+		return val, nil
+	case common.MultipleResult:
+		return g.values(result.Results())
+	case common.StringResult:
+		return result.Val().Val(), nil
+	}
+
+	return nil, fmt.Errorf("can't get the value of %s", result)
+}
+
+func (g Grammar) values(results []common.EvaluateResult) ([]any, error) {
+	vals := make([]any, len(results))
+
+	for i, result := range results {
+		val, err := g.value(result)
+
+		if err != nil {
+			return nil, err
+		}
+
+		vals[i] = val
+	}
+
+	return vals, nil
+}
@@ -0,0 +1,174 @@
+package parsley
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sum adds up every int among vals, looking inside repetitions and groups.
+func sum(vals []any) int {
+	total := 0
+
+	for _, val := range vals {
+		switch val := val.(type) {
+		case int:
+			total += val
+		case []any:
+			total += sum(val)
+		}
+	}
+
+	return total
+}
+
+func TestActions(t *testing.T) {
+	grammar, err := ParseGrammar("input: expr\nexpr: number (\"+\" number)*\nnumber: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errTooBig := errors.New("too big")
+
+	grammar.Action("number", func(n Node) (any, error) {
+		val, err := strconv.Atoi(n.Text)
+
+		if err == nil && val > 100 {
+			return nil, errTooBig
+		}
+
+		return val, err
+	})
+
+	grammar.Action("expr", func(n Node) (any, error) {
+		return sum(n.Children), nil
+	})
+
+	val, err := grammar.ParseValue(" 1 + 2+3")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// input has no action, so it comes back as its Node
+	node, ok := val.(Node)
+
+	if !ok {
+		t.Fatalf("got %#v, want a Node", val)
+	}
+
+	if node.Rule != "input" || node.Text != "1 + 2+3" || node.Loc.Pos != 1 || len(node.Children) != 1 || node.Children[0] != 6 {
+		t.Errorf("got %+v", node)
+	}
+
+	_, err = grammar.ParseValue("1 + 200")
+
+	var actionErr ActionError
+
+	if !errors.As(err, &actionErr) || !errors.Is(err, errTooBig) {
+		t.Fatalf("got error %v, want an ActionError", err)
+	}
+
+	if actionErr.Rule != "number" || actionErr.Loc.Pos != 4 {
+		t.Errorf("got %+v, want the position of 200", actionErr)
+	}
+
+	if _, err := grammar.ParseValue("1 +"); err == nil {
+		t.Error("actions ran for input that doesn't parse")
+	}
+}
+
+func TestActionsSkipBacktracking(t *testing.T) {
+	grammar, err := ParseGrammar("input: <(number \"!\") (number \"?\")>\nnumber: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+
+	grammar.Action("number", func(n Node) (any, error) {
+		calls++
+		return n.Text, nil
+	})
+
+	if _, err := grammar.ParseValue("1?"); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 1 {
+		t.Errorf("number action ran %d times, want once", calls)
+	}
+}
+
+func TestEmbeddedActions(t *testing.T) {
+	embedded, err := ParseGrammar("input: number (\"+\" number)*\nnumber: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embedded.Action("number", func(n Node) (any, error) {
+		return strconv.Atoi(n.Text)
+	})
+
+	embedded.Action("input", func(n Node) (any, error) {
+		return sum(n.Children), nil
+	})
+
+	grammar, err := ParseGrammar("input: tag*\ntag: number \"{\" embed(sum, /[^}]*/) \"}\"\nnumber: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grammar.Embed("sum", embedded)
+
+	// Both grammars have a number rule, and each one gets its own action
+	grammar.Action("number", func(n Node) (any, error) {
+		return "#" + n.Text, nil
+	})
+
+	grammar.Action("tag", func(n Node) (any, error) {
+		return n.Children, nil
+	})
+
+	val, err := grammar.ParseValue("1{2+3} 4{5}")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := val.(Node).Children[0].([]any)
+
+	if len(tags) != 2 || tags[0].([]any)[0] != "#1" || tags[0].([]any)[1] != 5 || tags[1].([]any)[1] != 5 {
+		t.Errorf("got %#v", tags)
+	}
+}
+
+func TestValueOfStreamedResult(t *testing.T) {
+	grammar, err := ParseGrammar("input: name*\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The start of the result only holds on to the start of the input
+	result, err := grammar.ParseReader(strings.NewReader(strings.Repeat("abc ", readerChunkSize)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := grammar.value(result)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node := val.(Node); len(node.Children[0].([]any)) != readerChunkSize {
+		t.Errorf("got %d names", len(node.Children[0].([]any)))
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/l-donovan/parsley"
+)
+
+func runDiagram(args []string) int {
+	flags := flag.NewFlagSet("diagram", flag.ContinueOnError)
+	format := flags.String("format", "html", "output format: html or svg")
+	output := flags.String("o", "", "`path` to write to instead of stdout, which is a directory for svg without -rule")
+	rule := flags.String("rule", "", "only draw the rule with this `name`, which needs -format svg")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: parsley diagram [-format html|svg] [-rule NAME] [-o PATH] GRAMMAR")
+		return 2
+	}
+
+	if *format != "html" && *format != "svg" {
+		fmt.Fprintf(os.Stderr, "parsley diagram: unknown format %q\n", *format)
+		return 2
+	}
+
+	if *rule != "" && *format != "svg" {
+		fmt.Fprintln(os.Stderr, "parsley diagram: -rule needs -format svg")
+		return 2
+	}
+
+	if *format == "svg" && *rule == "" && *output == "" {
+		fmt.Fprintln(os.Stderr, "parsley diagram: -o DIR is needed to write a diagram of every rule")
+		return 2
+	}
+
+	grammar, err := loadGrammar(flags.Arg(0))
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsley diagram: %v\n", err)
+		return 1
+	}
+
+	switch {
+	case *format == "html":
+		title := strings.TrimSuffix(filepath.Base(flags.Arg(0)), filepath.Ext(flags.Arg(0)))
+
+		err = writeOutput(*output, func(w io.Writer) error {
+			return grammar.WriteDiagramHTML(w, parsley.DiagramOptions{Title: title})
+		})
+	case *rule != "":
+		err = writeOutput(*output, func(w io.Writer) error {
+			return grammar.WriteDiagram(w, *rule, parsley.DiagramOptions{Link: diagramFile})
+		})
+	default:
+		err = writeDiagrams(grammar, *output)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsley diagram: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// writeDiagrams writes an SVG diagram of every rule into dir, each of them linking to the
+// others.
+func writeDiagrams(grammar *parsley.Grammar, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, rule := range grammar.Rules() {
+		err := writeOutput(filepath.Join(dir, diagramFile(rule)), func(w io.Writer) error {
+			return grammar.WriteDiagram(w, rule, parsley.DiagramOptions{Link: diagramFile})
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diagramFile is the name of the SVG file for a rule. Template instances have all sorts of
+// characters in their names, so anything that doesn't belong in a file name is replaced.
+func diagramFile(rule string) string {
+	return strings.Map(func(ch rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|() ,`, ch) {
+			return '_'
+		}
+
+		return ch
+	}, rule) + ".svg"
+}
+
+// writeOutput calls write with the file at path, or with stdout if there is no path.
+func writeOutput(path string, write func(w io.Writer) error) error {
+	if path == "" {
+		return write(os.Stdout)
+	}
+
+	file, err := os.Create(path)
+
+	if err != nil {
+		return err
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/l-donovan/parsley"
+)
+
+var exportFormats = map[string]parsley.ExportFormat{
+	"ebnf": parsley.ISOEBNF,
+	"abnf": parsley.ABNF,
+	"w3c":  parsley.W3CEBNF,
+}
+
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	formatName := flags.String("format", "ebnf", "notation to export to: ebnf (ISO 14977), abnf (RFC 5234) or w3c (W3C EBNF)")
+	output := flags.String("o", "", "`file` to write to instead of stdout")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: parsley export [-format ebnf|abnf|w3c] [-o FILE] GRAMMAR")
+		return 2
+	}
+
+	format, found := exportFormats[*formatName]
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "parsley export: unknown format %q\n", *formatName)
+		return 2
+	}
+
+	grammar, err := loadGrammar(flags.Arg(0))
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsley export: %v\n", err)
+		return 1
+	}
+
+	err = writeOutput(*output, func(w io.Writer) error {
+		return grammar.Export(w, format)
+	})
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsley export: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
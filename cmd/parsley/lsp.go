@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/l-donovan/parsley/lsp"
+)
+
+// pairsFlag is a flag made of comma-separated items, each of which is either key=value or
+// just key.
+type pairsFlag map[string]string
+
+func (f pairsFlag) String() string {
+	var items []string
+
+	for key, value := range f {
+		items = append(items, key+"="+value)
+	}
+
+	return strings.Join(items, ",")
+}
+
+func (f pairsFlag) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+
+		if key == "" {
+			return fmt.Errorf("empty item in %q", s)
+		}
+
+		f[key] = value
+	}
+
+	return nil
+}
+
+func runLSP(args []string) int {
+	flags := flag.NewFlagSet("lsp", flag.ContinueOnError)
+	grammarPath := flags.String("grammar", "", "grammar `file` that documents are parsed with")
+	symbols := pairsFlag{}
+	tokens := pairsFlag{}
+	flags.Var(symbols, "symbols", "`rule[=name],...` rules that make up the document outline, each named after the first match of name in it")
+	flags.Var(tokens, "tokens", "`rule=type,...` semantic token types for rules, on top of rules named after a token type")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: parsley lsp [-grammar FILE [-symbols RULES] [-tokens RULES]]")
+		return 2
+	}
+
+	for _, tokenType := range tokens {
+		if !slices.Contains(lsp.SemanticTokenTypes, tokenType) {
+			fmt.Fprintf(os.Stderr, "parsley lsp: %q isn't a semantic token type, expected one of %s\n", tokenType, strings.Join(lsp.SemanticTokenTypes, ", "))
+			return 2
+		}
+	}
+
+	// Without a grammar, the files being edited are grammars themselves
+	server := lsp.NewGrammarServer("parsley")
+
+	if *grammarPath != "" {
+		grammar, err := loadGrammar(*grammarPath)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "parsley lsp: %v\n", err)
+			return 1
+		}
+
+		opts := lsp.DSLOptions{Symbols: map[string]lsp.SymbolRule{}, Tokens: tokens}
+
+		for rule, nameRule := range symbols {
+			opts.Symbols[rule] = lsp.SymbolRule{NameRule: nameRule}
+		}
+
+		server = lsp.NewDSLServer("parsley", grammar, opts)
+	}
+
+	if err := server.Serve(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "parsley lsp: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,197 @@
+// Command parsley works with parsley grammars from the command line.
+//
+// Usage:
+//
+//	parsley check -grammar FILE [-format text|json|sarif] [FILE...]
+//	parsley lsp [-grammar FILE [-symbols RULES] [-tokens RULES]]
+//	parsley diagram [-format html|svg] [-rule NAME] [-o PATH] GRAMMAR
+//	parsley export [-format ebnf|abnf|w3c] [-o FILE] GRAMMAR
+//
+// check validates the grammar, then parses each file with it. It exits with status 1 if
+// there were any errors, and 2 if it was used wrong.
+//
+// lsp runs a language server over stdin and stdout for files in the language the grammar
+// parses, or for grammar files if there is no grammar.
+//
+// diagram draws railroad diagrams of the rules in a grammar, either as a single HTML page
+// or as an SVG image per rule.
+//
+// export writes a grammar in ISO EBNF, ABNF or W3C EBNF, with comments on anything that
+// has no equivalent in them.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/l-donovan/parsley"
+	"github.com/l-donovan/parsley/common"
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"check", "validate a grammar and parse files with it", runCheck},
+		{"lsp", "run a language server for grammar files or files parsed by a grammar", runLSP},
+		{"diagram", "draw railroad diagrams of the rules in a grammar", runDiagram},
+		{"export", "write a grammar in ISO EBNF, ABNF or W3C EBNF", runExport},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: parsley <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "parsley: unknown command %q\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+// loadGrammar reads the grammar at path, letting it import files next to it.
+func loadGrammar(path string) (*parsley.Grammar, error) {
+	return parsley.ParseGrammarFS(os.DirFS(filepath.Dir(path)), filepath.Base(path))
+}
+
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	grammarPath := flags.String("grammar", "", "grammar `file` to check against")
+	format := flags.String("format", "text", "output format: text, json or sarif")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *grammarPath == "" {
+		fmt.Fprintln(os.Stderr, "parsley check: -grammar is required")
+		flags.Usage()
+		return 2
+	}
+
+	if *format != "text" && *format != "json" && *format != "sarif" {
+		fmt.Fprintf(os.Stderr, "parsley check: unknown format %q\n", *format)
+		return 2
+	}
+
+	var diagnostics []parsley.Diagnostic
+
+	// parseErrors lines up with diagnostics, so that text output can show the input around
+	// each parse error
+	var parseErrors []*parsley.ParseError
+
+	grammar, err := loadGrammar(*grammarPath)
+
+	var grammarDiagnostics []parsley.Diagnostic
+
+	if err != nil {
+		grammarDiagnostics = append(grammarDiagnostics, parsley.GrammarErrorDiagnostic(filepath.Base(*grammarPath), err))
+	} else {
+		grammarDiagnostics = grammar.Validate()
+	}
+
+	for _, diagnostic := range grammarDiagnostics {
+		// Grammar files are named relative to the grammar's directory, not to us
+		if diagnostic.Span != nil {
+			diagnostic.Span.File = filepath.Join(filepath.Dir(*grammarPath), diagnostic.Span.File)
+		}
+
+		diagnostics = append(diagnostics, diagnostic)
+		parseErrors = append(parseErrors, nil)
+	}
+
+	// Files can only be checked against a grammar that could be read
+	if grammar != nil {
+		for _, path := range flags.Args() {
+			contents, err := os.ReadFile(path)
+
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "parsley check: %s\n", err)
+				return 2
+			}
+
+			_, err = grammar.ParseSource(common.NewSource(path, string(contents)))
+
+			if err == nil {
+				continue
+			}
+
+			var parseErr parsley.ParseError
+
+			if errors.As(err, &parseErr) {
+				parseErrors = append(parseErrors, &parseErr)
+			} else {
+				parseErrors = append(parseErrors, nil)
+			}
+
+			diagnostics = append(diagnostics, parsley.ErrorDiagnostic(path, err))
+		}
+	}
+
+	switch *format {
+	case "json":
+		err = parsley.WriteJSON(os.Stdout, diagnostics)
+	case "sarif":
+		err = parsley.WriteSARIF(os.Stdout, diagnostics)
+	default:
+		err = writeText(diagnostics, parseErrors)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsley check: %s\n", err)
+		return 2
+	}
+
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == parsley.SeverityError {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// writeText prints diagnostics for people, showing where in the input each parse error is.
+func writeText(diagnostics []parsley.Diagnostic, parseErrors []*parsley.ParseError) error {
+	for i, diagnostic := range diagnostics {
+		var err error
+
+		if parseErr := parseErrors[i]; parseErr != nil {
+			err = parseErr.Render(os.Stdout, parsley.RenderOptions{ContextLines: 2})
+		} else {
+			_, err = fmt.Fprintln(os.Stdout, diagnostic)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -31,12 +31,29 @@ func (e Expression) Evaluate(input MetaString, globals map[string]any) (Evaluate
 		return ErrorResult, fmt.Errorf("no Evaluate method defined for expression of type %s", e.Definition.Name)
 	}
 
+	state := GetState(globals)
+	var snapshot StateSnapshot
+
+	if state != nil {
+		if err := state.enter(input); err != nil {
+			return ErrorResult, err
+		}
+
+		defer state.leave()
+		snapshot = state.Snapshot()
+	}
+
 	out, err := e.Definition.Evaluate(e.Values, input, globals)
 
 	if err != nil {
 		return ErrorResult, err
 	}
 
+	// Anything a failed match did to the parse state has to be undone before backtracking
+	if state != nil && !Match(out) && state.Snapshot() != snapshot {
+		state.Restore(snapshot)
+	}
+
 	return out, nil
 }
 
@@ -105,12 +122,14 @@ var ErrorResult = NoMatchResult{}
 // RuleResult is the core type for defined rules.
 type RuleResult struct {
 	result     MultipleResult
+	start      MetaString
 	remaining  MetaString
 	identifier string
+	origin     any
 }
 
-func NewRuleResult(result MultipleResult, remaining MetaString, identifier string) RuleResult {
-	return RuleResult{result, remaining, identifier}
+func NewRuleResult(result MultipleResult, start, remaining MetaString, identifier string) RuleResult {
+	return RuleResult{result, start, remaining, identifier, nil}
 }
 
 func (r RuleResult) String() string {
@@ -131,6 +150,32 @@ func (r RuleResult) Remaining() MetaString {
 	return r.remaining
 }
 
+func (r RuleResult) Result() MultipleResult {
+	return r.result
+}
+
+// Start returns the input the rule was evaluated against, which begins with any whitespace
+// that its first token skipped over.
+func (r RuleResult) Start() MetaString {
+	return r.start
+}
+
+func (r RuleResult) Identifier() string {
+	return r.identifier
+}
+
+// WithOrigin returns the result marked as coming from origin, for a result that something
+// other than the rest of the tree parsed, like an embedded grammar.
+func (r RuleResult) WithOrigin(origin any) RuleResult {
+	r.origin = origin
+	return r
+}
+
+// Origin returns what the result was marked as coming from with WithOrigin, or nil.
+func (r RuleResult) Origin() any {
+	return r.origin
+}
+
 type RuleTreeItem struct {
 	rule   string
 	result MultipleTreeItem
@@ -145,6 +190,14 @@ func (t RuleTreeItem) String() string {
 	return fmt.Sprintf("%s<%s>", t.rule, t.result)
 }
 
+func (t RuleTreeItem) Rule() string {
+	return t.rule
+}
+
+func (t RuleTreeItem) Children() MultipleTreeItem {
+	return t.result
+}
+
 // MultipleResult
 
 type MultipleResult struct {
@@ -187,6 +240,10 @@ func (r MultipleResult) Remaining() MetaString {
 	return r.remaining
 }
 
+func (r MultipleResult) Results() []EvaluateResult {
+	return r.results
+}
+
 func (r MultipleResult) Next() *MetaString {
 	return r.nextInSeries
 }
@@ -223,13 +280,17 @@ func (r StringResult) String() string {
 }
 
 func (r StringResult) Condense() (TreeItem, error) {
-	return StringTreeItem{r.val.contents}, nil
+	return StringTreeItem{r.val.Val()}, nil
 }
 
 func (r StringResult) Remaining() MetaString {
 	return r.remaining
 }
 
+func (r StringResult) Val() MetaString {
+	return r.val
+}
+
 type StringTreeItem struct {
 	val string
 }
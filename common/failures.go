@@ -0,0 +1,153 @@
+package common
+
+import "slices"
+
+// furthestFailure is what parsing expected at the furthest position it couldn't get past.
+// Unlike the rest of the state, it isn't undone when backtracking, because backtracking
+// is how parsing gets there.
+type furthestFailure struct {
+	at       MetaString
+	pos      int
+	expected []string
+	rules    []string
+	labels   []string
+
+	// labelDepth is how deeply nested the labels are. Only the most deeply nested labels
+	// are kept, since they say the most about what went wrong.
+	labelDepth int
+}
+
+// failureLabel is an error message for failures in part of a grammar. It only applies to
+// failures after the position after, which is -1 for labels on expressions.
+type failureLabel struct {
+	message string
+	after   int
+}
+
+// FailureSnapshot is the furthest failure as it was at some point during a parse.
+type FailureSnapshot struct {
+	failure *furthestFailure
+}
+
+// SnapshotFailure and RestoreFailure undo whatever was expected since the snapshot. That
+// isn't needed for backtracking, only for parsing the same input over again as if the
+// first attempt never happened.
+func (s *ParseState) SnapshotFailure() FailureSnapshot {
+	if s.failure == nil {
+		return FailureSnapshot{}
+	}
+
+	failure := *s.failure
+	failure.expected = slices.Clone(failure.expected)
+	failure.labels = slices.Clone(failure.labels)
+	failure.rules = slices.Clone(failure.rules)
+
+	return FailureSnapshot{&failure}
+}
+
+func (s *ParseState) RestoreFailure(snapshot FailureSnapshot) {
+	s.failure = snapshot.failure
+}
+
+// EnterRule and LeaveRule keep track of which rules are being parsed, so that failures
+// can say where they happened.
+func (s *ParseState) EnterRule(name string) {
+	s.ruleStack = append(s.ruleStack, name)
+}
+
+func (s *ParseState) LeaveRule() {
+	s.ruleStack = s.ruleStack[:len(s.ruleStack)-1]
+}
+
+// PushLabel and PopLabel surround the evaluation of something with a failure label. Any
+// failure inside it is reported with the innermost label's message.
+func (s *ParseState) PushLabel(message string) {
+	s.labels = append(s.labels, failureLabel{message, -1})
+}
+
+// PushRuleLabel is PushLabel for the label of a rule starting at input. The label only
+// applies once the rule has matched something other than whitespace, so that trying a
+// rule that doesn't fit at all isn't reported as an error in it.
+func (s *ParseState) PushRuleLabel(message string, input MetaString) {
+	s.labels = append(s.labels, failureLabel{message, input.FromFirstNotMatching(" \t\f\v\r\n").Pos()})
+}
+
+func (s *ParseState) PopLabel() {
+	s.labels = s.labels[:len(s.labels)-1]
+}
+
+// Expect records that something described by describe was expected at input and wasn't
+// there. Only what was expected at the furthest position is kept, so describe is only
+// called if input is at least that far.
+func (s *ParseState) Expect(input MetaString, describe func() string) {
+	pos := input.Pos()
+
+	switch {
+	case s.failure == nil:
+		s.failure = &furthestFailure{at: input, pos: pos, rules: slices.Clone(s.ruleStack)}
+	case pos > s.failure.pos:
+		// Parsing that goes well moves the furthest failure along all the time, so the
+		// same one is reused instead of allocating a new one every time
+		failure := s.failure
+		failure.at, failure.pos = input, pos
+		failure.expected, failure.labels, failure.labelDepth = failure.expected[:0], failure.labels[:0], 0
+		failure.rules = append(failure.rules[:0], s.ruleStack...)
+	case pos < s.failure.pos:
+		return
+	}
+
+	if description := describe(); !slices.Contains(s.failure.expected, description) {
+		s.failure.expected = append(s.failure.expected, description)
+	}
+
+	for depth := len(s.labels); depth > 0; depth-- {
+		label := s.labels[depth-1]
+
+		if pos <= label.after {
+			continue
+		}
+
+		if depth > s.failure.labelDepth {
+			s.failure.labels = nil
+			s.failure.labelDepth = depth
+		}
+
+		if depth == s.failure.labelDepth && !slices.Contains(s.failure.labels, label.message) {
+			s.failure.labels = append(s.failure.labels, label.message)
+		}
+
+		break
+	}
+}
+
+// Furthest returns the furthest position anything was expected at, and false if nothing
+// has been expected yet.
+func (s *ParseState) Furthest() (MetaString, bool) {
+	if s.failure == nil {
+		return MetaString{}, false
+	}
+
+	return s.failure.at, true
+}
+
+// Expected returns what was expected at pos, along with the rules that were being parsed
+// when it first was, outermost first. Both are empty unless pos is the furthest position
+// anything was expected at.
+func (s *ParseState) Expected(pos int) (expected, rules []string) {
+	if s.failure == nil || s.failure.pos != pos {
+		return nil, nil
+	}
+
+	return s.failure.expected, s.failure.rules
+}
+
+// Labels returns the messages of the failure labels that were around whatever was expected
+// at pos, in the order they were first used. Like Expected, it is empty unless pos is the
+// furthest position anything was expected at.
+func (s *ParseState) Labels(pos int) []string {
+	if s.failure == nil || s.failure.pos != pos {
+		return nil
+	}
+
+	return s.failure.labels
+}
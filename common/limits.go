@@ -0,0 +1,107 @@
+package common
+
+import (
+	"context"
+	"fmt"
+)
+
+// DefaultMaxDepth is how deeply expressions can nest when no other limit is given. It is
+// far deeper than any reasonable grammar needs, but shallow enough that a left-recursive
+// rule fails with a DepthLimitError instead of overflowing the stack.
+const DefaultMaxDepth = 100_000
+
+// contextCheckInterval is how many evaluation steps pass between checks for cancellation.
+const contextCheckInterval = 1024
+
+type DepthLimitError struct {
+	Max int
+	Loc StringPos
+}
+
+func (e DepthLimitError) Error() string {
+	return fmt.Sprintf("expressions nested more than %d deep at %s", e.Max, e.Loc)
+}
+
+type StepLimitError struct {
+	Max int
+	Loc StringPos
+}
+
+func (e StepLimitError) Error() string {
+	return fmt.Sprintf("parsing took more than %d steps, stopped at %s", e.Max, e.Loc)
+}
+
+type InputSizeError struct {
+	Max, Size int
+}
+
+func (e InputSizeError) Error() string {
+	return fmt.Sprintf("input is %d bytes, which is more than the limit of %d", e.Size, e.Max)
+}
+
+// Limits bounds the work a single parse is allowed to do. Zero means no limit, except for
+// MaxDepth, which falls back to DefaultMaxDepth. A nil Context is one that is never
+// cancelled.
+type Limits struct {
+	Context  context.Context
+	MaxDepth int
+	MaxSteps int
+}
+
+// Nested returns the state for a parse that happens in the middle of this one, like that
+// of an embedded grammar. It starts out as deep as this one and with as many steps taken,
+// so that both count towards the same limits. Once the nested parse is done, Unnest adds
+// the steps it took to this state.
+func (s *ParseState) Nested(tabWidth int) *ParseState {
+	nested := NewParseState(tabWidth)
+	nested.User = s.User
+	nested.Limits = s.Limits
+	nested.depth = s.depth
+	nested.steps = s.steps
+
+	return nested
+}
+
+func (s *ParseState) Unnest(nested *ParseState) {
+	s.steps = nested.steps
+}
+
+// enter is called before evaluating every expression, and has to be paired with a call to
+// leave once the expression is done.
+func (s *ParseState) enter(input MetaString) error {
+	s.depth++
+
+	maxDepth := s.Limits.MaxDepth
+
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+
+	if s.depth > maxDepth {
+		return DepthLimitError{maxDepth, input.Loc}
+	}
+
+	// Steps are only counted for a limit on them or to check for cancellation every so
+	// often, so parses that have neither don't count them at all
+	if s.Limits.MaxSteps <= 0 && s.Limits.Context == nil {
+		return nil
+	}
+
+	s.steps++
+
+	if s.Limits.MaxSteps > 0 && s.steps > s.Limits.MaxSteps {
+		return StepLimitError{s.Limits.MaxSteps, input.Loc}
+	}
+
+	if s.Limits.Context != nil && s.steps%contextCheckInterval == 0 {
+		if err := s.Limits.Context.Err(); err != nil {
+			return fmt.Errorf("parsing stopped at %s: %w", input.Loc, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *ParseState) leave() {
+	s.depth--
+}
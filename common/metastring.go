@@ -2,82 +2,189 @@ package common
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
+// StringPos is a position in the input. File is the name of the Source the input came
+// from, if it has one. Pos is the offset in bytes from the start of the input, and Line
+// counts from zero. Col is the column in runes, which is what a person would count,
+// ByteCol is the column in bytes, and UTF16Col is the column in UTF-16 code units, which
+// is what LSP clients count by default.
 type StringPos struct {
-	Pos, Line, Col int
+	File              string
+	Pos, Line, Col    int
+	ByteCol, UTF16Col int
 }
 
+// String returns the position as file:line:col, or line:col if it has no file, with the
+// line and the column in runes counting from one.
 func (s StringPos) String() string {
+	if s.File != "" {
+		return fmt.Sprintf("%s:%d:%d", s.File, s.Line+1, s.Col+1)
+	}
+
 	return fmt.Sprintf("%d:%d", s.Line+1, s.Col+1)
 }
 
+// document is the input that MetaStrings are slices of. Where its lines start is worked
+// out once, and then shared by every slice of it.
+type document struct {
+	contents   string
+	base       StringPos
+	lineStarts []int
+
+	// ascii is whether every character is a single byte, in which case all three kinds of
+	// column are the same and don't need counting.
+	ascii bool
+}
+
+func newDocument(contents string, base StringPos) *document {
+	d := &document{contents: contents, base: base, ascii: true}
+
+	for i := 0; i < len(contents); i++ {
+		switch {
+		case contents[i] == '\n':
+			d.lineStarts = append(d.lineStarts, i+1)
+		case contents[i] >= utf8.RuneSelf:
+			d.ascii = false
+		}
+	}
+
+	return d
+}
+
+func (d *document) position(offset int) StringPos {
+	return d.advance(d.base, 0, offset)
+}
+
+// advance returns the position of offset, given that from is the position of fromOffset
+// and that offset isn't before it. Only what is between the two is looked at, so a slice
+// of a slice is found from where its parent is, rather than by counting from the start of
+// its line, which is slow for long lines that have to be counted by the rune.
+func (d *document) advance(from StringPos, fromOffset, offset int) StringPos {
+	pos := from
+	pos.Pos += offset - fromOffset
+	lineStart := fromOffset
+
+	// How many lines start after fromOffset and at or before offset
+	if first, last := sort.SearchInts(d.lineStarts, fromOffset+1), sort.SearchInts(d.lineStarts, offset+1); last > first {
+		pos.Line += last - first
+		pos.Col, pos.ByteCol, pos.UTF16Col = 0, 0, 0
+		lineStart = d.lineStarts[last-1]
+	}
+
+	if d.ascii {
+		pos.Col += offset - lineStart
+		pos.ByteCol += offset - lineStart
+		pos.UTF16Col += offset - lineStart
+
+		return pos
+	}
+
+	prefix := d.contents[lineStart:offset]
+	pos.Col += utf8.RuneCountInString(prefix)
+	pos.ByteCol += len(prefix)
+	pos.UTF16Col += utf16Len(prefix)
+
+	return pos
+}
+
+// MetaString is a slice of the input that knows where in the input it is. Slices of it
+// share the input and its line index, and find their position from where the string they
+// were cut from is, so each one only looks at the input between the two.
 type MetaString struct {
-	contents string
-	Loc      StringPos
+	Loc StringPos
+
+	doc        *document
+	start, end int
 }
 
 func NewMetaString(contents string) MetaString {
-	return MetaString{contents, StringPos{0, 0, 0}}
+	return MetaString{StringPos{}, newDocument(contents, StringPos{}), 0, len(contents)}
 }
 
-func (m MetaString) getPos(start int) StringPos {
-	if start == 0 {
-		return m.Loc
-	}
+// NewMetaStringAt is like NewMetaString for contents that don't start at the beginning of
+// the input, such as a window onto a larger stream.
+func NewMetaStringAt(contents string, loc StringPos) MetaString {
+	return MetaString{loc, newDocument(contents, loc), 0, len(contents)}
+}
 
-	newlineCount := strings.Count(m.contents[:start], "\n")
-	pos := m.Loc.Pos + start
-	line := m.Loc.Line + newlineCount
-	col := start
+// Pos returns the offset in bytes of the start of m from the start of the input, which is
+// the same as Loc.Pos.
+func (m MetaString) Pos() int {
+	return m.Loc.Pos
+}
 
-	if newlineCount == 0 {
-		col += m.Loc.Col
-	} else {
-		lastNewlinePos := strings.LastIndex(m.contents[:start], "\n")
-		col -= lastNewlinePos + 1
+// utf16Len returns how many UTF-16 code units s takes up. Invalid UTF-8 counts as one
+// replacement character per byte, like it does when ranging over s.
+func utf16Len(s string) int {
+	n := 0
+
+	for _, ch := range s {
+		if ch >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
 	}
 
-	return StringPos{pos, line, col}
+	return n
 }
 
 func (m MetaString) FromStartPos(start int) MetaString {
-	return MetaString{m.contents[start:], m.getPos(start)}
+	return m.FromPosRange(start, m.end-m.start)
 }
 
 func (m MetaString) FromPosRange(start, stop int) MetaString {
-	return MetaString{m.contents[start:stop], m.getPos(start)}
+	if start < 0 || start > stop || stop > m.end-m.start {
+		panic(fmt.Sprintf("slice bounds out of range [%d:%d] with length %d", start, stop, m.end-m.start))
+	}
+
+	if m.doc == nil {
+		return m
+	}
+
+	return MetaString{m.doc.advance(m.Loc, m.start, m.start+start), m.doc, m.start + start, m.start + stop}
 }
 
+// FromFirstMatching returns m from its first rune in targetset on, or the empty end of m
+// if there is no such rune.
 func (m MetaString) FromFirstMatching(targetset string) MetaString {
-	for i, ch := range m.contents {
+	for i, ch := range m.Val() {
 		if strings.ContainsRune(targetset, ch) {
-			return MetaString{m.contents[i:], m.getPos(i)}
+			return m.FromStartPos(i)
 		}
 	}
 
-	return MetaString{}
+	return m.FromStartPos(m.end - m.start)
 }
 
+// FromFirstNotMatching returns m from its first rune not in targetset on, or the empty end
+// of m if there is no such rune.
 func (m MetaString) FromFirstNotMatching(targetset string) MetaString {
-	for i, ch := range m.contents {
+	for i, ch := range m.Val() {
 		if !strings.ContainsRune(targetset, ch) {
-			return MetaString{m.contents[i:], m.getPos(i)}
+			return m.FromStartPos(i)
 		}
 	}
 
-	return MetaString{}
+	return m.FromStartPos(m.end - m.start)
 }
 
 func (m MetaString) Val() string {
-	return m.contents
+	if m.doc == nil {
+		return ""
+	}
+
+	return m.doc.contents[m.start:m.end]
 }
 
 func (m MetaString) String() string {
-	if strings.Contains(m.contents, "\"") {
-		return fmt.Sprintf("'%s' %s", m.contents, m.Loc)
+	if strings.Contains(m.Val(), "\"") {
+		return fmt.Sprintf("'%s' %s", m.Val(), m.Loc)
 	} else {
-		return fmt.Sprintf("%#v %s", m.contents, m.Loc)
+		return fmt.Sprintf("%#v %s", m.Val(), m.Loc)
 	}
 }
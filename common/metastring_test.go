@@ -0,0 +1,115 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPositions(t *testing.T) {
+	// é is two bytes and one UTF-16 unit, 😀 is four bytes and two UTF-16 units
+	input := NewMetaString("aé😀b\nxé\r\ny")
+
+	cases := []struct {
+		pos  int
+		want StringPos
+	}{
+		{0, StringPos{Pos: 0, Line: 0, Col: 0, ByteCol: 0, UTF16Col: 0}},
+		{1, StringPos{Pos: 1, Line: 0, Col: 1, ByteCol: 1, UTF16Col: 1}},
+		{3, StringPos{Pos: 3, Line: 0, Col: 2, ByteCol: 3, UTF16Col: 2}},
+		{7, StringPos{Pos: 7, Line: 0, Col: 3, ByteCol: 7, UTF16Col: 4}},
+		{8, StringPos{Pos: 8, Line: 0, Col: 4, ByteCol: 8, UTF16Col: 5}},
+		{9, StringPos{Pos: 9, Line: 1, Col: 0, ByteCol: 0, UTF16Col: 0}},
+		{12, StringPos{Pos: 12, Line: 1, Col: 2, ByteCol: 3, UTF16Col: 2}},
+		{14, StringPos{Pos: 14, Line: 2, Col: 0, ByteCol: 0, UTF16Col: 0}},
+		{15, StringPos{Pos: 15, Line: 2, Col: 1, ByteCol: 1, UTF16Col: 1}},
+	}
+
+	for _, c := range cases {
+		if got := input.FromStartPos(c.pos).Loc; got != c.want {
+			t.Errorf("at %d: got %+v, want %+v", c.pos, got, c.want)
+		}
+	}
+
+	// Positions carry on from a string that was cut out of the middle of a line
+	middle := input.FromStartPos(3).FromPosRange(4, 6)
+
+	if want := (StringPos{Pos: 7, Line: 0, Col: 3, ByteCol: 7, UTF16Col: 4}); middle.Loc != want {
+		t.Errorf("got %+v, want %+v", middle.Loc, want)
+	}
+}
+
+func TestPositionsOfSlicesOfSlices(t *testing.T) {
+	input := NewMetaStringAt("aé😀b\nxé\r\n\ny", StringPos{Pos: 10, Line: 1, Col: 2, ByteCol: 2, UTF16Col: 2})
+	current := input
+
+	// Going along one rune at a time ends up where slicing the whole input does
+	for i := range input.Val() {
+		current = current.FromStartPos(i - current.Pos() + input.Pos())
+
+		if want := input.FromStartPos(i).Loc; current.Loc != want {
+			t.Errorf("at %d: got %+v, want %+v", i, current.Loc, want)
+		}
+	}
+}
+
+func TestPositionsFromBase(t *testing.T) {
+	// A window onto the middle of a larger input, starting on its third line
+	window := NewMetaStringAt("ab\ncd", StringPos{Pos: 100, Line: 2, Col: 4, ByteCol: 4, UTF16Col: 4})
+
+	cases := []struct {
+		pos  int
+		want StringPos
+	}{
+		{0, StringPos{Pos: 100, Line: 2, Col: 4, ByteCol: 4, UTF16Col: 4}},
+		{2, StringPos{Pos: 102, Line: 2, Col: 6, ByteCol: 6, UTF16Col: 6}},
+		{4, StringPos{Pos: 104, Line: 3, Col: 1, ByteCol: 1, UTF16Col: 1}},
+	}
+
+	for _, c := range cases {
+		m := window.FromStartPos(c.pos)
+
+		if got := m.Loc; got != c.want || m.Pos() != c.want.Pos {
+			t.Errorf("at %d: got %+v and offset %d, want %+v", c.pos, got, m.Pos(), c.want)
+		}
+	}
+}
+
+func TestSliceOutOfRange(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("slicing past the end didn't panic")
+		}
+	}()
+
+	NewMetaString("abc").FromStartPos(1).FromPosRange(0, 3)
+}
+
+// BenchmarkLoc slices a large input at every line, which is what parsing it does over and
+// over. Each slice has to work out its line and column from the shared line index.
+func BenchmarkLoc(b *testing.B) {
+	input := NewMetaString(strings.Repeat("2024-01-02 12:00:00 INFO something happened\n", 50_000))
+	lineLength := strings.IndexByte(input.Val(), '\n') + 1
+
+	b.ResetTimer()
+
+	for range b.N {
+		for offset := 0; offset < len(input.Val()); offset += lineLength {
+			_ = input.FromStartPos(offset).Loc
+		}
+	}
+}
+
+// BenchmarkLocNonASCII is BenchmarkLoc for input with characters wider than a byte, where
+// columns have to be counted, and with every slice partway into its line.
+func BenchmarkLocNonASCII(b *testing.B) {
+	input := NewMetaString(strings.Repeat("2024-01-02 12:00:00 INFO ça happened\n", 50_000))
+	lineLength := strings.IndexByte(input.Val(), '\n') + 1
+
+	b.ResetTimer()
+
+	for range b.N {
+		for offset := 30; offset < len(input.Val()); offset += lineLength {
+			_ = input.FromStartPos(offset).Loc
+		}
+	}
+}
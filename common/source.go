@@ -0,0 +1,105 @@
+package common
+
+import (
+	"sort"
+	"sync"
+)
+
+// Source is a named input, usually a file. Positions in it carry its name, so that they
+// print as name:line:col.
+type Source struct {
+	Name     string
+	Contents string
+
+	base int
+	doc  *document
+}
+
+func NewSource(name, contents string) *Source {
+	return &Source{Name: name, Contents: contents, doc: newDocument(contents, StringPos{File: name})}
+}
+
+// MetaString returns the whole source. Every MetaString of the same source shares its
+// line index.
+func (s *Source) MetaString() MetaString {
+	return MetaString{s.doc.base, s.doc, 0, len(s.Contents)}
+}
+
+// Base is where the source starts in the FileSet it was added to, or zero if it wasn't
+// added to one.
+func (s *Source) Base() int {
+	return s.base
+}
+
+// Pos turns an offset into the source into a position in its FileSet.
+func (s *Source) Pos(offset int) int {
+	return s.base + offset
+}
+
+// Position returns the file, line and column of an offset into the source.
+func (s *Source) Position(offset int) StringPos {
+	return s.doc.position(offset)
+}
+
+// FileSet is a set of sources that share a single range of positions, like a
+// token.FileSet. Each source takes up as many positions as it has bytes plus one, so that
+// the end of every source has a position of its own, and a plain int is enough to say
+// where in which source something is. Position 0 is never part of a source.
+type FileSet struct {
+	mu      sync.RWMutex
+	base    int
+	sources []*Source
+}
+
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// AddSource adds a new source to the set. Sources can be added while positions are being
+// looked up in other goroutines.
+func (fs *FileSet) AddSource(name, contents string) *Source {
+	source := NewSource(name, contents)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	source.base = fs.base
+	fs.base += len(contents) + 1
+	fs.sources = append(fs.sources, source)
+
+	return source
+}
+
+// Source returns the source that pos is in, or nil if it isn't in any of them.
+func (fs *FileSet) Source(pos int) *Source {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	i := sort.Search(len(fs.sources), func(i int) bool { return fs.sources[i].base > pos }) - 1
+
+	if i < 0 || pos > fs.sources[i].base+len(fs.sources[i].Contents) {
+		return nil
+	}
+
+	return fs.sources[i]
+}
+
+// Position resolves pos to a file, line and column. A position that isn't in any source
+// resolves to the zero StringPos.
+func (fs *FileSet) Position(pos int) StringPos {
+	source := fs.Source(pos)
+
+	if source == nil {
+		return StringPos{}
+	}
+
+	return source.Position(pos - source.base)
+}
+
+// Sources returns the sources in the order they were added.
+func (fs *FileSet) Sources() []*Source {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	return append([]*Source(nil), fs.sources...)
+}
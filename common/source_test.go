@@ -0,0 +1,54 @@
+package common
+
+import "testing"
+
+func TestFileSet(t *testing.T) {
+	fs := NewFileSet()
+	a := fs.AddSource("a.txt", "ab\nc")
+	b := fs.AddSource("b.txt", "xyz")
+
+	cases := []struct {
+		pos  int
+		want string
+	}{
+		{0, "1:1"},
+		{a.Pos(0), "a.txt:1:1"},
+		{a.Pos(3), "a.txt:2:1"},
+		{a.Pos(4), "a.txt:2:2"},
+		{b.Pos(0), "b.txt:1:1"},
+		{b.Pos(3), "b.txt:1:4"},
+		{b.Pos(4), "1:1"},
+	}
+
+	for _, c := range cases {
+		if got := fs.Position(c.pos).String(); got != c.want {
+			t.Errorf("at %d: got %s, want %s", c.pos, got, c.want)
+		}
+	}
+
+	if fs.Source(b.Pos(1)) != b || fs.Source(a.Pos(4)) != a || fs.Source(0) != nil {
+		t.Error("positions resolved to the wrong sources")
+	}
+
+	if sources := fs.Sources(); len(sources) != 2 || sources[0] != a || sources[1] != b {
+		t.Errorf("got sources %v", sources)
+	}
+}
+
+func TestSourceMetaString(t *testing.T) {
+	source := NewSource("a.txt", "ab\ncd")
+	m := source.MetaString().FromStartPos(4)
+
+	if got := m.Loc.String(); got != "a.txt:2:2" {
+		t.Errorf("got %s", got)
+	}
+
+	if m.Loc != source.Position(4) {
+		t.Errorf("got %+v, want %+v", m.Loc, source.Position(4))
+	}
+
+	// Running out of input still leaves a position at the end of it
+	if end := source.MetaString().FromFirstMatching("!"); end.Val() != "" || end.Pos() != 5 || end.Loc.File != "a.txt" {
+		t.Errorf("got %+v", end.Loc)
+	}
+}
@@ -0,0 +1,167 @@
+package common
+
+// StateKey is the globals key under which the per-parse state is stored. Rule names can
+// never contain a '$', so it can't collide with a rule.
+const StateKey = "$state"
+
+const DefaultTabWidth = 8
+
+// ParseState holds everything that is specific to a single call to Parse. Everything in
+// here that can change during a parse is stored in immutable lists, so taking a snapshot
+// before evaluating an expression and restoring it on a failed match is cheap. The one
+// exception is what is kept for error messages, which has to outlive backtracking.
+type ParseState struct {
+	TabWidth int
+
+	// User is whatever the caller passed along for this parse. It isn't restored when
+	// backtracking, so anything that changes during the parse belongs in Set instead.
+	User any
+
+	Limits Limits
+	depth  int
+	steps  int
+
+	indents  *indentLevel
+	vars     *stateVar
+	captures *capture
+
+	ruleStack []string
+	labels    []failureLabel
+	failure   *furthestFailure
+}
+
+type indentLevel struct {
+	width  int
+	parent *indentLevel
+}
+
+type stateVar struct {
+	key    string
+	val    any
+	parent *stateVar
+}
+
+// capture is text captured by name within a rule. A capture with no name marks where the
+// captures of the current rule invocation begin.
+type capture struct {
+	name   string
+	text   string
+	parent *capture
+}
+
+type StateSnapshot struct {
+	indents  *indentLevel
+	vars     *stateVar
+	captures *capture
+}
+
+func NewParseState(tabWidth int) *ParseState {
+	if tabWidth <= 0 {
+		tabWidth = DefaultTabWidth
+	}
+
+	return &ParseState{TabWidth: tabWidth}
+}
+
+func GetState(globals map[string]any) *ParseState {
+	state, _ := globals[StateKey].(*ParseState)
+	return state
+}
+
+func (s *ParseState) Snapshot() StateSnapshot {
+	return StateSnapshot{s.indents, s.vars, s.captures}
+}
+
+func (s *ParseState) Restore(snapshot StateSnapshot) {
+	s.indents = snapshot.indents
+	s.vars = snapshot.vars
+	s.captures = snapshot.captures
+}
+
+// Get returns the most recent value stored under key, and whether there was one.
+func (s *ParseState) Get(key string) (any, bool) {
+	for v := s.vars; v != nil; v = v.parent {
+		if v.key == key {
+			return v.val, true
+		}
+	}
+
+	return nil, false
+}
+
+// Set stores a value under key. Like everything else in the state, it is undone if the
+// expression that set it ends up not matching.
+func (s *ParseState) Set(key string, val any) {
+	s.vars = &stateVar{key, val, s.vars}
+}
+
+// IndentLevel returns the width of the innermost indentation level, which is zero when
+// nothing has been indented yet.
+func (s *ParseState) IndentLevel() int {
+	if s.indents == nil {
+		return 0
+	}
+
+	return s.indents.width
+}
+
+func (s *ParseState) PushIndent(width int) {
+	s.indents = &indentLevel{width, s.indents}
+}
+
+func (s *ParseState) PopIndent() bool {
+	if s.indents == nil {
+		return false
+	}
+
+	s.indents = s.indents.parent
+	return true
+}
+
+// IndentWidth returns the printed width of a run of leading whitespace, with tabs
+// advancing to the next multiple of TabWidth.
+func (s *ParseState) IndentWidth(indentation string) int {
+	width := 0
+
+	for _, ch := range indentation {
+		if ch == '\t' {
+			width += s.TabWidth - width%s.TabWidth
+		} else {
+			width++
+		}
+	}
+
+	return width
+}
+
+type CaptureScope struct {
+	captures *capture
+}
+
+// EnterScope starts a new set of captures for a rule invocation. The returned scope has to
+// be handed to ExitScope once the rule is done.
+func (s *ParseState) EnterScope() CaptureScope {
+	outer := CaptureScope{s.captures}
+	s.captures = &capture{parent: s.captures}
+	return outer
+}
+
+func (s *ParseState) ExitScope(outer CaptureScope) {
+	s.captures = outer.captures
+}
+
+func (s *ParseState) Capture(name, text string) {
+	s.captures = &capture{name, text, s.captures}
+}
+
+// Captured returns the text most recently captured under name in the current rule
+// invocation.
+func (s *ParseState) Captured(name string) (string, bool) {
+	for c := s.captures; c != nil && c.name != ""; c = c.parent {
+		if c.name == name {
+			return c.text, true
+		}
+	}
+
+	return "", false
+}
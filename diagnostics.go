@@ -0,0 +1,306 @@
+package parsley
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Rule IDs say what kind of problem a Diagnostic is about. They don't change between
+// versions, so tools can filter on them.
+const (
+	RuleSyntaxError     = "syntax-error"
+	RuleGrammarError    = "grammar-error"
+	RuleMissingStart    = "missing-start-rule"
+	RuleUndefinedRule   = "undefined-rule"
+	RuleLeftRecursion   = "left-recursion"
+	RuleEmptyRepetition = "empty-repetition"
+	RuleUnusedRule      = "unused-rule"
+	RuleInternalError   = "internal-error"
+)
+
+// ruleDescriptions are the short descriptions that SARIF output gives for each rule ID.
+var ruleDescriptions = map[string]string{
+	RuleSyntaxError:     "The input doesn't match the grammar.",
+	RuleGrammarError:    "The grammar can't be read.",
+	RuleMissingStart:    "The grammar has no input rule to start parsing from.",
+	RuleUndefinedRule:   "A rule refers to a rule that doesn't exist.",
+	RuleLeftRecursion:   "A rule can refer back to itself without consuming any input.",
+	RuleEmptyRepetition: "A repetition can match nothing, so it never ends.",
+	RuleUnusedRule:      "A rule can't be reached from the input rule.",
+	RuleInternalError:   "Parsing stopped because of something other than the input.",
+}
+
+// Diagnostic is a problem with an input or a grammar, in a form that is meant to be
+// written out as JSON and read by other tools. Its JSON encoding is stable.
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	RuleID   string   `json:"ruleId"`
+	Message  string   `json:"message"`
+
+	// Span is missing for problems that can't be pinned down to a place in a file, like
+	// most problems with a grammar.
+	Span *Span `json:"span,omitempty"`
+
+	// Expected and RuleStack are the same as the Expected and Rules of a ParseError.
+	Expected  []string `json:"expected,omitempty"`
+	RuleStack []string `json:"ruleStack,omitempty"`
+}
+
+// Span is a range in a file. The end is exclusive.
+type Span struct {
+	File  string   `json:"file,omitempty"`
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// Position is a place in a file. Offset counts bytes from zero. Line and Column count from
+// one, with Column counting runes. UTF16Column counts UTF-16 code units from zero, like
+// LSP clients do.
+type Position struct {
+	Offset      int `json:"offset"`
+	Line        int `json:"line"`
+	Column      int `json:"column"`
+	UTF16Column int `json:"utf16Column"`
+}
+
+// String returns the diagnostic the way compilers print them, as
+// path:line:col: severity: message, leaving out whatever parts of the position it has no
+// value for.
+func (d Diagnostic) String() string {
+	var location string
+
+	if d.Span != nil && d.Span.File != "" {
+		location = d.Span.File + ":"
+	}
+
+	if d.Span != nil && d.Span.Start.Line > 0 {
+		location += fmt.Sprintf("%d:%d:", d.Span.Start.Line, d.Span.Start.Column)
+	}
+
+	if location != "" {
+		location += " "
+	}
+
+	return fmt.Sprintf("%s%s: %s [%s]", location, d.Severity, d.Message, d.RuleID)
+}
+
+func newPosition(pos common.StringPos) Position {
+	return Position{pos.Pos, pos.Line + 1, pos.Col + 1, pos.UTF16Col}
+}
+
+// Diagnostic converts the error to a Diagnostic. Its span covers the character the error
+// is at, or nothing at all at the end of a line or of the input.
+func (e ParseError) Diagnostic() Diagnostic {
+	end := e.Loc
+
+	if offset := e.Loc.Pos; offset < len(e.Contents) && e.Contents[offset] != '\n' && e.Contents[offset] != '\r' {
+		ch, size := utf8.DecodeRuneInString(e.Contents[offset:])
+		end.Pos += size
+		end.Col++
+		end.ByteCol += size
+		end.UTF16Col += utf16Width(ch)
+	}
+
+	return Diagnostic{
+		Severity:  SeverityError,
+		RuleID:    RuleSyntaxError,
+		Message:   e.Message(),
+		Span:      &Span{e.Loc.File, newPosition(e.Loc), newPosition(end)},
+		Expected:  e.Expected,
+		RuleStack: e.Rules,
+	}
+}
+
+func utf16Width(ch rune) int {
+	if ch >= 0x10000 {
+		return 2
+	}
+
+	return 1
+}
+
+// ErrorDiagnostic converts an error from parsing file to a Diagnostic. A ParseError keeps
+// its position, and anything else, like a limit being reached, becomes an internal-error
+// about file as a whole.
+func ErrorDiagnostic(file string, err error) Diagnostic {
+	var parseErr ParseError
+
+	if errors.As(err, &parseErr) {
+		return parseErr.Diagnostic()
+	}
+
+	return Diagnostic{Severity: SeverityError, RuleID: RuleInternalError, Message: err.Error(), Span: &Span{File: file}}
+}
+
+// GrammarErrorDiagnostic converts an error from reading the grammar in file to a
+// Diagnostic. A GrammarError is placed where it was found, which can be in a file that
+// file imports, and anything else is about file as a whole.
+func GrammarErrorDiagnostic(file string, err error) Diagnostic {
+	var grammarErr GrammarError
+
+	if errors.As(err, &grammarErr) {
+		pos := newPosition(grammarErr.Loc)
+
+		if grammarErr.Loc.File != "" {
+			file = grammarErr.Loc.File
+		}
+
+		return Diagnostic{Severity: SeverityError, RuleID: RuleGrammarError, Message: grammarErr.Err.Error(), Span: &Span{file, pos, pos}}
+	}
+
+	return Diagnostic{Severity: SeverityError, RuleID: RuleGrammarError, Message: err.Error(), Span: &Span{File: file}}
+}
+
+// WriteJSON writes diagnostics as a JSON array.
+func WriteJSON(w io.Writer, diagnostics []Diagnostic) error {
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+
+	return encoder.Encode(diagnostics)
+}
+
+// The parts of SARIF 2.1.0 that diagnostics need.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// sarifRegion uses lines and columns counting from one, with columns counted in runes,
+// which is what SARIF calls the unicodeCodePoints column kind.
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+	EndLine     int `json:"endLine"`
+	EndColumn   int `json:"endColumn"`
+	ByteOffset  int `json:"byteOffset"`
+	ByteLength  int `json:"byteLength"`
+}
+
+// WriteSARIF writes diagnostics as a SARIF 2.1.0 log with a single run. Diagnostics
+// without a file can't be shown next to any code, but are still part of the log.
+func WriteSARIF(w io.Writer, diagnostics []Diagnostic) error {
+	rules := []sarifRule{}
+	ruleIndexes := map[string]int{}
+	results := []sarifResult{}
+
+	for _, diagnostic := range diagnostics {
+		index, found := ruleIndexes[diagnostic.RuleID]
+
+		if !found {
+			index = len(rules)
+			ruleIndexes[diagnostic.RuleID] = index
+			rules = append(rules, sarifRule{diagnostic.RuleID, sarifMessage{ruleDescriptions[diagnostic.RuleID]}})
+		}
+
+		result := sarifResult{
+			RuleID:    diagnostic.RuleID,
+			RuleIndex: index,
+			Level:     string(diagnostic.Severity),
+			Message:   sarifMessage{diagnostic.Message},
+		}
+
+		if span := diagnostic.Span; span != nil && span.File != "" {
+			location := sarifLocation{sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{span.File}}}
+
+			if span.Start.Line > 0 {
+				location.PhysicalLocation.Region = &sarifRegion{
+					StartLine:   span.Start.Line,
+					StartColumn: span.Start.Column,
+					EndLine:     span.End.Line,
+					EndColumn:   span.End.Column,
+					ByteOffset:  span.Start.Offset,
+					ByteLength:  span.End.Offset - span.Start.Offset,
+				}
+			}
+
+			result.Locations = []sarifLocation{location}
+		}
+
+		results = append(results, result)
+	}
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{sarifDriver{
+				Name:           "parsley",
+				InformationURI: "https://github.com/l-donovan/parsley",
+				Rules:          rules,
+			}},
+			ColumnKind: "unicodeCodePoints",
+			Results:    results,
+		}},
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+
+	return encoder.Encode(log)
+}
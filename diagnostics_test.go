@@ -0,0 +1,149 @@
+package parsley
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+func TestParseErrorDiagnostic(t *testing.T) {
+	grammar, err := ParseGrammar("input: pair*\npair: name \"=\" name \";\"\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = grammar.ParseSource(common.NewSource("pairs.txt", "a=b;\ncd=é"))
+	diagnostic := ErrorDiagnostic("pairs.txt", err)
+
+	want := Diagnostic{
+		Severity: SeverityError,
+		RuleID:   RuleSyntaxError,
+		Message:  "unknown token",
+		Span: &Span{
+			File:  "pairs.txt",
+			Start: Position{Offset: 8, Line: 2, Column: 4, UTF16Column: 3},
+			// The span covers all of the two bytes of é
+			End: Position{Offset: 10, Line: 2, Column: 5, UTF16Column: 4},
+		},
+		Expected:  []string{"/[a-z]+/"},
+		RuleStack: []string{"pair", "name"},
+	}
+
+	if !reflect.DeepEqual(diagnostic, want) {
+		t.Errorf("got %#v, want %#v", diagnostic, want)
+	}
+
+	if got := diagnostic.String(); got != "pairs.txt:2:4: error: unknown token [syntax-error]" {
+		t.Errorf("got %q", got)
+	}
+
+	// A parse error at the end of the input has an empty span
+	_, err = grammar.Parse("a=")
+	diagnostic = ErrorDiagnostic("pairs.txt", err)
+
+	if diagnostic.Span.Start != diagnostic.Span.End {
+		t.Errorf("got span %+v, want an empty one", *diagnostic.Span)
+	}
+
+	diagnostic = ErrorDiagnostic("pairs.txt", errors.New("out of steps"))
+
+	if got := diagnostic.String(); got != "pairs.txt: error: out of steps [internal-error]" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var out strings.Builder
+
+	if err := WriteJSON(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.TrimSpace(out.String()); got != "[]" {
+		t.Errorf("got %s for no diagnostics, want []", got)
+	}
+
+	out.Reset()
+	diagnostics := []Diagnostic{
+		{Severity: SeverityWarning, RuleID: RuleUnusedRule, Message: "rule name is never used", Span: &Span{File: "a.parsley"}},
+		{Severity: SeverityError, RuleID: RuleInternalError, Message: "out of steps"},
+	}
+
+	if err := WriteJSON(&out, diagnostics); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []map[string]any
+
+	if err := json.Unmarshal([]byte(out.String()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded[0]["ruleId"] != RuleUnusedRule || decoded[0]["severity"] != "warning" {
+		t.Errorf("got %v", decoded[0])
+	}
+
+	if _, hasSpan := decoded[1]["span"]; hasSpan {
+		t.Errorf("got a span for a diagnostic without one: %v", decoded[1])
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	grammar, err := ParseGrammar("input: name*\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = grammar.ParseSource(common.NewSource("words.txt", "ab\ncd 12"))
+
+	diagnostics := []Diagnostic{
+		ErrorDiagnostic("words.txt", err),
+		{Severity: SeverityWarning, RuleID: RuleUnusedRule, Message: "rule number is never used", Span: &Span{File: "words.parsley"}},
+		{Severity: SeverityError, RuleID: RuleSyntaxError, Message: "unknown token"},
+	}
+
+	var out strings.Builder
+
+	if err := WriteSARIF(&out, diagnostics); err != nil {
+		t.Fatal(err)
+	}
+
+	var log sarifLog
+
+	if err := json.Unmarshal([]byte(out.String()), &log); err != nil {
+		t.Fatal(err)
+	}
+
+	run := log.Runs[0]
+
+	// Each rule ID is only described once
+	if len(run.Tool.Driver.Rules) != 2 || run.Tool.Driver.Rules[0].ID != RuleSyntaxError || run.Tool.Driver.Rules[1].ID != RuleUnusedRule {
+		t.Errorf("got rules %+v", run.Tool.Driver.Rules)
+	}
+
+	indexes := []int{run.Results[0].RuleIndex, run.Results[1].RuleIndex, run.Results[2].RuleIndex}
+
+	if !reflect.DeepEqual(indexes, []int{0, 1, 0}) {
+		t.Errorf("got rule indexes %v", indexes)
+	}
+
+	wantRegion := sarifRegion{StartLine: 2, StartColumn: 4, EndLine: 2, EndColumn: 5, ByteOffset: 6, ByteLength: 1}
+
+	if region := run.Results[0].Locations[0].PhysicalLocation.Region; region == nil || *region != wantRegion {
+		t.Errorf("got region %+v, want %+v", region, wantRegion)
+	}
+
+	if location := run.Results[1].Locations[0].PhysicalLocation; location.ArtifactLocation.URI != "words.parsley" || location.Region != nil {
+		t.Errorf("got location %+v", location)
+	}
+
+	if len(run.Results[2].Locations) != 0 {
+		t.Errorf("got locations %+v for a diagnostic without a file", run.Results[2].Locations)
+	}
+}
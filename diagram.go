@@ -0,0 +1,607 @@
+package parsley
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// DiagramOptions changes how railroad diagrams are drawn.
+type DiagramOptions struct {
+	// Title is shown at the top of an HTML page of diagrams.
+	Title string
+
+	// Link returns where a reference to a rule links to. Without it, references aren't
+	// linked in an SVG diagram, and link to the rule's own diagram on an HTML page.
+	Link func(rule string) string
+}
+
+// Rules returns the names of the rules in the grammar in the order they were read, with
+// instances of rule templates at the end. Templates themselves are left out, since they
+// can only be used through their instances.
+func (g Grammar) Rules() []string {
+	var names []string
+
+	for _, rule := range g.topLevelExpr.Values["rules"].([]common.Expression) {
+		if _, isTemplate := rule.Values["params"]; !isTemplate {
+			names = append(names, rule.Values["name"].(string))
+		}
+	}
+
+	return names
+}
+
+// findRule returns the rule with the given name, which can't be a template.
+func (g Grammar) findRule(name string) (common.Expression, bool) {
+	for _, rule := range g.topLevelExpr.Values["rules"].([]common.Expression) {
+		if _, isTemplate := rule.Values["params"]; !isTemplate && rule.Values["name"].(string) == name {
+			return rule, true
+		}
+	}
+
+	return common.Empty, false
+}
+
+// WriteDiagram writes a railroad diagram of a rule as a standalone SVG image.
+func (g Grammar) WriteDiagram(w io.Writer, rule string, opts DiagramOptions) error {
+	expr, found := g.findRule(rule)
+
+	if !found {
+		return fmt.Errorf("could not find rule with name %s", rule)
+	}
+
+	var out strings.Builder
+	g.diagram(&out, expr, opts.Link, true)
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// WriteDiagramHTML writes a page with a railroad diagram for every rule, in the order of
+// Rules, and an index of them at the top. Each diagram can be linked to as #rule-name.
+func (g Grammar) WriteDiagramHTML(w io.Writer, opts DiagramOptions) error {
+	title := opts.Title
+
+	if title == "" {
+		title = "Grammar"
+	}
+
+	link := opts.Link
+
+	if link == nil {
+		link = func(rule string) string { return "#" + diagramID(rule) }
+	}
+
+	var out strings.Builder
+
+	out.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&out, "<title>%s</title>\n", html.EscapeString(title))
+	out.WriteString("<style>\nbody { font-family: sans-serif; margin: 2em; }\nsection { margin: 1em 0; overflow-x: auto; }\n" + diagramStyle + "</style>\n")
+	fmt.Fprintf(&out, "</head>\n<body>\n<h1>%s</h1>\n<ul>\n", html.EscapeString(title))
+
+	for _, name := range g.Rules() {
+		fmt.Fprintf(&out, "<li><a href=\"#%s\">%s</a></li>\n", html.EscapeString(diagramID(name)), html.EscapeString(name))
+	}
+
+	out.WriteString("</ul>\n")
+
+	for _, name := range g.Rules() {
+		rule, _ := g.findRule(name)
+
+		fmt.Fprintf(&out, "<section id=\"%s\">\n", html.EscapeString(diagramID(name)))
+		g.diagram(&out, rule, link, false)
+		out.WriteString("</section>\n")
+	}
+
+	out.WriteString("</body>\n</html>\n")
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// diagramID is the id of a rule's diagram on an HTML page. Template instances have all
+// sorts of characters in their names, so anything but a letter, digit, dot, dash or
+// underscore is replaced.
+func diagramID(rule string) string {
+	return "rule-" + strings.Map(func(ch rune) rune {
+		if ch < utf8.RuneSelf && (ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '.' || ch == '-' || ch == '_') {
+			return ch
+		}
+
+		return '_'
+	}, rule)
+}
+
+const diagramStyle = `svg.railroad path { fill: none; stroke: #333; stroke-width: 2; }
+svg.railroad rect { stroke: #333; stroke-width: 2; }
+svg.railroad rect.terminal { fill: #dfd; }
+svg.railroad rect.nonterminal { fill: #ddf; }
+svg.railroad rect.regex { fill: #ffd; }
+svg.railroad rect.special { fill: #eee; }
+svg.railroad rect.group { fill: none; stroke: #999; stroke-width: 1; stroke-dasharray: 4 3; }
+svg.railroad text { font: 13px monospace; fill: #000; }
+svg.railroad text.label { font: 11px sans-serif; fill: #666; }
+svg.railroad text.name { font: bold 14px sans-serif; }
+svg.railroad a text { fill: #00c; text-decoration: underline; }
+`
+
+// Sizes in a diagram, in pixels. Text is monospace, so its width only depends on how
+// many characters there are.
+const (
+	railRadius     = 10
+	railGap        = 10
+	railPadding    = 20
+	railBoxHeight  = 22
+	railCharWidth  = 8
+	railLabelWidth = 7
+	railLabelSize  = 14
+	railMaxText    = 48
+)
+
+// diagram writes the SVG element for a rule. Only a standalone image needs the style and
+// the XML namespace.
+func (g Grammar) diagram(out *strings.Builder, rule common.Expression, link func(string) string, standalone bool) {
+	d := diagrammer{link: link, rules: map[string]bool{}}
+
+	for _, name := range g.Rules() {
+		d.rules[name] = true
+	}
+
+	name := rule.Values["name"].(string)
+	body := d.sequence(rule.Values["contents"].([]common.Expression))
+
+	if label, labeled := rule.Values["label"].(string); labeled {
+		body = &railGroup{child: body, label: "error: " + label}
+	}
+
+	bodyWidth, up, down := body.size()
+	width := max(2*railPadding+bodyWidth+2*railPadding, 2*railPadding+utf8.RuneCountInString(name)*railCharWidth)
+	height := railPadding + railLabelSize + up + down + railPadding
+	y := railPadding + railLabelSize + up
+
+	if standalone {
+		fmt.Fprintf(out, "<svg xmlns=\"http://www.w3.org/2000/svg\" class=\"railroad\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", width, height, width, height)
+		out.WriteString("<style>\n" + diagramStyle + "</style>\n")
+	} else {
+		fmt.Fprintf(out, "<svg class=\"railroad\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", width, height, width, height)
+	}
+
+	s := svgWriter{out}
+	fmt.Fprintf(out, "<text class=\"name\" x=\"%d\" y=\"%d\">%s</text>\n", railPadding, railPadding, html.EscapeString(name))
+
+	// Double bars mark where the rule starts and ends
+	x := railPadding
+	s.path("M%d %dv%dM%d %dv%dM%d %dH%d", x, y-8, 16, x+4, y-8, 16, x, y, x+railPadding)
+	body.render(s, x+railPadding, y)
+
+	x += railPadding + bodyWidth
+	s.path("M%d %dH%dM%d %dv%dM%d %dv%d", x, y, x+railPadding, x+railPadding-4, y-8, 16, x+railPadding, y-8, 16)
+
+	out.WriteString("</svg>\n")
+}
+
+type diagrammer struct {
+	link  func(string) string
+	rules map[string]bool
+}
+
+// node lays out an expression. Anything the diagram has no shape of its own for is shown
+// the way it's written in the grammar.
+func (d diagrammer) node(expr common.Expression) railNode {
+	switch expr.Definition {
+	case &Group:
+		return d.sequence(expr.Values["groupItems"].([]common.Expression))
+	case &Union:
+		var branches railChoice
+
+		for _, item := range expr.Values["unionItems"].([]common.Expression) {
+			branches = append(branches, d.node(item))
+		}
+
+		return branches
+	case &Or:
+		// Each side of an Or is tried in turn, so any of them can be left out, but not all
+		var operands railSequence
+
+		for expr.Definition == &Or {
+			operands = append(operands, &railOptional{child: d.node(expr.Values["lhs"].(common.Expression))})
+			expr = expr.Values["rhs"].(common.Expression)
+		}
+
+		operands = append(operands, &railOptional{child: d.node(expr)})
+
+		return &railGroup{child: operands, label: "at least one of, in order"}
+	case &ExclusiveOr:
+		branches := railChoice{d.node(expr.Values["lhs"].(common.Expression)), d.node(expr.Values["rhs"].(common.Expression))}
+		return &railGroup{child: branches, label: "exactly one of"}
+	case &ZeroOrMore:
+		return &railOptional{child: &railLoop{child: d.node(expr.Values["expr"].(common.Expression))}}
+	case &OneOrMore:
+		return &railLoop{child: d.node(expr.Values["expr"].(common.Expression))}
+	case &ZeroOrOne:
+		return &railOptional{child: d.node(expr.Values["expr"].(common.Expression))}
+	case &Repeat:
+		return d.repeat(d.node(expr.Values["expr"].(common.Expression)), expr.Values["min"].(int), expr.Values["max"].(int))
+	case &Separated:
+		separator := d.node(expr.Values["separator"].(common.Expression))
+		var list railNode = &railLoop{child: d.node(expr.Values["item"].(common.Expression)), separator: separator}
+
+		if expr.Values["trailing"].(bool) {
+			list = railSequence{list, &railOptional{child: separator}}
+		}
+
+		if !expr.Values["nonEmpty"].(bool) {
+			list = &railOptional{child: list}
+		}
+
+		return list
+	case &Capture:
+		return &railGroup{child: d.node(expr.Values["expr"].(common.Expression)), label: expr.Values["name"].(string) + "="}
+	case &Labeled:
+		return &railGroup{child: d.node(expr.Values["expr"].(common.Expression)), label: "error: " + expr.Values["message"].(string)}
+	case &Embedded:
+		return &railGroup{child: d.node(expr.Values["expr"].(common.Expression)), label: "embed " + expr.Values["grammar"].(string)}
+	case &RuleRef:
+		ref := expr.Values["ref"].(string)
+		box := &railBox{text: ref, class: "nonterminal"}
+
+		// References to rules that don't exist have nothing to link to
+		if d.link != nil && d.rules[ref] {
+			box.href = d.link(ref)
+		}
+
+		return box
+	case &StringLiteral:
+		return &railBox{text: `"` + expr.Values["val"].(string) + `"`, class: "terminal", rounded: true}
+	case &RegularExpression:
+		return &railBox{text: "/" + expr.Values["source"].(string) + "/", class: "regex"}
+	}
+
+	return &railBox{text: serialized(expr), class: "special"}
+}
+
+// sequence lays out expressions one after the other. A sequence of one is just that one.
+func (d diagrammer) sequence(exprs []common.Expression) railNode {
+	if len(exprs) == 1 {
+		return d.node(exprs[0])
+	}
+
+	items := make(railSequence, len(exprs))
+
+	for i, expr := range exprs {
+		items[i] = d.node(expr)
+	}
+
+	return items
+}
+
+// repeat lays out a bounded repetition as a loop labeled with how many times it goes
+// around. Bounds that ZeroOrMore, OneOrMore or ZeroOrOne could have been used for look
+// just like them.
+func (d diagrammer) repeat(child railNode, minCount, maxCount int) railNode {
+	switch {
+	case maxCount == 0:
+		return railSequence{}
+	case maxCount == 1 && minCount == 0:
+		return &railOptional{child: child}
+	case maxCount == 1:
+		return child
+	}
+
+	loop := &railLoop{child: child}
+
+	switch {
+	case minCount == maxCount:
+		loop.label = fmt.Sprintf("%d times", minCount)
+	case maxCount < 0 && minCount > 1:
+		loop.label = fmt.Sprintf("at least %d times", minCount)
+	case maxCount > 0 && minCount == 0:
+		loop.label = fmt.Sprintf("at most %d times", maxCount)
+	case maxCount > 0:
+		loop.label = fmt.Sprintf("%d to %d times", minCount, maxCount)
+	}
+
+	if minCount == 0 {
+		return &railOptional{child: loop}
+	}
+
+	return loop
+}
+
+// railNode is a piece of a railroad diagram. The track enters it on the left and leaves
+// on the right at the same height, and up and down are how far it reaches above and below
+// that track.
+type railNode interface {
+	size() (width, up, down int)
+	render(s svgWriter, x, y int)
+}
+
+type svgWriter struct {
+	out *strings.Builder
+}
+
+func (s svgWriter) path(format string, args ...any) {
+	fmt.Fprintf(s.out, "<path d=\""+format+"\"/>\n", args...)
+}
+
+func (s svgWriter) line(x1, x2, y int) {
+	if x1 != x2 {
+		s.path("M%d %dH%d", x1, y, x2)
+	}
+}
+
+func (s svgWriter) label(x, y int, anchor, text string) {
+	fmt.Fprintf(s.out, "<text class=\"label\" x=\"%d\" y=\"%d\" text-anchor=\"%s\">%s</text>\n", x, y, anchor, html.EscapeString(text))
+}
+
+// railBox is a single item: a literal, a regular expression, a rule or anything else that
+// doesn't contain other expressions. Text that is too long is cut short, and shown in
+// full when hovered over.
+type railBox struct {
+	text    string
+	class   string
+	href    string
+	rounded bool
+}
+
+func (b *railBox) shown() string {
+	if utf8.RuneCountInString(b.text) <= railMaxText {
+		return b.text
+	}
+
+	return string([]rune(b.text)[:railMaxText-1]) + "…"
+}
+
+func (b *railBox) size() (int, int, int) {
+	return utf8.RuneCountInString(b.shown())*railCharWidth + 2*railGap, railBoxHeight / 2, railBoxHeight / 2
+}
+
+func (b *railBox) render(s svgWriter, x, y int) {
+	width, up, _ := b.size()
+	corner := 0
+
+	if b.rounded {
+		corner = railBoxHeight / 2
+	}
+
+	if b.href != "" {
+		fmt.Fprintf(s.out, "<a href=\"%s\">\n", html.EscapeString(b.href))
+	}
+
+	fmt.Fprintf(s.out, "<rect class=\"%s\" x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"%d\"/>\n", b.class, x, y-up, width, railBoxHeight, corner)
+	fmt.Fprintf(s.out, "<text x=\"%d\" y=\"%d\" text-anchor=\"middle\">", x+width/2, y+4)
+
+	if b.shown() != b.text {
+		fmt.Fprintf(s.out, "<title>%s</title>", html.EscapeString(b.text))
+	}
+
+	fmt.Fprintf(s.out, "%s</text>\n", html.EscapeString(b.shown()))
+
+	if b.href != "" {
+		s.out.WriteString("</a>\n")
+	}
+}
+
+// railSequence is items one after the other. An empty sequence matches nothing, and is
+// just as wide.
+type railSequence []railNode
+
+func (q railSequence) size() (int, int, int) {
+	width, up, down := 0, 0, 0
+
+	for i, item := range q {
+		itemWidth, itemUp, itemDown := item.size()
+
+		if i > 0 {
+			width += railGap
+		}
+
+		width += itemWidth
+		up = max(up, itemUp)
+		down = max(down, itemDown)
+	}
+
+	return width, up, down
+}
+
+func (q railSequence) render(s svgWriter, x, y int) {
+	for i, item := range q {
+		if i > 0 {
+			s.line(x, x+railGap, y)
+			x += railGap
+		}
+
+		width, _, _ := item.size()
+		item.render(s, x, y)
+		x += width
+	}
+}
+
+// railChoice is branches stacked on top of each other, with the first one on the track.
+type railChoice []railNode
+
+// offsets returns how far below the track each branch is.
+func (c railChoice) offsets() []int {
+	offsets := make([]int, len(c))
+	_, _, prevDown := c[0].size()
+
+	for i := 1; i < len(c); i++ {
+		_, up, down := c[i].size()
+		offsets[i] = offsets[i-1] + max(2*railRadius, prevDown+railGap+up)
+		prevDown = down
+	}
+
+	return offsets
+}
+
+func (c railChoice) size() (int, int, int) {
+	inner := 0
+
+	for _, branch := range c {
+		width, _, _ := branch.size()
+		inner = max(inner, width)
+	}
+
+	offsets := c.offsets()
+	_, up, _ := c[0].size()
+	_, _, down := c[len(c)-1].size()
+
+	return inner + 4*railRadius, up, offsets[len(c)-1] + down
+}
+
+func (c railChoice) render(s svgWriter, x, y int) {
+	width, _, _ := c.size()
+	start, end := x+2*railRadius, x+width-2*railRadius
+	r := railRadius
+
+	for i, offset := range c.offsets() {
+		branchWidth, _, _ := c[i].size()
+		branchY := y + offset
+
+		if i == 0 {
+			s.line(x, start, y)
+		} else {
+			s.path("M%d %da%d %d 0 0 1 %d %dV%da%d %d 0 0 0 %d %d", x, y, r, r, r, r, branchY-r, r, r, r, r)
+		}
+
+		c[i].render(s, start, branchY)
+
+		if i == 0 {
+			s.line(start+branchWidth, x+width, y)
+		} else {
+			s.path("M%d %dH%da%d %d 0 0 0 %d %dV%da%d %d 0 0 1 %d %d", start+branchWidth, branchY, end, r, r, r, -r, y+r, r, r, r, -r)
+		}
+	}
+}
+
+// railOptional is its child on the track, with a way around it above.
+type railOptional struct {
+	child railNode
+}
+
+func (o *railOptional) skip() int {
+	_, up, _ := o.child.size()
+	return max(2*railRadius, up+railGap)
+}
+
+func (o *railOptional) size() (int, int, int) {
+	width, _, down := o.child.size()
+	return width + 4*railRadius, o.skip(), down
+}
+
+func (o *railOptional) render(s svgWriter, x, y int) {
+	childWidth, _, _ := o.child.size()
+	width := childWidth + 4*railRadius
+	r, top := railRadius, y-o.skip()
+
+	s.line(x, x+2*r, y)
+	o.child.render(s, x+2*r, y)
+	s.line(x+2*r+childWidth, x+width, y)
+	s.path("M%d %da%d %d 0 0 0 %d %dV%da%d %d 0 0 1 %d %dH%da%d %d 0 0 1 %d %dV%da%d %d 0 0 0 %d %d", x, y, r, r, r, -r, top+r, r, r, r, -r, x+width-2*r, r, r, r, r, y-r, r, r, r, r)
+}
+
+// railLoop is its child on the track, with a way back to the start below it that goes
+// through the separator, if there is one. The label says how many times it goes around.
+type railLoop struct {
+	child     railNode
+	separator railNode
+	label     string
+}
+
+func (l *railLoop) inner() int {
+	width, _, _ := l.child.size()
+
+	if l.separator != nil {
+		separatorWidth, _, _ := l.separator.size()
+		width = max(width, separatorWidth)
+	}
+
+	return max(width, utf8.RuneCountInString(l.label)*railLabelWidth)
+}
+
+// back returns how far below the track the way back is, and how far the separator and
+// label reach below that.
+func (l *railLoop) back() (int, int) {
+	_, _, childDown := l.child.size()
+	separatorUp, separatorDown := 0, 0
+
+	if l.separator != nil {
+		_, separatorUp, separatorDown = l.separator.size()
+	}
+
+	if l.label != "" {
+		separatorDown += railLabelSize
+	}
+
+	return max(2*railRadius, childDown+railGap+separatorUp), separatorDown
+}
+
+func (l *railLoop) size() (int, int, int) {
+	_, up, _ := l.child.size()
+	offset, below := l.back()
+
+	return l.inner() + 2*railRadius, up, offset + below
+}
+
+func (l *railLoop) render(s svgWriter, x, y int) {
+	childWidth, _, _ := l.child.size()
+	width := l.inner() + 2*railRadius
+	childX := x + (width-childWidth)/2
+	offset, below := l.back()
+	r, backY := railRadius, y+offset
+
+	s.line(x, childX, y)
+	l.child.render(s, childX, y)
+	s.line(childX+childWidth, x+width, y)
+
+	// The way back goes from right to left
+	s.path("M%d %da%d %d 0 0 1 %d %dV%da%d %d 0 0 1 %d %d", x+width-r, y, r, r, r, r, backY-r, r, r, -r, r)
+
+	left := x + width - r
+
+	if l.separator != nil {
+		separatorWidth, _, _ := l.separator.size()
+		separatorX := x + (width-separatorWidth)/2
+
+		s.line(left, separatorX+separatorWidth, backY)
+		l.separator.render(s, separatorX, backY)
+		left = separatorX
+	}
+
+	s.path("M%d %dH%da%d %d 0 0 1 %d %dV%da%d %d 0 0 1 %d %d", left, backY, x+r, r, r, -r, -r, y+r, r, r, r, -r)
+
+	if l.label != "" {
+		s.label(x+width/2, backY+below-3, "middle", l.label)
+	}
+}
+
+// railGroup draws a dashed box around its child, labeled with what the box means.
+type railGroup struct {
+	child railNode
+	label string
+}
+
+func (g *railGroup) size() (int, int, int) {
+	width, up, down := g.child.size()
+	width = max(width, utf8.RuneCountInString(g.label)*railLabelWidth)
+
+	return width + 2*railGap, up + railGap + railLabelSize, down + railGap
+}
+
+func (g *railGroup) render(s svgWriter, x, y int) {
+	width, _, _ := g.size()
+	childWidth, up, down := g.child.size()
+	childX := x + (width-childWidth)/2
+	top := y - up - railGap
+
+	s.line(x, childX, y)
+	g.child.render(s, childX, y)
+	s.line(childX+childWidth, x+width, y)
+
+	fmt.Fprintf(s.out, "<rect class=\"group\" x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" rx=\"%d\"/>\n", x, top, width, up+down+2*railGap, railRadius/2)
+	s.label(x+2, top-4, "start", g.label)
+}
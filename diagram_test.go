@@ -0,0 +1,172 @@
+package parsley
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const diagramGrammar = `input: list(item) @error("bad input")
+list(x): x ("," x)*
+item: <name number> | missing
+name: /[a-z]+/ "<&>"
+number: /[0-9]+/{2,4} tag=name? =tag
+`
+
+// diagramText returns the text in an SVG diagram, along with where its links go. It fails
+// if the diagram isn't well-formed XML.
+func diagramText(t *testing.T, svg string) (texts, links []string) {
+	t.Helper()
+
+	decoder := xml.NewDecoder(strings.NewReader(svg))
+	inText := false
+
+	for {
+		token, err := decoder.Token()
+
+		if errors.Is(err, io.EOF) {
+			return texts, links
+		}
+
+		if err != nil {
+			t.Fatalf("diagram isn't well-formed: %v\n%s", err, svg)
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			inText = token.Name.Local == "text"
+
+			for _, attr := range token.Attr {
+				if token.Name.Local == "a" && attr.Name.Local == "href" {
+					links = append(links, attr.Value)
+				}
+			}
+		case xml.EndElement:
+			inText = false
+		case xml.CharData:
+			if inText {
+				texts = append(texts, string(token))
+			}
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	grammar, err := ParseGrammar(diagramGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Template instances come last, and templates themselves are left out
+	if got, want := grammar.Rules(), []string{"input", "item", "name", "number", "list(item)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWriteDiagram(t *testing.T) {
+	grammar, err := ParseGrammar(diagramGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		rule  string
+		texts []string
+		links []string
+	}{
+		{rule: "name", texts: []string{"name", "/[a-z]+/", `"<&>"`}},
+		{rule: "number", texts: []string{"number", "/[0-9]+/", "2 to 4 times", "name", "tag=", "=tag"}, links: []string{"name.svg"}},
+		{rule: "input", texts: []string{"input", "list(item)", "error: bad input"}, links: []string{"list(item).svg"}},
+		// There's nothing to link to for a rule that doesn't exist
+		{rule: "item", texts: []string{"item", "name", "number", "missing", "at least one of, in order"}, links: []string{"name.svg", "number.svg"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.rule, func(t *testing.T) {
+			var out strings.Builder
+
+			if err := grammar.WriteDiagram(&out, tc.rule, DiagramOptions{Link: func(rule string) string { return rule + ".svg" }}); err != nil {
+				t.Fatal(err)
+			}
+
+			texts, links := diagramText(t, out.String())
+
+			if !reflect.DeepEqual(texts, tc.texts) {
+				t.Errorf("got text %q, want %q", texts, tc.texts)
+			}
+
+			if !reflect.DeepEqual(links, tc.links) {
+				t.Errorf("got links %q, want %q", links, tc.links)
+			}
+		})
+	}
+
+	if err := grammar.WriteDiagram(io.Discard, "list", DiagramOptions{}); err == nil || err.Error() != "could not find rule with name list" {
+		t.Errorf("got error %v for a template", err)
+	}
+}
+
+func TestDiagramRepeatLabels(t *testing.T) {
+	cases := map[string]string{
+		"x{3}":   "3 times",
+		"x{2,}":  "at least 2 times",
+		"x{0,4}": "at most 4 times",
+		"x{2,4}": "2 to 4 times",
+	}
+
+	for repeat, want := range cases {
+		grammar, err := ParseGrammar("input: " + repeat + "\nx: /x/\n")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out strings.Builder
+
+		if err := grammar.WriteDiagram(&out, "input", DiagramOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if texts, _ := diagramText(t, out.String()); !slices.Contains(texts, want) {
+			t.Errorf("%s: got text %q, want a label %q", repeat, texts, want)
+		}
+	}
+}
+
+func TestWriteDiagramHTML(t *testing.T) {
+	grammar, err := ParseGrammar(diagramGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+
+	if err := grammar.WriteDiagramHTML(&out, DiagramOptions{Title: "Items & names"}); err != nil {
+		t.Fatal(err)
+	}
+
+	page := out.String()
+
+	for _, want := range []string{
+		"<title>Items &amp; names</title>",
+		`<li><a href="#rule-list_item_">list(item)</a></li>`,
+		`<section id="rule-list_item_">`,
+		// References link to the diagrams on the same page
+		`<a href="#rule-name">`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page doesn't contain %s:\n%s", want, page)
+		}
+	}
+
+	if sections := strings.Count(page, "<section "); sections != len(grammar.Rules()) {
+		t.Errorf("got %d diagrams, want one for each of %d rules", sections, len(grammar.Rules()))
+	}
+}
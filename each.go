@@ -0,0 +1,93 @@
+package parsley
+
+import (
+	"context"
+	"errors"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// StopParsing can be returned from a ParseEach callback to stop parsing early without
+// ParseEach returning an error.
+var StopParsing = errors.New("stop parsing")
+
+// ParseEach hands each child of the start rule to fn as soon as it has been parsed. If the
+// start rule is a single repetition, like `input: item+`, that is one call per item,
+// and nothing is held on to once fn returns. Any other start rule is parsed completely
+// first. An error returned from fn stops the parse and is returned as is, except for
+// StopParsing.
+func (g Grammar) ParseEach(contents string, fn func(common.TreeItem) error) error {
+	return g.ParseEachContext(context.Background(), contents, ParseOptions{}, fn)
+}
+
+// ParseEachContext is ParseEach with the cancellation and limits of ParseContext.
+func (g Grammar) ParseEachContext(ctx context.Context, contents string, opts ParseOptions, fn func(common.TreeItem) error) error {
+	err := g.parseEach(ctx, contents, opts, fn)
+
+	if errors.Is(err, StopParsing) {
+		return nil
+	}
+
+	return err
+}
+
+func (g Grammar) parseEach(ctx context.Context, contents string, opts ParseOptions, fn func(common.TreeItem) error) error {
+	repetition, ok := g.startRepetition()
+
+	if !ok {
+		result, err := g.ParseContext(ctx, contents, opts)
+
+		if err != nil {
+			return err
+		}
+
+		tree, err := result.Condense()
+
+		if err != nil {
+			return err
+		}
+
+		for _, child := range tree.(common.RuleTreeItem).Children() {
+			if err := fn(child); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if opts.MaxInputSize > 0 && len(contents) > opts.MaxInputSize {
+		return common.InputSizeError{Max: opts.MaxInputSize, Size: len(contents)}
+	}
+
+	stream := newItemStream(g, ctx, nil, opts, repetition)
+	stream.setInput(contents)
+
+	for {
+		result, err := stream.next()
+
+		if err != nil {
+			return err
+		}
+
+		if result == nil {
+			break
+		}
+
+		if common.Discard(result) {
+			continue
+		}
+
+		item, err := result.Condense()
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return stream.end()
+}
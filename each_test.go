@@ -0,0 +1,89 @@
+package parsley
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+func TestParseEach(t *testing.T) {
+	grammar, err := ParseGrammar("input: item*\nitem: name \";\"\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []string
+
+	err = grammar.ParseEach("a; b;\nc;", func(item common.TreeItem) error {
+		items = append(items, item.String())
+		return nil
+	})
+
+	want := []string{"item<[name<[String<a>]>]>", "item<[name<[String<b>]>]>", "item<[name<[String<c>]>]>"}
+
+	if err != nil || !slices.Equal(items, want) {
+		t.Errorf("got %v, %v, want %v", items, err, want)
+	}
+
+	// Items before the error have already been handed over
+	items = nil
+
+	err = grammar.ParseEach("a; b c;", func(item common.TreeItem) error {
+		items = append(items, item.String())
+		return nil
+	})
+
+	if err == nil || len(items) != 1 {
+		t.Errorf("got %v, %v, want one item and an error", items, err)
+	}
+
+	items = nil
+
+	err = grammar.ParseEach("a; b; c;", func(item common.TreeItem) error {
+		items = append(items, item.String())
+
+		if len(items) == 2 {
+			return StopParsing
+		}
+
+		return nil
+	})
+
+	if err != nil || len(items) != 2 {
+		t.Errorf("got %v, %v, want to stop after two items", items, err)
+	}
+
+	errCallback := errors.New("callback failed")
+
+	err = grammar.ParseEach("a; b;", func(item common.TreeItem) error {
+		return errCallback
+	})
+
+	if err != errCallback {
+		t.Errorf("got error %v, want the callback's error", err)
+	}
+}
+
+func TestParseEachWholeInput(t *testing.T) {
+	grammar, err := ParseGrammar("input: name value\nname: /[a-z]+/\nvalue: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []string
+
+	err = grammar.ParseEach("a 1", func(item common.TreeItem) error {
+		items = append(items, item.String())
+		return nil
+	})
+
+	want := []string{"name<[String<a>]>", "value<[String<1>]>"}
+
+	if err != nil || !slices.Equal(items, want) {
+		t.Errorf("got %v, %v, want %v", items, err, want)
+	}
+}
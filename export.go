@@ -0,0 +1,1023 @@
+package parsley
+
+import (
+	"fmt"
+	"io"
+	"regexp/syntax"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// ExportFormat is a notation that Export can write a grammar in.
+type ExportFormat int
+
+const (
+	// ISOEBNF is the EBNF of ISO/IEC 14977.
+	ISOEBNF ExportFormat = iota
+
+	// ABNF is the ABNF of RFC 5234.
+	ABNF
+
+	// W3CEBNF is the EBNF that W3C specifications like XML are written in.
+	W3CEBNF
+)
+
+// exportHeader explains what the notations can't, at the top of every export.
+var exportHeader = []string{
+	"Exported from a parsley grammar, which is a parsing expression grammar.",
+	"Alternatives are tried in order and the first one that matches is used, and repetitions match as many times as they can, without backtracking.",
+	"Whitespace is skipped before every literal and regular expression.",
+}
+
+// Export writes the grammar in another notation, for other parser generators and for
+// specifications. Rules are written in the order of Rules, and regular expressions are
+// written out in the notation as far as it goes.
+//
+// Anything the notation has no equivalent for is written as closely as it can be and
+// explained in a comment above the rule, like literals being left out of the parse tree
+// or the sides of an ExclusiveOr both matching. Things that can only be described in
+// words, like NEWLINE, are referred to by name and described at the end.
+func (g Grammar) Export(w io.Writer, format ExportFormat) error {
+	var n notation
+
+	switch format {
+	case ISOEBNF:
+		n = isoNotation{}
+	case ABNF:
+		n = abnfNotation{}
+	case W3CEBNF:
+		n = w3cNotation{}
+	default:
+		return fmt.Errorf("unknown export format %d", format)
+	}
+
+	e := exporter{notation: n, names: map[string]string{}, used: map[string]bool{}, externalNames: map[string]string{}}
+	rules := g.Rules()
+
+	for _, name := range rules {
+		e.names[name] = e.unique(n.name(name))
+	}
+
+	var out strings.Builder
+
+	for _, line := range exportHeader {
+		out.WriteString(n.comment(line) + "\n")
+	}
+
+	for _, name := range rules {
+		rule, _ := g.findRule(name)
+		e.notes, e.literals, e.captures = nil, nil, map[string]exportNode{}
+
+		body := e.sequence(rule.Values["contents"].([]common.Expression))
+
+		if len(e.literals) > 0 {
+			e.note(joinList(e.literals) + " matched but left out of the parse tree")
+		}
+
+		out.WriteString("\n")
+
+		for _, note := range e.notes {
+			out.WriteString(n.comment(note) + "\n")
+		}
+
+		out.WriteString(n.rule(e.names[name], body) + "\n")
+	}
+
+	if len(e.externals) > 0 {
+		out.WriteString("\n" + n.comment("These can only be described in words.") + "\n")
+
+		for _, external := range e.externals {
+			out.WriteString(n.external(external.name, external.description) + "\n")
+		}
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// joinList joins items into "a", "a are" or "a, b and c are".
+func joinList(items []string) string {
+	if len(items) == 1 {
+		return items[0] + " is"
+	}
+
+	return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1] + " are"
+}
+
+type exportKind int
+
+const (
+	exportSequence exportKind = iota
+	exportChoice
+	exportRepeat
+	exportLiteral
+	exportClass
+	exportRef
+)
+
+// exportNode is a grammar the way the notations see it, which is the same for all of
+// them. Repetitions cover options too, and a max of -1 means there is no upper bound.
+// Classes are pairs of the first and last character of each range in them.
+type exportNode struct {
+	kind     exportKind
+	items    []exportNode
+	min, max int
+	text     string
+	ranges   []rune
+}
+
+// exportSeq is a sequence of items, with sequences in it flattened. A sequence of one is
+// just that one.
+func exportSeq(items ...exportNode) exportNode {
+	var flat []exportNode
+
+	for _, item := range items {
+		if item.kind == exportSequence {
+			flat = append(flat, item.items...)
+		} else {
+			flat = append(flat, item)
+		}
+	}
+
+	if len(flat) == 1 {
+		return flat[0]
+	}
+
+	return exportNode{kind: exportSequence, items: flat}
+}
+
+// exportAlt is a choice between items, with choices in it flattened.
+func exportAlt(items ...exportNode) exportNode {
+	var flat []exportNode
+
+	for _, item := range items {
+		if item.kind == exportChoice {
+			flat = append(flat, item.items...)
+		} else {
+			flat = append(flat, item)
+		}
+	}
+
+	if len(flat) == 1 {
+		return flat[0]
+	}
+
+	return exportNode{kind: exportChoice, items: flat}
+}
+
+// exportRep repeats item. Repeating nothing is still nothing.
+func exportRep(item exportNode, minCount, maxCount int) exportNode {
+	if item.empty() {
+		return item
+	}
+
+	return exportNode{kind: exportRepeat, items: []exportNode{item}, min: minCount, max: maxCount}
+}
+
+func (node exportNode) empty() bool {
+	return node.kind == exportSequence && len(node.items) == 0
+}
+
+type exporter struct {
+	notation notation
+
+	// names maps rule names to the names they are exported with, all of which are in used
+	names map[string]string
+	used  map[string]bool
+
+	// externals are things that can only be described in words, and externalNames maps
+	// what they were made from to their names
+	externals     []externalRule
+	externalNames map[string]string
+
+	// notes, literals and captures belong to the rule being exported
+	notes    []string
+	literals []string
+	captures map[string]exportNode
+}
+
+type externalRule struct {
+	name        string
+	description string
+}
+
+// unique returns name, or name with a number after it if name is already taken.
+func (e *exporter) unique(name string) string {
+	candidate := name
+
+	for i := 2; e.used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s%d", name, i)
+	}
+
+	e.used[candidate] = true
+	return candidate
+}
+
+func (e *exporter) note(note string) {
+	if !slices.Contains(e.notes, note) {
+		e.notes = append(e.notes, note)
+	}
+}
+
+// external returns a reference to something described in words, adding it the first
+// time it is seen.
+func (e *exporter) external(key, name, description string) exportNode {
+	exported, found := e.externalNames[key]
+
+	if !found {
+		exported = e.unique(e.notation.name(name))
+		e.externalNames[key] = exported
+		e.externals = append(e.externals, externalRule{name: exported, description: description})
+	}
+
+	return exportNode{kind: exportRef, text: exported}
+}
+
+func (e *exporter) sequence(exprs []common.Expression) exportNode {
+	items := make([]exportNode, len(exprs))
+
+	for i, expr := range exprs {
+		items[i] = e.node(expr)
+	}
+
+	return exportSeq(items...)
+}
+
+func (e *exporter) node(expr common.Expression) exportNode {
+	switch expr.Definition {
+	case &Group:
+		return e.sequence(expr.Values["groupItems"].([]common.Expression))
+	case &Union:
+		var items []exportNode
+
+		for _, item := range expr.Values["unionItems"].([]common.Expression) {
+			items = append(items, e.node(item))
+		}
+
+		return exportAlt(items...)
+	case &Or:
+		// Each side of an Or is tried in turn and at least one has to match, so a | b | c
+		// is a [b] [c] | b [c] | c
+		var operands []exportNode
+
+		for expr.Definition == &Or {
+			operands = append(operands, e.node(expr.Values["lhs"].(common.Expression)))
+			expr = expr.Values["rhs"].(common.Expression)
+		}
+
+		operands = append(operands, e.node(expr))
+		alternatives := make([]exportNode, len(operands))
+
+		for i, operand := range operands {
+			items := []exportNode{operand}
+
+			for _, rest := range operands[i+1:] {
+				items = append(items, exportRep(rest, 0, 1))
+			}
+
+			alternatives[i] = exportSeq(items...)
+		}
+
+		return exportAlt(alternatives...)
+	case &ExclusiveOr:
+		e.note(serialized(expr) + " only matches if exactly one side does, which is exported as a plain alternative")
+		return exportAlt(e.node(expr.Values["lhs"].(common.Expression)), e.node(expr.Values["rhs"].(common.Expression)))
+	case &ZeroOrMore:
+		return exportRep(e.node(expr.Values["expr"].(common.Expression)), 0, -1)
+	case &OneOrMore:
+		return exportRep(e.node(expr.Values["expr"].(common.Expression)), 1, -1)
+	case &ZeroOrOne:
+		return exportRep(e.node(expr.Values["expr"].(common.Expression)), 0, 1)
+	case &Repeat:
+		return exportRep(e.node(expr.Values["expr"].(common.Expression)), expr.Values["min"].(int), expr.Values["max"].(int))
+	case &Separated:
+		item := e.node(expr.Values["item"].(common.Expression))
+		separator := e.node(expr.Values["separator"].(common.Expression))
+		list := exportSeq(item, exportRep(exportSeq(separator, item), 0, -1))
+
+		if expr.Values["trailing"].(bool) {
+			list = exportSeq(list, exportRep(separator, 0, 1))
+		}
+
+		if !expr.Values["nonEmpty"].(bool) {
+			list = exportRep(list, 0, 1)
+		}
+
+		return list
+	case &Capture:
+		captured := e.node(expr.Values["expr"].(common.Expression))
+		e.captures[expr.Values["name"].(string)] = captured
+
+		return captured
+	case &BackReference:
+		name := expr.Values["name"].(string)
+
+		if captured, found := e.captures[name]; found {
+			e.note(fmt.Sprintf("=%s has to match the same text that %s= did, which is exported as matching the same expression again", name, name))
+			return captured
+		}
+
+		return e.external(serialized(expr), "same_as_"+name, fmt.Sprintf("the same text that %s= matched", name))
+	case &Labeled:
+		return e.node(expr.Values["expr"].(common.Expression))
+	case &Embedded:
+		inner := expr.Values["expr"].(common.Expression)
+		e.note(fmt.Sprintf("the text matched by %s is parsed further with the embedded grammar %s", serialized(inner), expr.Values["grammar"]))
+
+		return e.node(inner)
+	case &SemanticPredicate:
+		e.note(serialized(expr) + " decides whether parsing can continue without consuming anything, and is left out")
+		return exportSeq()
+	case &Primitive:
+		return e.external(serialized(expr), expr.Values["name"].(string), fmt.Sprintf("whatever the primitive %s matches, which is implemented in Go", serialized(expr)))
+	case &Newline:
+		return e.external("NEWLINE", "NEWLINE", "a line break to a line indented as deeply as the current block")
+	case &Indent:
+		return e.external("INDENT", "INDENT", "a line break to a line indented more deeply than the current block, which starts a new block")
+	case &Dedent:
+		return e.external("DEDENT", "DEDENT", "the end of the current block, before a line indented less deeply, which consumes nothing")
+	case &RuleRef:
+		ref := expr.Values["ref"].(string)
+
+		// References to rules that don't exist are left as they are
+		if name, found := e.names[ref]; found {
+			return exportNode{kind: exportRef, text: name}
+		}
+
+		return exportNode{kind: exportRef, text: e.notation.name(ref)}
+	case &StringLiteral:
+		// An empty literal only skips whitespace, which is already implied
+		if expr.Values["val"].(string) == "" {
+			return exportSeq()
+		}
+
+		if literal := serialized(expr); !slices.Contains(e.literals, literal) {
+			e.literals = append(e.literals, literal)
+		}
+
+		return exportNode{kind: exportLiteral, text: expr.Values["val"].(string)}
+	case &RegularExpression:
+		return e.regex(expr.Values["source"].(string))
+	}
+
+	return e.external(serialized(expr), expr.Definition.Name, serialized(expr))
+}
+
+// regex translates a regular expression, which parsley compiles with the same flags.
+func (e *exporter) regex(source string) exportNode {
+	re, err := syntax.Parse(source, syntax.Perl)
+
+	if err != nil {
+		return e.external("/"+source+"/", "regex", "/"+source+"/")
+	}
+
+	var anchors []string
+	lazy := false
+
+	node := e.regexNode(re.Simplify(), &anchors, &lazy)
+
+	if len(anchors) > 0 {
+		e.note(fmt.Sprintf("/%s/ checks where it is with %s, which is left out", source, strings.Join(anchors, " and ")))
+	}
+
+	if lazy {
+		e.note(fmt.Sprintf("/%s/ repeats as few times as it can, which is exported as an ordinary repetition", source))
+	}
+
+	return node
+}
+
+func (e *exporter) regexNode(re *syntax.Regexp, anchors *[]string, lazy *bool) exportNode {
+	var anchor string
+
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return exportNode{kind: exportLiteral, text: string(re.Rune)}
+		}
+
+		// Each letter of a literal that ignores case is any of its cases
+		var items []exportNode
+		var run []rune
+
+		for _, ch := range re.Rune {
+			folds := []rune{ch}
+
+			for fold := unicode.SimpleFold(ch); fold != ch; fold = unicode.SimpleFold(fold) {
+				folds = append(folds, fold)
+			}
+
+			if len(folds) == 1 {
+				run = append(run, ch)
+				continue
+			}
+
+			if len(run) > 0 {
+				items = append(items, exportNode{kind: exportLiteral, text: string(run)})
+				run = nil
+			}
+
+			slices.Sort(folds)
+			class := exportNode{kind: exportClass}
+
+			for _, fold := range folds {
+				class.ranges = append(class.ranges, fold, fold)
+			}
+
+			items = append(items, class)
+		}
+
+		if len(run) > 0 {
+			items = append(items, exportNode{kind: exportLiteral, text: string(run)})
+		}
+
+		return exportSeq(items...)
+	case syntax.OpCharClass:
+		return exportNode{kind: exportClass, ranges: re.Rune}
+	case syntax.OpAnyCharNotNL:
+		return exportNode{kind: exportClass, ranges: []rune{0, '\n' - 1, '\n' + 1, unicode.MaxRune}}
+	case syntax.OpAnyChar:
+		return exportNode{kind: exportClass, ranges: []rune{0, unicode.MaxRune}}
+	case syntax.OpCapture:
+		return e.regexNode(re.Sub[0], anchors, lazy)
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		if re.Flags&syntax.NonGreedy != 0 {
+			*lazy = true
+		}
+
+		minCount, maxCount := re.Min, re.Max
+
+		switch re.Op {
+		case syntax.OpStar:
+			minCount, maxCount = 0, -1
+		case syntax.OpPlus:
+			minCount, maxCount = 1, -1
+		case syntax.OpQuest:
+			minCount, maxCount = 0, 1
+		}
+
+		return exportRep(e.regexNode(re.Sub[0], anchors, lazy), minCount, maxCount)
+	case syntax.OpConcat:
+		items := make([]exportNode, len(re.Sub))
+
+		for i, sub := range re.Sub {
+			items[i] = e.regexNode(sub, anchors, lazy)
+		}
+
+		return exportSeq(items...)
+	case syntax.OpAlternate:
+		items := make([]exportNode, len(re.Sub))
+
+		for i, sub := range re.Sub {
+			items[i] = e.regexNode(sub, anchors, lazy)
+		}
+
+		return exportAlt(items...)
+	case syntax.OpBeginText:
+		anchor = "^"
+	case syntax.OpEndText:
+		anchor = "$"
+	case syntax.OpBeginLine:
+		anchor = "(?m:^)"
+	case syntax.OpEndLine:
+		anchor = "(?m:$)"
+	case syntax.OpWordBoundary:
+		anchor = `\b`
+	case syntax.OpNoWordBoundary:
+		anchor = `\B`
+	}
+
+	// Anchors only check where they are, so leaving them out still matches everything
+	// that they would have let through
+	if anchor != "" && !slices.Contains(*anchors, anchor) {
+		*anchors = append(*anchors, anchor)
+	}
+
+	return exportSeq()
+}
+
+// complementRanges returns every character that isn't in ranges.
+func complementRanges(ranges []rune) []rune {
+	var complement []rune
+	next := rune(0)
+
+	for i := 0; i < len(ranges); i += 2 {
+		if ranges[i] > next {
+			complement = append(complement, next, ranges[i]-1)
+		}
+
+		next = ranges[i+1] + 1
+	}
+
+	if next <= unicode.MaxRune {
+		complement = append(complement, next, unicode.MaxRune)
+	}
+
+	return complement
+}
+
+// negated returns whether ranges are more easily read as the characters they leave out,
+// and those characters if so.
+func negated(ranges []rune) ([]rune, bool) {
+	if len(ranges) > 2 && ranges[0] == 0 && ranges[len(ranges)-1] == unicode.MaxRune {
+		return complementRanges(ranges), true
+	}
+
+	return ranges, false
+}
+
+// classSize returns how many characters are in ranges.
+func classSize(ranges []rune) int {
+	size := 0
+
+	for i := 0; i < len(ranges); i += 2 {
+		size += int(ranges[i+1]-ranges[i]) + 1
+	}
+
+	return size
+}
+
+// Precedences of printed expressions, for deciding where parentheses are needed.
+const (
+	precChoice = iota
+	precSequence
+	precPrimary
+)
+
+// notation prints an exportNode in one of the formats.
+type notation interface {
+	name(rule string) string
+	comment(text string) string
+	rule(name string, body exportNode) string
+	external(name, description string) string
+}
+
+// sanitizeName replaces every run of characters that can't be in a name with sep.
+func sanitizeName(name string, allowed func(rune) bool, sep string) string {
+	var out strings.Builder
+	pending := false
+
+	for _, ch := range name {
+		if !allowed(ch) {
+			pending = true
+			continue
+		}
+
+		if pending && out.Len() > 0 {
+			out.WriteString(sep)
+		}
+
+		pending = false
+		out.WriteRune(ch)
+	}
+
+	if out.Len() == 0 {
+		return "rule"
+	}
+
+	return out.String()
+}
+
+func isASCIIAlnum(ch rune) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+// printAll prints items and joins them with sep, wrapping the ones that bind more loosely
+// than prec in parentheses.
+func printAll(items []exportNode, sep string, prec int, print func(exportNode) (string, int), open, close string) string {
+	parts := make([]string, 0, len(items))
+
+	for _, item := range items {
+		out, itemPrec := print(item)
+
+		if itemPrec < prec {
+			out = open + out + close
+		}
+
+		parts = append(parts, out)
+	}
+
+	return strings.Join(parts, sep)
+}
+
+// quoteLiteral splits text into quoted runs of printable characters, using whichever of
+// the two quotes isn't in the run, and hands other characters to escape.
+func quoteLiteral(text string, escape func(rune) string) []string {
+	var parts []string
+	var run strings.Builder
+	hasDouble, hasSingle := false, false
+
+	flush := func() {
+		if run.Len() == 0 {
+			return
+		}
+
+		if hasDouble {
+			parts = append(parts, "'"+run.String()+"'")
+		} else {
+			parts = append(parts, `"`+run.String()+`"`)
+		}
+
+		run.Reset()
+		hasDouble, hasSingle = false, false
+	}
+
+	for _, ch := range text {
+		if !unicode.IsPrint(ch) {
+			flush()
+			parts = append(parts, escape(ch))
+			continue
+		}
+
+		if ch == '"' && hasSingle || ch == '\'' && hasDouble {
+			flush()
+		}
+
+		hasDouble = hasDouble || ch == '"'
+		hasSingle = hasSingle || ch == '\''
+		run.WriteRune(ch)
+	}
+
+	flush()
+
+	return parts
+}
+
+// isoNotation prints ISO/IEC 14977 EBNF. It has no character classes, so small ones are
+// written out and the rest are described in special sequences.
+type isoNotation struct{}
+
+const isoMaxClass = 16
+
+func (isoNotation) name(rule string) string {
+	return sanitizeName(rule, isASCIIAlnum, "_")
+}
+
+func (isoNotation) comment(text string) string {
+	return "(* " + strings.ReplaceAll(text, "*)", "* )") + " *)"
+}
+
+func (n isoNotation) rule(name string, body exportNode) string {
+	out, _ := n.print(body)
+	return name + " = " + out + " ;"
+}
+
+func (n isoNotation) external(name, description string) string {
+	if strings.Contains(description, "?") {
+		return n.comment(name+" is "+description) + "\n" + name + " = ? see above ? ;"
+	}
+
+	return name + " = ? " + description + " ? ;"
+}
+
+func (n isoNotation) primary(node exportNode) string {
+	out, prec := n.print(node)
+
+	if prec < precPrimary {
+		return "( " + out + " )"
+	}
+
+	return out
+}
+
+func (n isoNotation) print(node exportNode) (string, int) {
+	switch node.kind {
+	case exportSequence:
+		return printAll(node.items, " , ", precSequence, n.print, "( ", " )"), precSequence
+	case exportChoice:
+		return printAll(node.items, " | ", precChoice, n.print, "( ", " )"), precChoice
+	case exportRepeat:
+		item, _ := n.print(node.items[0])
+		times := func(count int, out string) string {
+			if count == 1 {
+				return out
+			}
+
+			return fmt.Sprintf("%d * %s", count, out)
+		}
+
+		switch {
+		case node.min == 0 && node.max == 1:
+			return "[ " + item + " ]", precPrimary
+		case node.min == 0 && node.max < 0:
+			return "{ " + item + " }", precPrimary
+		case node.max < 0:
+			return times(node.min, n.primary(node.items[0])) + " , { " + item + " }", precSequence
+		case node.min == node.max:
+			return times(node.min, n.primary(node.items[0])), precSequence
+		case node.min == 0:
+			return times(node.max, "[ "+item+" ]"), precSequence
+		default:
+			return times(node.min, n.primary(node.items[0])) + " , " + times(node.max-node.min, "[ "+item+" ]"), precSequence
+		}
+	case exportLiteral:
+		parts := quoteLiteral(node.text, func(ch rune) string { return fmt.Sprintf("? U+%04X ?", ch) })
+
+		if len(parts) == 1 {
+			return parts[0], precPrimary
+		}
+
+		return strings.Join(parts, " , "), precSequence
+	case exportClass:
+		if classSize(node.ranges) > isoMaxClass {
+			return "? " + strings.ReplaceAll(regexClass(node.ranges), "?", `\x3F`) + " ?", precPrimary
+		}
+
+		var items []exportNode
+
+		for i := 0; i < len(node.ranges); i += 2 {
+			for ch := node.ranges[i]; ch <= node.ranges[i+1]; ch++ {
+				items = append(items, exportNode{kind: exportLiteral, text: string(ch)})
+			}
+		}
+
+		return n.print(exportAlt(items...))
+	}
+
+	return node.text, precPrimary
+}
+
+// regexClass writes ranges the way a regular expression would.
+func regexClass(ranges []rune) string {
+	if len(ranges) == 2 && ranges[0] == 0 && ranges[1] == unicode.MaxRune {
+		return "any character"
+	}
+
+	ranges, isNegated := negated(ranges)
+
+	var out strings.Builder
+	out.WriteString("[")
+
+	if isNegated {
+		out.WriteString("^")
+	}
+
+	char := func(ch rune) string {
+		switch {
+		case ch == '\n':
+			return `\n`
+		case ch == '\t':
+			return `\t`
+		case strings.ContainsRune(`\]-^`, ch):
+			return `\` + string(ch)
+		case !unicode.IsPrint(ch) || ch == ' ':
+			return fmt.Sprintf(`\x{%X}`, ch)
+		}
+
+		return string(ch)
+	}
+
+	for i := 0; i < len(ranges); i += 2 {
+		out.WriteString(char(ranges[i]))
+
+		if ranges[i+1] != ranges[i] {
+			out.WriteString("-" + char(ranges[i+1]))
+		}
+	}
+
+	out.WriteString("]")
+
+	return out.String()
+}
+
+// abnfNotation prints RFC 5234 ABNF. Quoted strings are case-insensitive in ABNF, so
+// literals with letters in them are written as character codes.
+type abnfNotation struct{}
+
+func (abnfNotation) name(rule string) string {
+	name := sanitizeName(rule, isASCIIAlnum, "-")
+
+	// Rule names have to start with a letter
+	if !unicode.IsLetter(rune(name[0])) {
+		name = "r-" + name
+	}
+
+	return name
+}
+
+func (abnfNotation) comment(text string) string {
+	return "; " + text
+}
+
+func (n abnfNotation) rule(name string, body exportNode) string {
+	out, _ := n.print(body)
+	return name + " = " + out
+}
+
+func (n abnfNotation) external(name, description string) string {
+	if strings.Contains(description, ">") {
+		return n.comment(name+" is "+description) + "\n" + name + " = <see above>"
+	}
+
+	return name + " = <" + description + ">"
+}
+
+func (n abnfNotation) element(node exportNode) string {
+	out, prec := n.print(node)
+
+	if prec < precPrimary {
+		return "(" + out + ")"
+	}
+
+	return out
+}
+
+func (n abnfNotation) print(node exportNode) (string, int) {
+	switch node.kind {
+	case exportSequence:
+		if node.empty() {
+			return `""`, precPrimary
+		}
+
+		return printAll(node.items, " ", precSequence, n.print, "(", ")"), precSequence
+	case exportChoice:
+		return printAll(node.items, " / ", precChoice, n.print, "(", ")"), precChoice
+	case exportRepeat:
+		item := n.element(node.items[0])
+
+		switch {
+		case node.min == 0 && node.max == 1:
+			out, _ := n.print(node.items[0])
+			return "[" + out + "]", precPrimary
+		case node.min == 0 && node.max < 0:
+			return "*" + item, precSequence
+		case node.max < 0:
+			return fmt.Sprintf("%d*%s", node.min, item), precSequence
+		case node.min == node.max:
+			return fmt.Sprintf("%d%s", node.min, item), precSequence
+		case node.min == 0:
+			return fmt.Sprintf("*%d%s", node.max, item), precSequence
+		default:
+			return fmt.Sprintf("%d*%d%s", node.min, node.max, item), precSequence
+		}
+	case exportLiteral:
+		plain := node.text != ""
+
+		for _, ch := range node.text {
+			if ch < 0x20 || ch > 0x7E || ch == '"' || unicode.IsLetter(ch) {
+				plain = false
+			}
+		}
+
+		if plain || node.text == "" {
+			return `"` + node.text + `"`, precPrimary
+		}
+
+		codes := make([]string, 0, len(node.text))
+
+		for _, ch := range node.text {
+			codes = append(codes, fmt.Sprintf("%X", ch))
+		}
+
+		return "%x" + strings.Join(codes, "."), precPrimary
+	case exportClass:
+		items := make([]string, 0, len(node.ranges)/2)
+
+		for i := 0; i < len(node.ranges); i += 2 {
+			if node.ranges[i] == node.ranges[i+1] {
+				items = append(items, fmt.Sprintf("%%x%X", node.ranges[i]))
+			} else {
+				items = append(items, fmt.Sprintf("%%x%X-%X", node.ranges[i], node.ranges[i+1]))
+			}
+		}
+
+		if len(items) == 1 {
+			return items[0], precPrimary
+		}
+
+		return strings.Join(items, " / "), precChoice
+	}
+
+	return node.text, precPrimary
+}
+
+// w3cNotation prints the EBNF of the XML specification. It has no counted repetition, so
+// that is written out, and no way to describe anything in words, so what can only be
+// described in words is left undefined.
+type w3cNotation struct{}
+
+func (w3cNotation) name(rule string) string {
+	return sanitizeName(rule, func(ch rune) bool { return isASCIIAlnum(ch) || ch == '.' || ch == '-' || ch == '_' }, "_")
+}
+
+func (w3cNotation) comment(text string) string {
+	return "/* " + strings.ReplaceAll(text, "*/", "* /") + " */"
+}
+
+func (n w3cNotation) rule(name string, body exportNode) string {
+	out, _ := n.print(body)
+	return name + " ::= " + out
+}
+
+func (n w3cNotation) external(name, description string) string {
+	return n.comment(name + " is " + description)
+}
+
+func (n w3cNotation) primary(node exportNode) string {
+	out, prec := n.print(node)
+
+	if prec < precPrimary {
+		return "(" + out + ")"
+	}
+
+	return out
+}
+
+func w3cChar(ch rune) string {
+	return fmt.Sprintf("#x%X", ch)
+}
+
+func (n w3cNotation) print(node exportNode) (string, int) {
+	switch node.kind {
+	case exportSequence:
+		if node.empty() {
+			return `""`, precPrimary
+		}
+
+		return printAll(node.items, " ", precSequence, n.print, "(", ")"), precSequence
+	case exportChoice:
+		return printAll(node.items, " | ", precChoice, n.print, "(", ")"), precChoice
+	case exportRepeat:
+		item := n.primary(node.items[0])
+
+		switch {
+		case node.min == 0 && node.max == 1:
+			return item + "?", precSequence
+		case node.min == 0 && node.max < 0:
+			return item + "*", precSequence
+		case node.min == 1 && node.max < 0:
+			return item + "+", precSequence
+		}
+
+		var parts []string
+
+		for range node.min {
+			parts = append(parts, item)
+		}
+
+		if node.max < 0 {
+			parts = append(parts, item+"*")
+		}
+
+		for range node.max - node.min {
+			parts = append(parts, item+"?")
+		}
+
+		if len(parts) == 0 {
+			return `""`, precPrimary
+		}
+
+		return strings.Join(parts, " "), precSequence
+	case exportLiteral:
+		if node.text == "" {
+			return `""`, precPrimary
+		}
+
+		parts := quoteLiteral(node.text, w3cChar)
+
+		if len(parts) == 1 {
+			return parts[0], precPrimary
+		}
+
+		return strings.Join(parts, " "), precSequence
+	case exportClass:
+		ranges := node.ranges
+		isNegated := false
+
+		if len(ranges) != 2 || ranges[0] != 0 || ranges[1] != unicode.MaxRune {
+			ranges, isNegated = negated(ranges)
+		}
+
+		char := func(ch rune) string {
+			if ch < 0x7F && unicode.IsPrint(ch) && !strings.ContainsRune(` []^-#\`, ch) {
+				return string(ch)
+			}
+
+			return w3cChar(ch)
+		}
+
+		var out strings.Builder
+		out.WriteString("[")
+
+		if isNegated {
+			out.WriteString("^")
+		}
+
+		for i := 0; i < len(ranges); i += 2 {
+			out.WriteString(char(ranges[i]))
+
+			if ranges[i+1] != ranges[i] {
+				out.WriteString("-" + char(ranges[i+1]))
+			}
+		}
+
+		out.WriteString("]")
+
+		return out.String(), precPrimary
+	}
+
+	return node.text, precPrimary
+}
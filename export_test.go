@@ -0,0 +1,160 @@
+package parsley
+
+import (
+	"strings"
+	"testing"
+)
+
+const exportGrammar = `input: item+
+item: <pair number> NEWLINE
+pair: key "=" value?
+key: /[a-z_][a-z0-9_]*/
+value: /"[^"]*"/ ^ number
+number: /-?[0-9]{1,3}/
+`
+
+func TestExport(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  ExportFormat
+		grammar string
+		want    string
+
+		// withoutHeader compares the export without the header that every export starts with
+		withoutHeader bool
+	}{
+		{
+			name:    "ISO EBNF",
+			format:  ISOEBNF,
+			grammar: exportGrammar,
+			want: `(* Exported from a parsley grammar, which is a parsing expression grammar. *)
+(* Alternatives are tried in order and the first one that matches is used, and repetitions match as many times as they can, without backtracking. *)
+(* Whitespace is skipped before every literal and regular expression. *)
+
+input = item , { item } ;
+
+item = ( pair | number ) , NEWLINE ;
+
+(* "=" is matched but left out of the parse tree *)
+pair = key , "=" , [ value ] ;
+
+key = ? [_a-z] ? , { ? [0-9_a-z] ? } ;
+
+(* /"[^"]*"/ ^ number only matches if exactly one side does, which is exported as a plain alternative *)
+value = '"' , { ? [^"] ? } , '"' | number ;
+
+number = [ "-" ] , ( "0" | "1" | "2" | "3" | "4" | "5" | "6" | "7" | "8" | "9" ) , [ ( "0" | "1" | "2" | "3" | "4" | "5" | "6" | "7" | "8" | "9" ) , [ "0" | "1" | "2" | "3" | "4" | "5" | "6" | "7" | "8" | "9" ] ] ;
+
+(* These can only be described in words. *)
+NEWLINE = ? a line break to a line indented as deeply as the current block ? ;
+`,
+		},
+		{
+			name:    "ABNF",
+			format:  ABNF,
+			grammar: exportGrammar,
+			want: `; Exported from a parsley grammar, which is a parsing expression grammar.
+; Alternatives are tried in order and the first one that matches is used, and repetitions match as many times as they can, without backtracking.
+; Whitespace is skipped before every literal and regular expression.
+
+input = 1*item
+
+item = (pair / number) NEWLINE
+
+; "=" is matched but left out of the parse tree
+pair = key "=" [value]
+
+key = (%x5F / %x61-7A) *(%x30-39 / %x5F / %x61-7A)
+
+; /"[^"]*"/ ^ number only matches if exactly one side does, which is exported as a plain alternative
+value = %x22 *(%x0-21 / %x23-10FFFF) %x22 / number
+
+number = ["-"] %x30-39 [%x30-39 [%x30-39]]
+
+; These can only be described in words.
+NEWLINE = <a line break to a line indented as deeply as the current block>
+`,
+		},
+		{
+			name:    "W3C EBNF",
+			format:  W3CEBNF,
+			grammar: exportGrammar,
+			want: `/* Exported from a parsley grammar, which is a parsing expression grammar. */
+/* Alternatives are tried in order and the first one that matches is used, and repetitions match as many times as they can, without backtracking. */
+/* Whitespace is skipped before every literal and regular expression. */
+
+input ::= item+
+
+item ::= (pair | number) NEWLINE
+
+/* "=" is matched but left out of the parse tree */
+pair ::= key "=" value?
+
+key ::= [_a-z] [0-9_a-z]*
+
+/* /"[^"]*"/ ^ number only matches if exactly one side does, which is exported as a plain alternative */
+value ::= '"' [^"]* '"' | number
+
+number ::= "-"? [0-9] ([0-9] [0-9]?)?
+
+/* These can only be described in words. */
+/* NEWLINE is a line break to a line indented as deeply as the current block */
+`,
+		},
+		{
+			// ABNF names can't have underscores or parentheses, and back-references can
+			// only be approximated
+			name:          "names and back-references",
+			format:        ABNF,
+			grammar:       "input: list(key_name) tag=key_name =tag\nlist(x): sep(x, \",\")\nkey_name: /[a-z]+/\n",
+			withoutHeader: true,
+			want: `
+; =tag has to match the same text that tag= did, which is exported as matching the same expression again
+input = list-key-name key-name key-name
+
+key-name = 1*%x61-7A
+
+; "," is matched but left out of the parse tree
+list-key-name = [key-name *("," key-name)]
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			grammar, err := ParseGrammar(tc.grammar)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out strings.Builder
+
+			if err := grammar.Export(&out, tc.format); err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.String()
+
+			if tc.withoutHeader {
+				got = strings.SplitN(got, "\n", len(exportHeader)+1)[len(exportHeader)]
+			}
+
+			if got != tc.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExportUnknownFormat(t *testing.T) {
+	grammar, err := ParseGrammar(exportGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := grammar.Export(&strings.Builder{}, ExportFormat(7)); err == nil || err.Error() != "unknown export format 7" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/l-donovan/parsley/common"
@@ -40,6 +42,9 @@ var (
 
 			return common.NewMultipleResult(results, input, &deepestRemaining), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return serializePostfix(values["expr"].(common.Expression), "*", config, indentLevel)
+		},
 	}
 
 	OneOrMore = common.ExpressionDefinition{
@@ -78,6 +83,9 @@ var (
 
 			return common.NewMultipleResult(results, input, &deepestRemaining), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return serializePostfix(values["expr"].(common.Expression), "+", config, indentLevel)
+		},
 	}
 
 	ZeroOrOne = common.ExpressionDefinition{
@@ -110,6 +118,165 @@ var (
 
 			return common.NewMultipleResult(results, result.Remaining(), deepestNextInSeries), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return serializePostfix(values["expr"].(common.Expression), "?", config, indentLevel)
+		},
+	}
+
+	// Repeat matches its expression at least min times and at most max times. A negative max
+	// means there is no upper bound.
+	Repeat = common.ExpressionDefinition{
+		Name: "Repeat",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			expr := values["expr"].(common.Expression)
+			minCount := values["min"].(int)
+			maxCount := values["max"].(int)
+			count := 0
+
+			var results []common.EvaluateResult
+			var deepestRemaining *common.MetaString
+
+			for maxCount < 0 || count < maxCount {
+				result, err := expr.Evaluate(input, globals)
+
+				if err != nil {
+					return common.ErrorResult, err
+				}
+
+				if noMatch, didNotMatch := result.(common.NoMatchResult); didNotMatch {
+					remaining := noMatch.Remaining()
+					deepestRemaining = &remaining
+					break
+				}
+
+				count++
+
+				if !common.Discard(result) {
+					results = append(results, result)
+				}
+
+				input = result.Remaining()
+			}
+
+			if count < minCount {
+				return common.NewNoMatchResult(*deepestRemaining), nil
+			}
+
+			return common.NewMultipleResult(results, input, deepestRemaining), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			minCount := values["min"].(int)
+			maxCount := values["max"].(int)
+
+			switch {
+			case minCount == maxCount:
+				return serializePostfix(values["expr"].(common.Expression), fmt.Sprintf("{%d}", minCount), config, indentLevel)
+			case maxCount < 0:
+				return serializePostfix(values["expr"].(common.Expression), fmt.Sprintf("{%d,}", minCount), config, indentLevel)
+			default:
+				return serializePostfix(values["expr"].(common.Expression), fmt.Sprintf("{%d,%d}", minCount, maxCount), config, indentLevel)
+			}
+		},
+	}
+
+	// Separated matches a list of items with a separator between each of them. Only the items
+	// are kept, so the list condenses flat no matter what the separator is.
+	Separated = common.ExpressionDefinition{
+		Name: "Separated",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			item := values["item"].(common.Expression)
+			separator := values["separator"].(common.Expression)
+			trailing := values["trailing"].(bool)
+			nonEmpty := values["nonEmpty"].(bool)
+			state := common.GetState(globals)
+
+			var results []common.EvaluateResult
+
+			result, err := item.Evaluate(input, globals)
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			if !common.Match(result) {
+				if nonEmpty {
+					return result, nil
+				}
+
+				remaining := result.Remaining()
+				return common.NewMultipleResult(results, input, &remaining), nil
+			}
+
+			if !common.Discard(result) {
+				results = append(results, result)
+			}
+
+			input = result.Remaining()
+
+			var deepestRemaining common.MetaString
+			var beforeSeparator common.StateSnapshot
+
+			for {
+				if state != nil {
+					beforeSeparator = state.Snapshot()
+				}
+
+				separatorResult, err := separator.Evaluate(input, globals)
+
+				if err != nil {
+					return common.ErrorResult, err
+				}
+
+				if !common.Match(separatorResult) {
+					deepestRemaining = separatorResult.Remaining()
+					break
+				}
+
+				result, err := item.Evaluate(separatorResult.Remaining(), globals)
+
+				if err != nil {
+					return common.ErrorResult, err
+				}
+
+				if !common.Match(result) {
+					deepestRemaining = result.Remaining()
+
+					if trailing {
+						input = separatorResult.Remaining()
+					} else if state != nil {
+						state.Restore(beforeSeparator)
+					}
+
+					break
+				}
+
+				if !common.Discard(result) {
+					results = append(results, result)
+				}
+
+				input = result.Remaining()
+			}
+
+			return common.NewMultipleResult(results, input, &deepestRemaining), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			args := []common.Expression{values["item"].(common.Expression), values["separator"].(common.Expression)}
+			out, err := serializeAll(args, config, indentLevel, config.Sep(", ", ","))
+
+			if err != nil {
+				return "", err
+			}
+
+			if values["trailing"].(bool) {
+				out += config.Sep(", ", ",") + "trailing"
+			}
+
+			if values["nonEmpty"].(bool) {
+				out += config.Sep(", ", ",") + "nonempty"
+			}
+
+			return "sep(" + out + ")", nil
+		},
 	}
 
 	Or = common.ExpressionDefinition{
@@ -143,7 +310,7 @@ var (
 			}
 
 			if !common.Match(lhsResult) && !common.Match(rhsResult) {
-				if lhsResult.Remaining().Loc.Pos > rhsResult.Remaining().Loc.Pos {
+				if lhsResult.Remaining().Pos() > rhsResult.Remaining().Pos() {
 					return common.NewNoMatchResult(lhsResult.Remaining()), nil
 				} else {
 					return common.NewNoMatchResult(rhsResult.Remaining()), nil
@@ -154,7 +321,7 @@ var (
 
 			for _, result := range results {
 				if multipleResult, ok := result.(common.MultipleResult); ok {
-					if multipleResult.Next() != nil && (deepestNextInSeries == nil || multipleResult.Next().Loc.Pos > deepestNextInSeries.Loc.Pos) {
+					if multipleResult.Next() != nil && (deepestNextInSeries == nil || multipleResult.Next().Pos() > deepestNextInSeries.Pos()) {
 						deepestNextInSeries = multipleResult.Next()
 					}
 				}
@@ -162,6 +329,10 @@ var (
 
 			return common.NewMultipleResult(results, input, deepestNextInSeries), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			operands := []common.Expression{values["lhs"].(common.Expression), values["rhs"].(common.Expression)}
+			return serializeAll(operands, config, indentLevel, config.Sep(" | ", "|"))
+		},
 	}
 
 	ExclusiveOr = common.ExpressionDefinition{
@@ -170,12 +341,25 @@ var (
 			lhs := values["lhs"].(common.Expression)
 			rhs := values["rhs"].(common.Expression)
 
+			state := common.GetState(globals)
+			var beforeLhs, afterLhs common.StateSnapshot
+
+			if state != nil {
+				beforeLhs = state.Snapshot()
+			}
+
 			lhsResult, err := lhs.Evaluate(input, globals)
 
 			if err != nil {
 				return common.ErrorResult, err
 			}
 
+			// Both sides start from the same input, so they also have to start from the same state
+			if state != nil {
+				afterLhs = state.Snapshot()
+				state.Restore(beforeLhs)
+			}
+
 			rhsResult, err := rhs.Evaluate(input, globals)
 
 			if err != nil {
@@ -183,17 +367,25 @@ var (
 			}
 
 			if common.Match(lhsResult) == common.Match(rhsResult) {
-				if lhsResult.Remaining().Loc.Pos > rhsResult.Remaining().Loc.Pos {
+				if lhsResult.Remaining().Pos() > rhsResult.Remaining().Pos() {
 					return common.NewNoMatchResult(lhsResult.Remaining()), nil
 				} else {
 					return common.NewNoMatchResult(rhsResult.Remaining()), nil
 				}
 			} else if common.Match(lhsResult) {
+				if state != nil {
+					state.Restore(afterLhs)
+				}
+
 				return lhsResult, nil
 			} else {
 				return rhsResult, nil
 			}
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			operands := []common.Expression{values["lhs"].(common.Expression), values["rhs"].(common.Expression)}
+			return serializeAll(operands, config, indentLevel, config.Sep(" ^ ", "^"))
+		},
 	}
 
 	Union = common.ExpressionDefinition{
@@ -211,7 +403,7 @@ var (
 				}
 
 				if noMatch, didNotMatch := result.(common.NoMatchResult); didNotMatch {
-					if noMatch.Remaining().Loc.Pos > deepestRemaining.Loc.Pos {
+					if noMatch.Remaining().Pos() > deepestRemaining.Pos() {
 						deepestRemaining = noMatch.Remaining()
 					}
 				} else {
@@ -222,6 +414,15 @@ var (
 
 			return common.NewNoMatchResult(deepestRemaining), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			out, err := serializeAll(values["unionItems"].([]common.Expression), config, indentLevel, " ")
+
+			if err != nil {
+				return "", err
+			}
+
+			return "<" + out + ">", nil
+		},
 	}
 
 	Rule = common.ExpressionDefinition{
@@ -230,8 +431,34 @@ var (
 			contents := values["contents"].([]common.Expression)
 			groupExpr := common.Expression{Definition: &Group, Values: map[string]any{"groupItems": contents}}
 
+			if label, labeled := values["label"].(string); labeled {
+				if state := common.GetState(globals); state != nil {
+					state.PushRuleLabel(label, input)
+					defer state.PopLabel()
+				}
+			}
+
 			return groupExpr.Evaluate(input, globals)
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			name := values["name"].(string)
+
+			if params, ok := values["params"].([]string); ok {
+				name += "(" + strings.Join(params, config.Sep(", ", ",")) + ")"
+			}
+
+			if label, labeled := values["label"].(string); labeled {
+				name += " " + serializeLabel(label)
+			}
+
+			out, err := serializeAll(values["contents"].([]common.Expression), config, indentLevel, " ")
+
+			if err != nil {
+				return "", err
+			}
+
+			return config.Indent(indentLevel) + name + config.Sep(": ", ":") + out, nil
+		},
 	}
 
 	RuleRef = common.ExpressionDefinition{
@@ -245,6 +472,30 @@ var (
 				return common.ErrorResult, fmt.Errorf("could not find rule with name %s", ref)
 			}
 
+			memo := getMemoTable(globals)
+			var outer memoFrame
+
+			if memo != nil {
+				if result, found := memo.lookup(ref, input); found {
+					return result, nil
+				}
+
+				outer = memo.begin()
+			}
+
+			// Captures made inside the rule can't be seen from outside of it
+			if state := common.GetState(globals); state != nil {
+				defer state.ExitScope(state.EnterScope())
+
+				state.EnterRule(ref)
+				defer state.LeaveRule()
+
+				if label, labeled := globals[labelKey(ref)].(string); labeled {
+					state.PushRuleLabel(label, input)
+					defer state.PopLabel()
+				}
+			}
+
 			groupExpr := common.Expression{Definition: &Group, Values: map[string]any{"groupItems": groupItems}}
 			result, err := groupExpr.Evaluate(input, globals)
 
@@ -252,11 +503,18 @@ var (
 				return common.ErrorResult, err
 			}
 
-			if !common.Match(result) {
-				return result, nil
+			if common.Match(result) {
+				result = common.NewRuleResult(result.(common.MultipleResult), input, result.Remaining(), ref)
+			}
+
+			if memo != nil {
+				memo.end(outer, ref, input, result)
 			}
 
-			return common.NewRuleResult(result.(common.MultipleResult), result.Remaining(), ref), nil
+			return result, nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return values["ref"].(string), nil
 		},
 	}
 
@@ -264,9 +522,17 @@ var (
 		Name: "RegularExpression",
 		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
 			expr := values["val"].(*regexp.Regexp)
-			idx := expr.FindStringSubmatchIndex(input.Val())
+			var idx []int
+
+			if memo := getMemoTable(globals); memo != nil {
+				idx = memo.findRegexp(expr, input)
+			} else {
+				idx = expr.FindStringSubmatchIndex(input.Val())
+			}
 
 			if idx == nil || idx[0] > 0 {
+				// Like a string literal, the regular expression is expected after any whitespace
+				expect(globals, input.FromFirstNotMatching(" \t\f\v\r\n"), func() string { return "/" + values["source"].(string) + "/" })
 				return common.NewNoMatchResult(input), nil
 			}
 
@@ -275,6 +541,9 @@ var (
 
 			return common.NewStringResult(result, remaining), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return "/" + values["source"].(string) + "/", nil
+		},
 	}
 
 	File = common.ExpressionDefinition{
@@ -295,11 +564,25 @@ var (
 					return common.ErrorResult, err
 				}
 
-				return common.NewRuleResult(result.(common.MultipleResult), result.Remaining(), ruleName), nil
+				if !common.Match(result) {
+					return result, nil
+				}
+
+				return common.NewRuleResult(result.(common.MultipleResult), input, result.Remaining(), ruleName), nil
 			}
 
 			return common.ErrorResult, errors.New("no top-level rule found")
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			var directives []common.Expression
+
+			if extends, ok := values["extends"].(common.Expression); ok {
+				directives = append(directives, extends)
+			}
+
+			imports, _ := values["imports"].([]common.Expression)
+			return serializeAll(slices.Concat(directives, imports, values["rules"].([]common.Expression)), config, indentLevel, "\n")
+		},
 	}
 
 	Group = common.ExpressionDefinition{
@@ -318,7 +601,7 @@ var (
 				}
 
 				if !common.Match(result) {
-					if deepestNextInSeries == nil || result.Remaining().Loc.Pos > deepestNextInSeries.Loc.Pos {
+					if deepestNextInSeries == nil || result.Remaining().Pos() > deepestNextInSeries.Pos() {
 						return result, nil
 					}
 
@@ -326,7 +609,7 @@ var (
 				}
 
 				if multipleResult, ok := result.(common.MultipleResult); ok {
-					if multipleResult.Next() != nil && (deepestNextInSeries == nil || multipleResult.Next().Loc.Pos > deepestNextInSeries.Loc.Pos) {
+					if multipleResult.Next() != nil && (deepestNextInSeries == nil || multipleResult.Next().Pos() > deepestNextInSeries.Pos()) {
 						deepestNextInSeries = multipleResult.Next()
 					}
 				}
@@ -340,6 +623,15 @@ var (
 
 			return common.NewMultipleResult(results, input, deepestNextInSeries), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			out, err := serializeAll(values["groupItems"].([]common.Expression), config, indentLevel, " ")
+
+			if err != nil {
+				return "", err
+			}
+
+			return "(" + out + ")", nil
+		},
 	}
 
 	StringLiteral = common.ExpressionDefinition{
@@ -348,12 +640,456 @@ var (
 			val := values["val"].(string)
 			trimmedInput := input.FromFirstNotMatching(" \t\f\v\r\n")
 
+			if memo := getMemoTable(globals); memo != nil {
+				memo.examinePrefix(input, val)
+			}
+
 			// The input starts with our string literal
-			if strings.Index(trimmedInput.Val(), val) == 0 {
+			if strings.HasPrefix(trimmedInput.Val(), val) {
 				return common.NewDiscardResult(trimmedInput.FromStartPos(len(val))), nil
 			}
 
+			expect(globals, trimmedInput, func() string { return `"` + val + `"` })
 			return common.NewNoMatchResult(trimmedInput), nil
 		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return `"` + values["val"].(string) + `"`, nil
+		},
+	}
+
+	// Embedded hands the text matched by its expression over to another grammar, and grafts
+	// the resulting tree in under the name that grammar was embedded with. Positions in
+	// that tree are relative to the whole input, not to the embedded text.
+	Embedded = common.ExpressionDefinition{
+		Name: "Embedded",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			notReusable(globals)
+
+			name := values["grammar"].(string)
+			expr := values["expr"].(common.Expression)
+
+			embedded, found := globals[embeddedKey(name)].(*Grammar)
+
+			if !found {
+				return common.ErrorResult, fmt.Errorf("could not find embedded grammar with name %s", name)
+			}
+
+			result, err := expr.Evaluate(input, globals)
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			if !common.Match(result) {
+				return result, nil
+			}
+
+			state, err := requireState(globals, "embed")
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			// The embedded grammar uses up the same limits as this one
+			nested := state.Nested(embedded.tabWidth)
+			embeddedGlobals := embedded.newGlobals(state.Limits.Context, ParseOptions{})
+			embeddedGlobals[common.StateKey] = nested
+
+			span := matchedSpan(input, result)
+			embeddedResult, err := embedded.topLevelExpr.Evaluate(span, embeddedGlobals)
+			state.Unnest(nested)
+
+			if err != nil {
+				return common.ErrorResult, fmt.Errorf("error in embedded grammar %s: %w", name, err)
+			}
+
+			if failure := unconsumed(embeddedResult); failure != nil {
+				return common.NewNoMatchResult(*failure), nil
+			}
+
+			return common.NewRuleResult(embeddedResult.(common.RuleResult).Result(), span, result.Remaining(), name).WithOrigin(embedded), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			out, err := values["expr"].(common.Expression).Serialize(config, indentLevel)
+
+			if err != nil {
+				return "", err
+			}
+
+			return "embed(" + values["grammar"].(string) + config.Sep(", ", ",") + out + ")", nil
+		},
+	}
+
+	// SemanticPredicate calls a Go function to decide whether parsing can continue. It
+	// never consumes any input.
+	SemanticPredicate = common.ExpressionDefinition{
+		Name: "SemanticPredicate",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			notReusable(globals)
+
+			name := values["name"].(string)
+			predicate, found := globals[predicateKey(name)].(Predicate)
+
+			if !found {
+				return common.ErrorResult, fmt.Errorf("could not find predicate with name %s", name)
+			}
+
+			examineRest(globals, input)
+			ok, err := predicate(input, common.GetState(globals))
+
+			if err != nil {
+				return common.ErrorResult, fmt.Errorf("predicate %s failed at %s: %w", name, input.Loc, err)
+			}
+
+			if !ok {
+				return common.NewNoMatchResult(input), nil
+			}
+
+			return common.NewDiscardResult(input), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return "&{" + values["name"].(string) + "}", nil
+		},
+	}
+
+	// Primitive is an expression definition that was registered from outside the package,
+	// along with the arguments it was given in the grammar.
+	Primitive = common.ExpressionDefinition{
+		Name: "Primitive",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			notReusable(globals)
+			examineRest(globals, input)
+
+			definition := values["definition"].(*common.ExpressionDefinition)
+			expr := common.Expression{Definition: definition, Values: map[string]any{"args": values["args"]}}
+
+			return expr.Evaluate(input, globals)
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			args := values["args"].([]string)
+
+			if len(args) == 0 {
+				return "@" + values["name"].(string), nil
+			}
+
+			quoted := make([]string, len(args))
+
+			for i, arg := range args {
+				quoted[i] = strconv.Quote(arg)
+			}
+
+			return "@" + values["name"].(string) + "(" + strings.Join(quoted, config.Sep(", ", ",")) + ")", nil
+		},
+	}
+
+	// Capture remembers the text matched by its expression under a name, for a BackReference
+	// later in the same rule invocation.
+	Capture = common.ExpressionDefinition{
+		Name: "Capture",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			expr := values["expr"].(common.Expression)
+			result, err := expr.Evaluate(input, globals)
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			if common.Match(result) {
+				state, err := requireState(globals, "capture")
+
+				if err != nil {
+					return common.ErrorResult, err
+				}
+
+				state.Capture(values["name"].(string), matchedSpan(input, result).Val())
+			}
+
+			return result, nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			out, err := values["expr"].(common.Expression).Serialize(config, indentLevel)
+
+			if err != nil {
+				return "", err
+			}
+
+			return values["name"].(string) + "=" + out, nil
+		},
+	}
+
+	// Labeled gives failures inside its expression a message of its own, which parse errors
+	// use instead of the generic one.
+	Labeled = common.ExpressionDefinition{
+		Name: "Labeled",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			if state := common.GetState(globals); state != nil {
+				state.PushLabel(values["message"].(string))
+				defer state.PopLabel()
+			}
+
+			return values["expr"].(common.Expression).Evaluate(input, globals)
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return serializePostfix(values["expr"].(common.Expression), " "+serializeLabel(values["message"].(string)), config, indentLevel)
+		},
+	}
+
+	// BackReference matches the exact text of an earlier Capture. Like a string literal, the
+	// text it matches is discarded.
+	BackReference = common.ExpressionDefinition{
+		Name: "BackReference",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			state, err := requireState(globals, "back-reference")
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			text, found := state.Captured(values["name"].(string))
+			trimmedInput := input.FromFirstNotMatching(" \t\f\v\r\n")
+
+			if memo := getMemoTable(globals); memo != nil {
+				memo.examinePrefix(input, text)
+			}
+
+			if !found || !strings.HasPrefix(trimmedInput.Val(), text) {
+				expect(globals, trimmedInput, func() string { return strconv.Quote(text) })
+				return common.NewNoMatchResult(trimmedInput), nil
+			}
+
+			return common.NewDiscardResult(trimmedInput.FromStartPos(len(text))), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return "=" + values["name"].(string), nil
+		},
+	}
+
+	// Import only appears at the top of a File and is resolved while loading the grammar.
+	Import = common.ExpressionDefinition{
+		Name: "Import",
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			out := config.Indent(indentLevel) + `import "` + values["path"].(string) + `"`
+
+			if namespace, ok := values["namespace"].(string); ok {
+				out += " as " + namespace
+			}
+
+			return out, nil
+		},
+	}
+
+	// Extend only appears at the top of a File and is resolved while loading the grammar.
+	Extend = common.ExpressionDefinition{
+		Name: "Extend",
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return config.Indent(indentLevel) + `extend "` + values["path"].(string) + `"`, nil
+		},
+	}
+
+	// MacroCall is an instantiation of a rule template. It only exists between reading a
+	// grammar and expanding its templates, so it can't be evaluated.
+	MacroCall = common.ExpressionDefinition{
+		Name: "MacroCall",
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			out, err := serializeAll(values["args"].([]common.Expression), config, indentLevel, config.Sep(", ", ","))
+
+			if err != nil {
+				return "", err
+			}
+
+			return values["name"].(string) + "(" + out + ")", nil
+		},
+	}
+
+	Newline = common.ExpressionDefinition{
+		Name: "Newline",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			notReusable(globals)
+
+			state, err := requireState(globals, "NEWLINE")
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			examineLine(globals, input)
+			lineStart, indentation, found := nextLine(input)
+
+			// At the end of the input there may be nothing left to skip, and matching nothing
+			// there would keep NEWLINE* going forever
+			if lineStart.Pos() == input.Pos() {
+				found = false
+			}
+
+			if !found || state.IndentWidth(indentation.Val()) != state.IndentLevel() {
+				expect(globals, lineStart, func() string { return "NEWLINE" })
+				return common.NewNoMatchResult(lineStart), nil
+			}
+
+			return common.NewDiscardResult(lineStart.FromStartPos(len(indentation.Val()))), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return "NEWLINE", nil
+		},
+	}
+
+	Indent = common.ExpressionDefinition{
+		Name: "Indent",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			notReusable(globals)
+
+			state, err := requireState(globals, "INDENT")
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			examineLine(globals, input)
+			lineStart, indentation, found := nextLine(input)
+
+			if !found {
+				expect(globals, lineStart, func() string { return "INDENT" })
+				return common.NewNoMatchResult(lineStart), nil
+			}
+
+			width := state.IndentWidth(indentation.Val())
+
+			if width <= state.IndentLevel() {
+				expect(globals, lineStart, func() string { return "INDENT" })
+				return common.NewNoMatchResult(lineStart), nil
+			}
+
+			state.PushIndent(width)
+
+			return common.NewDiscardResult(lineStart.FromStartPos(len(indentation.Val()))), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return "INDENT", nil
+		},
+	}
+
+	Dedent = common.ExpressionDefinition{
+		Name: "Dedent",
+		Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+			notReusable(globals)
+
+			state, err := requireState(globals, "DEDENT")
+
+			if err != nil {
+				return common.ErrorResult, err
+			}
+
+			examineLine(globals, input)
+			lineStart, indentation, found := nextLine(input)
+
+			if !found || state.IndentWidth(indentation.Val()) >= state.IndentLevel() {
+				expect(globals, lineStart, func() string { return "DEDENT" })
+				return common.NewNoMatchResult(lineStart), nil
+			}
+
+			state.PopIndent()
+
+			// Several levels may end on the same line, so the line break is left for whatever
+			// comes after the last DEDENT.
+			return common.NewDiscardResult(input), nil
+		},
+		Serialize: func(values map[string]any, config *common.SerializerConfig, indentLevel int) (string, error) {
+			return "DEDENT", nil
+		},
 	}
 )
+
+// requireState returns the per-parse state, which expressions that keep track of
+// something between matches can't do without. It is only there when evaluating through
+// one of the Grammar's Parse methods.
+func requireState(globals map[string]any, what string) (*common.ParseState, error) {
+	state := common.GetState(globals)
+
+	if state == nil {
+		return nil, fmt.Errorf("%s can only be evaluated through Grammar.Parse, which keeps per-parse state", what)
+	}
+
+	return state, nil
+}
+
+// expect records what an expression that failed to match at input was looking for, for
+// error messages.
+func expect(globals map[string]any, input common.MetaString, describe func() string) {
+	if state := common.GetState(globals); state != nil {
+		state.Expect(input, describe)
+	}
+}
+
+// matchedSpan returns the text a successful result matched. A string result knows exactly
+// which text it captured, anything else is taken to span everything it consumed after any
+// leading whitespace.
+func matchedSpan(input common.MetaString, result common.EvaluateResult) common.MetaString {
+	if stringResult, ok := result.(common.StringResult); ok {
+		return stringResult.Val()
+	}
+
+	consumed := input.FromPosRange(0, result.Remaining().Pos()-input.Pos())
+	return consumed.FromStartPos(len(consumed.Val()) - len(strings.TrimLeft(consumed.Val(), " \t\f\v\r\n")))
+}
+
+// nextLine skips the rest of the current line and any blank lines after it. It returns the
+// start of the next non-blank line and the indentation at the front of it. If the current
+// line still has content on it, found is false. The end of the input counts as a line with
+// no indentation.
+func nextLine(input common.MetaString) (lineStart, indentation common.MetaString, found bool) {
+	contents := input.Val()
+	start := -1
+	end := 0
+
+	for ; end < len(contents); end++ {
+		if contents[end] == '\n' {
+			start = end + 1
+		} else if !strings.ContainsRune(" \t\f\v\r", rune(contents[end])) {
+			break
+		}
+	}
+
+	if end == len(contents) {
+		lineStart = input.FromStartPos(end)
+		return lineStart, lineStart, true
+	}
+
+	if start == -1 {
+		return input, input, false
+	}
+
+	lineStart = input.FromStartPos(start)
+	indentation = lineStart.FromPosRange(0, len(contents[start:])-len(strings.TrimLeft(contents[start:], " \t")))
+
+	return lineStart, indentation, true
+}
+
+func serializeAll(exprs []common.Expression, config *common.SerializerConfig, indentLevel int, separator string) (string, error) {
+	parts := make([]string, len(exprs))
+
+	for i, expr := range exprs {
+		part, err := expr.Serialize(config, indentLevel)
+
+		if err != nil {
+			return "", err
+		}
+
+		parts[i] = part
+	}
+
+	return strings.Join(parts, separator), nil
+}
+
+func serializeLabel(message string) string {
+	return "@error(" + strconv.Quote(message) + ")"
+}
+
+func serializePostfix(expr common.Expression, operator string, config *common.SerializerConfig, indentLevel int) (string, error) {
+	out, err := expr.Serialize(config, indentLevel)
+
+	if err != nil {
+		return "", err
+	}
+
+	return out + operator, nil
+}
@@ -0,0 +1,424 @@
+package parsley
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// parseCase parses input with grammar, and expects either the condensed tree in want or
+// an error containing wantErr.
+type parseCase struct {
+	name    string
+	grammar string
+	input   string
+	want    string
+	wantErr string
+}
+
+func runParseCases(t *testing.T, cases []parseCase) {
+	t.Helper()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseCondensed(tc.grammar, tc.input)
+
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %s, %v, want an error containing %q", got, err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tc.want {
+				t.Errorf("got\n\t%s\nwant\n\t%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func parseCondensed(grammarContents, input string) (string, error) {
+	grammar, err := ParseGrammar(grammarContents)
+
+	if err != nil {
+		return "", err
+	}
+
+	return condensed(grammar, input)
+}
+
+func condensed(grammar *Grammar, input string) (string, error) {
+	result, err := grammar.Parse(input)
+
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := result.Condense()
+
+	if err != nil {
+		return "", err
+	}
+
+	return tree.String(), nil
+}
+
+const indentGrammar = `input: stmt+
+stmt: name block?
+block: INDENT stmt (NEWLINE stmt)* DEDENT
+name: /[a-z]+/
+`
+
+func TestIndentation(t *testing.T) {
+	runParseCases(t, []parseCase{
+		{
+			name:    "block",
+			grammar: indentGrammar,
+			input:   "a\n  b\n  c\nd\n",
+			want:    "input<[[stmt<[name<[String<a>]>, [block<[stmt<[name<[String<b>]>, []]>, [[stmt<[name<[String<c>]>, []]>]]]>]]>, stmt<[name<[String<d>]>, []]>]]>",
+		},
+		{
+			name:    "nested blocks ending together",
+			grammar: indentGrammar,
+			input:   "a\n  b\n    c\nd",
+			want:    "input<[[stmt<[name<[String<a>]>, [block<[stmt<[name<[String<b>]>, [block<[stmt<[name<[String<c>]>, []]>, []]>]]>, []]>]]>, stmt<[name<[String<d>]>, []]>]]>",
+		},
+		{
+			name:    "blank lines",
+			grammar: indentGrammar,
+			input:   "a\n\n  b\n   \n  c\n",
+			want:    "input<[[stmt<[name<[String<a>]>, [block<[stmt<[name<[String<b>]>, []]>, [[stmt<[name<[String<c>]>, []]>]]]>]]>]]>",
+		},
+		{
+			name:    "tab is as wide as the tab width",
+			grammar: indentGrammar,
+			input:   "a\n\tb\n        c\n",
+			want:    "input<[[stmt<[name<[String<a>]>, [block<[stmt<[name<[String<b>]>, []]>, [[stmt<[name<[String<c>]>, []]>]]]>]]>]]>",
+		},
+		{
+			name:    "dedent to a level that was never indented to",
+			grammar: "input: stmt (NEWLINE stmt)*\nstmt: name block?\nblock: INDENT stmt (NEWLINE stmt)* DEDENT\nname: /[a-z]+/\n",
+			input:   "a\n    b\n  c\n",
+			wantErr: "3:1",
+		},
+		{
+			name:    "indent without a block",
+			grammar: "input: name (NEWLINE name)*\nname: /[a-z]+/\n",
+			input:   "a\n  b\n",
+			wantErr: "2:1",
+		},
+		{
+			name:    "repeated NEWLINE ends at the end of the input",
+			grammar: "input: (name NEWLINE*)+\nname: /[a-z]+/\n",
+			input:   "a\nb\n\n",
+			want:    "input<[[[name<[String<a>]>, []], [name<[String<b>]>, []]]]>",
+		},
+		{
+			name:    "NEWLINE doesn't match nothing at the end of the input",
+			grammar: "input: name NEWLINE+\nname: /[a-z]+/\n",
+			input:   "a",
+			wantErr: "1:2: unknown token",
+		},
+	})
+}
+
+func TestIndentationNeedsState(t *testing.T) {
+	for _, definition := range []*common.ExpressionDefinition{&Newline, &Indent, &Dedent} {
+		expr := common.Expression{Definition: definition, Values: map[string]any{}}
+
+		// Evaluated on its own, without the state that Grammar.Parse sets up
+		if _, err := expr.Evaluate(common.NewMetaString("a\n  b"), map[string]any{}); err == nil || !strings.Contains(err.Error(), "can only be evaluated through Grammar.Parse") {
+			t.Errorf("%s: got error %v", definition.Name, err)
+		}
+	}
+}
+
+func TestTabWidth(t *testing.T) {
+	grammar, err := ParseGrammar(indentGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grammar.SetTabWidth(4)
+
+	got, err := condensed(grammar, "a\n\tb\n    c\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "input<[[stmt<[name<[String<a>]>, [block<[stmt<[name<[String<b>]>, []]>, [[stmt<[name<[String<c>]>, []]>]]]>]]>]]>"
+
+	if got != want {
+		t.Errorf("got\n\t%s\nwant\n\t%s", got, want)
+	}
+
+	grammar.SetTabWidth(0)
+
+	if got, _ := condensed(grammar, "a\n\tb\n    c\n"); got == want {
+		t.Error("a tab and four spaces are at the same level with the default tab width")
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	hexGrammar := "input: escape*\nescape: \"%\" hex{4}\nhex: /[0-9a-f]/\n"
+	rangeGrammar := "input: number*\nnumber: digit{2,3}\ndigit: /[0-9]/\n"
+	openGrammar := "input: number*\nnumber: digit{2,}\ndigit: /[0-9]/\n"
+
+	runParseCases(t, []parseCase{
+		{name: "exact count", grammar: hexGrammar, input: "%00ff", want: "input<[[escape<[[hex<[String<0>]>, hex<[String<0>]>, hex<[String<f>]>, hex<[String<f>]>]]>]]>"},
+		{name: "too few for an exact count", grammar: hexGrammar, input: "%00f", wantErr: "1:5"},
+		{name: "too many for an exact count", grammar: hexGrammar, input: "%00ffe", wantErr: "1:6"},
+		{name: "minimum of a range", grammar: rangeGrammar, input: "12", want: "input<[[number<[[digit<[String<1>]>, digit<[String<2>]>]]>]]>"},
+		{name: "maximum of a range", grammar: rangeGrammar, input: "123", want: "input<[[number<[[digit<[String<1>]>, digit<[String<2>]>, digit<[String<3>]>]]>]]>"},
+		{name: "stops at the maximum", grammar: rangeGrammar, input: "12345", want: "input<[[number<[[digit<[String<1>]>, digit<[String<2>]>, digit<[String<3>]>]]>, number<[[digit<[String<4>]>, digit<[String<5>]>]]>]]>"},
+		{name: "below the minimum after the maximum", grammar: rangeGrammar, input: "1234", wantErr: "1:5"},
+		{name: "below the minimum of a range", grammar: rangeGrammar, input: "1", wantErr: "1:2"},
+		{name: "open range", grammar: openGrammar, input: "12345", want: "input<[[number<[[digit<[String<1>]>, digit<[String<2>]>, digit<[String<3>]>, digit<[String<4>]>, digit<[String<5>]>]]>]]>"},
+		{name: "below the minimum of an open range", grammar: openGrammar, input: "1", wantErr: "1:2"},
+		{name: "maximum below minimum", grammar: "input: digit{3,2}\ndigit: /[0-9]/\n", wantErr: "maximum below its minimum"},
+	})
+}
+
+func TestSeparated(t *testing.T) {
+	// The list is optional so that a list that doesn't match is an error in the input
+	grammar := func(list string) string {
+		return "input: list?\nlist: " + list + "\nitem: /[a-z]+/\n"
+	}
+
+	runParseCases(t, []parseCase{
+		{name: "sep", grammar: grammar(`"[" sep(item, ",") "]"`), input: "[a, b,c]", want: "input<[[list<[[item<[String<a>]>, item<[String<b>]>, item<[String<c>]>]]>]]>"},
+		{name: "percent", grammar: grammar(`"[" item % "," "]"`), input: "[a, b,c]", want: "input<[[list<[[item<[String<a>]>, item<[String<b>]>, item<[String<c>]>]]>]]>"},
+		{name: "single item", grammar: grammar(`"[" sep(item, ",") "]"`), input: "[a]", want: "input<[[list<[[item<[String<a>]>]]>]]>"},
+		{name: "empty", grammar: grammar(`"[" sep(item, ",") "]"`), input: "[]", want: "input<[[list<[[]]>]]>"},
+		{name: "nonempty", grammar: grammar(`"[" sep(item, ",", nonempty) "]"`), input: "[]", wantErr: "1:2"},
+		{name: "no trailing separator", grammar: grammar(`"[" sep(item, ",") "]"`), input: "[a, b,]", wantErr: "1:7"},
+		{name: "trailing separator", grammar: grammar(`"[" sep(item, ",", trailing) "]"`), input: "[a, b,]", want: "input<[[list<[[item<[String<a>]>, item<[String<b>]>]]>]]>"},
+		{name: "trailing separator is optional", grammar: grammar(`"[" sep(item, ",", trailing) "]"`), input: "[a, b]", want: "input<[[list<[[item<[String<a>]>, item<[String<b>]>]]>]]>"},
+		{name: "separator made of several expressions", grammar: grammar(`sep(item, "-" ">")`), input: "a -> b->c", want: "input<[[list<[[item<[String<a>]>, item<[String<b>]>, item<[String<c>]>]]>]]>"},
+		{name: "unknown option", grammar: grammar(`sep(item, ",", sorted)`), wantErr: "unknown option"},
+		{name: "missing separator", grammar: grammar(`sep(item)`), wantErr: "sep takes an item and a separator"},
+	})
+}
+
+func TestEmbed(t *testing.T) {
+	sum, err := ParseGrammar("input: number (\"+\" number)*\nnumber: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outer, err := ParseGrammar("input: tag*\ntag: name \"{\" embed(sum, body) \"}\"\nbody: /[^}]*/\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outer.Embed("sum", sum)
+
+	got, err := condensed(outer, "a{1+2} b{3}")
+	want := "input<[[tag<[name<[String<a>]>, sum<[number<[String<1>]>, [[number<[String<2>]>]]]>]>, tag<[name<[String<b>]>, sum<[number<[String<3>]>, []]>]>]]>"
+
+	if err != nil || got != want {
+		t.Errorf("got %s, %v, want %s", got, err, want)
+	}
+
+	// Failures inside the embedded text are reported where they are in the whole input
+	if _, err := outer.Parse("a{1+2} b{3+}"); err == nil || !strings.Contains(err.Error(), "1:12") {
+		t.Errorf("got error %v", err)
+	}
+
+	unregistered, err := ParseGrammar("input: embed(other, /.*/)\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := unregistered.Parse("x"); err == nil || !strings.Contains(err.Error(), "could not find embedded grammar with name other") {
+		t.Errorf("got error %v", err)
+	}
+
+	// Evaluated on its own, without the state that Grammar.Parse sets up
+	globals := outer.newGlobals(context.Background(), ParseOptions{})
+	delete(globals, common.StateKey)
+
+	if _, err := outer.rules["tag"].([]common.Expression)[2].Evaluate(common.NewMetaString("1+2"), globals); err == nil || !strings.Contains(err.Error(), "embed can only be evaluated through Grammar.Parse") {
+		t.Errorf("got error %v", err)
+	}
+
+	if _, err := ParseGrammar("input: embed(\"sum\", body)\nbody: /.*/\n"); err == nil || !strings.Contains(err.Error(), "embed takes the name of an embedded grammar and an expression") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestSemanticPredicate(t *testing.T) {
+	grammar, err := ParseGrammar("input: word*\nword: &{notKeyword} /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grammar.Predicate("notKeyword", func(input common.MetaString, state *common.ParseState) (bool, error) {
+		words := strings.Fields(input.Val())
+		return len(words) > 0 && !state.User.(map[string]bool)[words[0]], nil
+	})
+
+	keywords := map[string]bool{"if": true}
+
+	if _, err := grammar.ParseWithOptions("a b c", ParseOptions{User: keywords}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := grammar.ParseWithOptions("a if c", ParseOptions{User: keywords}); err == nil || !strings.Contains(err.Error(), "1:2") {
+		t.Errorf("got error %v, want one before the keyword", err)
+	}
+}
+
+func TestSemanticPredicateState(t *testing.T) {
+	grammar, err := ParseGrammar("input: (<(&{mark} \"a\" \"!\") (\"a\" &{marked})>)?\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grammar.Predicate("mark", func(input common.MetaString, state *common.ParseState) (bool, error) {
+		state.Set("marked", true)
+		return true, nil
+	})
+
+	grammar.Predicate("marked", func(input common.MetaString, state *common.ParseState) (bool, error) {
+		marked, _ := state.Get("marked")
+		return marked == true, nil
+	})
+
+	if _, err := grammar.Parse("a!"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The first alternative set the value, but it was undone when that alternative failed
+	if _, err := grammar.Parse("a"); err == nil {
+		t.Error("state set by a failed alternative was kept")
+	}
+}
+
+func TestSemanticPredicateErrors(t *testing.T) {
+	grammar, err := ParseGrammar("input: &{check} /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := grammar.Parse("a"); err == nil || !strings.Contains(err.Error(), "could not find predicate with name check") {
+		t.Errorf("got error %v", err)
+	}
+
+	broken := errors.New("broken")
+
+	grammar.Predicate("check", func(input common.MetaString, state *common.ParseState) (bool, error) {
+		return false, broken
+	})
+
+	if _, err := grammar.Parse("a"); err == nil || !strings.Contains(err.Error(), "predicate check failed at") || !errors.Is(err, broken) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	tags := "input: element*\nelement: \"<\" tag=name \">\" content* \"</\" =tag \">\"\ncontent: <element text>\ntext: /[^<]+/\nname: /[a-z]+/\n"
+	choice := "input: pair?\npair: <(x=name \"!\") (name \"?\" =x)>\nname: /[a-z]+/\n"
+
+	runParseCases(t, []parseCase{
+		{name: "back-reference", grammar: tags, input: "<a>hi</a>", want: "input<[[element<[name<[String<a>]>, [content<[text<[String<hi>]>]>]]>]]>"},
+		{name: "back-reference mismatch", grammar: tags, input: "<a>hi</b>", wantErr: "1:8"},
+		{name: "each invocation has its own captures", grammar: tags, input: "<a><b></b></a>", want: "input<[[element<[name<[String<a>]>, [content<[element<[name<[String<b>]>, []]>]>]]>]]>"},
+		{name: "inner capture doesn't leak out", grammar: tags, input: "<a><b></b></b>", wantErr: "1:13"},
+		{name: "backtracking undoes captures", grammar: choice, input: "a ? a", wantErr: "1:5"},
+		{name: "capture in the alternative that matched", grammar: choice, input: "a!", want: "input<[[pair<[[name<[String<a>]>]]>]]>"},
+	})
+}
+
+func TestCapturesNeedState(t *testing.T) {
+	grammar, err := ParseGrammar("input: x=name =x\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Evaluated on their own, without the state that Grammar.Parse sets up
+	for _, expr := range grammar.rules["input"].([]common.Expression) {
+		if _, err := expr.Evaluate(common.NewMetaString("a a"), grammar.rules); err == nil || !strings.Contains(err.Error(), "can only be evaluated through Grammar.Parse") {
+			t.Errorf("%s: got error %v", expr.Definition.Name, err)
+		}
+	}
+}
+
+func TestFailureLabels(t *testing.T) {
+	list := "input: list+\nlist: \"[\" name* \"]\" @error(\"unclosed list\")\nname: /[a-z]+/\n"
+	ruleLabel := "input: list+\nlist @error(\"bad list\"): \"[\" name* \"]\"\nname: /[a-z]+/\n"
+
+	runParseCases(t, []parseCase{
+		{name: "label on an expression", grammar: list, input: "[a b", wantErr: "1:5: unclosed list"},
+		{name: "label on a rule", grammar: ruleLabel, input: "[a b", wantErr: "1:5: bad list"},
+		{name: "rule that doesn't fit at all", grammar: ruleLabel, input: "12", wantErr: "1:1: unknown token"},
+		{
+			name:    "label on a template",
+			grammar: "input: wrap(name)\nwrap(x) @error(\"bad wrap\"): \"(\" x \")\"\nname: /[a-z]+/\n",
+			input:   "(a",
+			wantErr: "1:3: bad wrap",
+		},
+		{
+			name:    "innermost label wins",
+			grammar: "input: list+ @error(\"bad input\")\nlist: \"[\" name* \"]\" @error(\"unclosed list\")\nname: /[a-z]+/\n",
+			input:   "[a",
+			wantErr: "1:3: unclosed list",
+		},
+		{
+			name:    "label on a required rule",
+			grammar: "input: stmt+\nstmt: name args\nargs: \"(\" name \")\" @error(\"unclosed args\")\nname: /[a-z]+/\n",
+			input:   "b(c",
+			wantErr: "1:4: unclosed args",
+		},
+		{
+			// The optional backtracks and the repetition stops before "(", but the error is
+			// still where args went wrong
+			name:    "label on an optional rule",
+			grammar: "input: stmt+\nstmt: name args?\nargs: \"(\" name \")\" @error(\"unclosed args\")\nname: /[a-z]+/\n",
+			input:   "b(c",
+			wantErr: "1:4: unclosed args",
+		},
+		{
+			name:    "furthest failure in a repetition",
+			grammar: "input: pair*\npair: name \"=\" name \";\"\nname: /[a-z]+/\n",
+			input:   "a=b;c=d e",
+			wantErr: "1:9: unknown token",
+		},
+	})
+
+	if _, err := ParseGrammar("input: name @error(1)\nname: /[a-z]+/\n"); err == nil || !strings.Contains(err.Error(), "@error takes a single string") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestFailureLabelSerialize(t *testing.T) {
+	grammar, err := ParseGrammar("input @error(\"bad input\"): name+ @error(\"no names\")\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := grammar.topLevelExpr.Values["rules"].([]common.Expression)
+	out, err := common.Serialize(rules[0], false, 0)
+
+	if err != nil || !strings.HasPrefix(out, `input @error("bad input"): name+ @error("no names")`) {
+		t.Errorf("got %s, %v", out, err)
+	}
+}
@@ -1,8 +1,14 @@
 package parsley
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/l-donovan/parsley/common"
@@ -11,49 +17,65 @@ import (
 type ParseError struct {
 	Contents string
 	Loc      common.StringPos
-}
 
-func (e ParseError) Error() string {
-	return fmt.Sprintf("unknown token beginning at %s", e.Loc)
+	// Expected describes what could have come next at Loc, as grammar syntax, and Rules
+	// are the rules that were being parsed when it was expected, outermost first. Both are
+	// empty if nothing was expected at exactly Loc.
+	Expected []string
+	Rules    []string
+
+	// Labels are the messages of the `@error` labels around what was expected at Loc. If
+	// there are any, they are the error message.
+	Labels []string
 }
 
-func digitCount(input int) int {
-	if input == 0 {
-		return 1
-	}
+func newParseError(contents string, failure common.MetaString, globals map[string]any) ParseError {
+	state := common.GetState(globals)
 
-	count := 0
+	if state == nil {
+		return ParseError{Contents: contents, Loc: failure.Loc}
+	}
 
-	for input != 0 {
-		input /= 10
-		count++
+	// Parsing usually got further than where it stopped consuming input, in an optional
+	// part or a repetition that backtracked, and that is where it went wrong
+	if furthest, ok := state.Furthest(); ok && furthest.Pos() > failure.Pos() {
+		failure = furthest
 	}
 
-	return count
+	err := ParseError{Contents: contents, Loc: failure.Loc}
+	err.Expected, err.Rules = state.Expected(failure.Pos())
+	err.Labels = state.Labels(failure.Pos())
+
+	return err
 }
 
-func (e ParseError) PrintContext(contextLineCount int) {
-	lines := strings.Split(e.Contents, "\n")
-	startLineNum := max(0, e.Loc.Line-contextLineCount)
-	endLineNum := min(e.Loc.Line+contextLineCount+1, len(lines))
-	maxLineNumWidth := digitCount(endLineNum + 1)
+// Error returns the error as path:line:col: message, the way compilers report errors, or
+// line:col: message if the input didn't come from a Source.
+func (e ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Loc, e.Message())
+}
 
-	fmt.Println("Context:")
+// Message returns the error without its position.
+func (e ParseError) Message() string {
+	if len(e.Labels) > 0 {
+		return strings.Join(e.Labels, "; ")
+	}
 
-	for i := startLineNum; i < endLineNum; i++ {
-		if i == e.Loc.Line {
-			// We're doing a "best effort" kinda thing here for characters with wide
-			// printing widths, specifically tabs.
-			tabCount := strings.Count(lines[i][:e.Loc.Col], "\t")
-			left := strings.Repeat("\t", tabCount) + strings.Repeat(" ", e.Loc.Col-tabCount)
+	return "unknown token"
+}
 
-			// TODO: Make sure TERM supports color before printing a bunch of escape sequences
-			fmt.Printf("%*d │ %s\x1b[30;47m%c\x1b[m%s\n", maxLineNumWidth, i+1, lines[i][:e.Loc.Col], lines[i][e.Loc.Col], lines[i][e.Loc.Col+1:])
-			fmt.Printf("%*s │ %s╰─── [Starting here]\n", maxLineNumWidth, "", left)
-		} else {
-			fmt.Printf("%*d │ %s\n", maxLineNumWidth, i+1, lines[i])
-		}
-	}
+// GrammarError is a syntax error in a grammar file, at the token where it was found.
+type GrammarError struct {
+	Loc common.StringPos
+	Err error
+}
+
+func (e GrammarError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %v", displayName(e.Loc.File), e.Loc.Line+1, e.Loc.Col+1, e.Err)
+}
+
+func (e GrammarError) Unwrap() error {
+	return e.Err
 }
 
 type TokenDefinition struct {
@@ -61,76 +83,250 @@ type TokenDefinition struct {
 	Pattern regexp.Regexp
 }
 
+// LexerToken is a token of a grammar file. Pos is its offset in bytes from the start of
+// the file.
 type LexerToken struct {
 	Name     string
 	Contents string
+	Pos      int
 }
 
 type Parser struct {
 	tokens []LexerToken
+
+	// templates are the rule templates that can be called by name, which are the ones
+	// declared in the file and in the files it imports or extends. Any other name
+	// followed by a parenthesis is a reference to a rule followed by a group.
+	// importedTemplates returns the ones in an imported or extended file, if the parser
+	// can get at other files.
+	templates         map[string]bool
+	importedTemplates func(path string) ([]string, error)
+
+	// source is the file being read, if the parser knows it, which is what positions are
+	// resolved against. last is the token that was read most recently.
+	source *common.Source
+	last   LexerToken
 }
 
 type Grammar struct {
 	topLevelExpr common.Expression
 	rules        map[string]any
+	tabWidth     int
+	embedded     map[string]*Grammar
+	actions      map[string]Action
+	predicates   map[string]Predicate
 }
 
-func (g Grammar) Parse(contents string) (common.EvaluateResult, error) {
-	contentsMeta := common.NewMetaString(contents)
-	result, err := g.topLevelExpr.Evaluate(contentsMeta, g.rules)
+// ParseOptions changes how a single parse behaves.
+type ParseOptions struct {
+	// User is handed to predicates as ParseState.User.
+	User any
+
+	// MaxDepth bounds how deeply expressions can nest, and defaults to
+	// common.DefaultMaxDepth. MaxSteps bounds how many expressions can be evaluated, and
+	// MaxInputSize how many bytes of input are accepted. Zero means no limit for both.
+	MaxDepth     int
+	MaxSteps     int
+	MaxInputSize int
+}
 
-	if err != nil {
-		return nil, err
+// Predicate decides whether parsing can continue at the given input. It is called from a
+// grammar with `&{name}` and never consumes anything.
+type Predicate func(input common.MetaString, state *common.ParseState) (bool, error)
+
+// SetTabWidth sets how many columns a tab advances indentation to when INDENT, DEDENT and
+// NEWLINE measure it. The default is common.DefaultTabWidth.
+func (g *Grammar) SetTabWidth(width int) {
+	g.tabWidth = width
+}
+
+// Embed registers another grammar under a name, so that rules can hand the text they match
+// over to it with `embed(name, expression)`. The value of what it matched comes from the
+// embedded grammar's actions, starting with the one for its input rule.
+func (g *Grammar) Embed(name string, embedded *Grammar) {
+	if g.embedded == nil {
+		g.embedded = map[string]*Grammar{}
+	}
+
+	g.embedded[name] = embedded
+}
+
+// Predicate registers a predicate under a name for `&{name}` to call.
+func (g *Grammar) Predicate(name string, predicate Predicate) {
+	if g.predicates == nil {
+		g.predicates = map[string]Predicate{}
+	}
+
+	g.predicates[name] = predicate
+}
+
+// embeddedKey and predicateKey are the globals keys for embedded grammars and predicates.
+// Like common.StateKey, they can't collide with a rule name.
+func embeddedKey(name string) string {
+	return "$grammar:" + name
+}
+
+func predicateKey(name string) string {
+	return "$predicate:" + name
+}
+
+// labelKey is the globals key for the failure label of a rule.
+func labelKey(name string) string {
+	return "$label:" + name
+}
+
+// newGlobals returns the rule table along with a fresh state for a single parse.
+func (g Grammar) newGlobals(ctx context.Context, opts ParseOptions) map[string]any {
+	globals := make(map[string]any, len(g.rules)+len(g.embedded)+len(g.predicates)+1)
+
+	for name, rule := range g.rules {
+		globals[name] = rule
+	}
+
+	for name, embedded := range g.embedded {
+		globals[embeddedKey(name)] = embedded
+	}
+
+	for name, predicate := range g.predicates {
+		globals[predicateKey(name)] = predicate
 	}
 
+	// A context that can never be cancelled isn't worth checking
+	if ctx != nil && ctx.Done() == nil {
+		ctx = nil
+	}
+
+	state := common.NewParseState(g.tabWidth)
+	state.User = opts.User
+	state.Limits = common.Limits{Context: ctx, MaxDepth: opts.MaxDepth, MaxSteps: opts.MaxSteps}
+	globals[common.StateKey] = state
+
+	return globals
+}
+
+// unconsumed returns where parsing went wrong if result didn't consume all of the input
+// other than trailing whitespace, or nil if it did.
+func unconsumed(result common.EvaluateResult) *common.MetaString {
 	remaining := result.Remaining()
 
-	if strings.TrimSpace(remaining.Val()) != "" {
-		if multipleResult, ok := result.(common.MultipleResult); ok {
-			if next := multipleResult.Next(); next != nil {
-				return nil, ParseError{contents, next.Loc}
-			}
-		}
+	if common.Match(result) && strings.TrimSpace(remaining.Val()) == "" {
+		return nil
+	}
+
+	multipleResult, ok := result.(common.MultipleResult)
+
+	if ruleResult, isRule := result.(common.RuleResult); isRule {
+		multipleResult, ok = ruleResult.Result(), true
+	}
+
+	if next := multipleResult.Next(); ok && next != nil && next.Pos() > remaining.Pos() {
+		return next
+	}
+
+	return &remaining
+}
+
+func (g Grammar) Parse(contents string) (common.EvaluateResult, error) {
+	return g.ParseWithOptions(contents, ParseOptions{})
+}
+
+func (g Grammar) ParseWithOptions(contents string, opts ParseOptions) (common.EvaluateResult, error) {
+	return g.ParseContext(context.Background(), contents, opts)
+}
+
+// ParseContext parses contents, giving up once ctx is done or one of the limits in opts is
+// reached. Each limit has its own error type: common.DepthLimitError,
+// common.StepLimitError and common.InputSizeError. Cancellation is returned wrapping
+// ctx.Err().
+func (g Grammar) ParseContext(ctx context.Context, contents string, opts ParseOptions) (common.EvaluateResult, error) {
+	if opts.MaxInputSize > 0 && len(contents) > opts.MaxInputSize {
+		return nil, common.InputSizeError{Max: opts.MaxInputSize, Size: len(contents)}
+	}
 
-		return nil, ParseError{contents, remaining.Loc}
+	return g.parse(ctx, common.NewMetaString(contents), opts)
+}
+
+// ParseSource parses a source, so that positions in the result and in errors carry its
+// name.
+func (g Grammar) ParseSource(source *common.Source) (common.EvaluateResult, error) {
+	return g.ParseSourceContext(context.Background(), source, ParseOptions{})
+}
+
+// ParseSourceContext is ParseSource with the cancellation and limits of ParseContext.
+func (g Grammar) ParseSourceContext(ctx context.Context, source *common.Source, opts ParseOptions) (common.EvaluateResult, error) {
+	if opts.MaxInputSize > 0 && len(source.Contents) > opts.MaxInputSize {
+		return nil, common.InputSizeError{Max: opts.MaxInputSize, Size: len(source.Contents)}
+	}
+
+	return g.parse(ctx, source.MetaString(), opts)
+}
+
+func (g Grammar) parse(ctx context.Context, input common.MetaString, opts ParseOptions) (common.EvaluateResult, error) {
+	globals := g.newGlobals(ctx, opts)
+	result, err := g.topLevelExpr.Evaluate(input, globals)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if failure := unconsumed(result); failure != nil {
+		return nil, newParseError(input.Val(), *failure, globals)
 	}
 
 	return result, nil
 }
 
-var tokenDefinitions map[string]*regexp.Regexp
+// builtinExpressions are keywords that refer to a primitive instead of a rule.
+var builtinExpressions = map[string]*common.ExpressionDefinition{
+	"NEWLINE": &Newline,
+	"INDENT":  &Indent,
+	"DEDENT":  &Dedent,
+}
+
+// tokenDefinitions are tried in order, and the first one that matches wins.
+var tokenDefinitions []TokenDefinition
 
 func init() {
-	tokenDefinitions = map[string]*regexp.Regexp{
-		"Colon":             regexp.MustCompile(`^:`),
-		"Pipe":              regexp.MustCompile(`^\|`),
-		"Caret":             regexp.MustCompile(`^\^`),
-		"QuestionMark":      regexp.MustCompile(`^\?`),
-		"Newline":           regexp.MustCompile(`^[\n\r]+`),
-		"LineComment":       regexp.MustCompile(`^#.+?[\n\r]+`),
-		"RegularExpression": regexp.MustCompile(`^/(?:[^/\\]|\\.)*/`),
-		"Keyword":           regexp.MustCompile(`^[\^!?.]?[\w_]+`),
-		"String":            regexp.MustCompile(`^"(?:[^"\\]|\\.)*"`),
-		"Star":              regexp.MustCompile(`^\*`),
-		"Plus":              regexp.MustCompile(`^\+`),
-		"LeftAngleBracket":  regexp.MustCompile(`^<`),
-		"RightAngleBracket": regexp.MustCompile(`^>`),
-		"LeftParenthesis":   regexp.MustCompile(`^\(`),
-		"RightParenthesis":  regexp.MustCompile(`^\)`),
-		"AtSign":            regexp.MustCompile(`^@`),
-		"Whitespace":        regexp.MustCompile(`^[\t\f\v ]+`),
+	tokenDefinitions = []TokenDefinition{
+		{"Colon", *regexp.MustCompile(`^:`)},
+		{"Pipe", *regexp.MustCompile(`^\|`)},
+		{"Caret", *regexp.MustCompile(`^\^`)},
+		{"QuestionMark", *regexp.MustCompile(`^\?`)},
+		{"Newline", *regexp.MustCompile(`^[\n\r]+`)},
+		{"LineComment", *regexp.MustCompile(`^#.*?(?:[\n\r]+|$)`)},
+		{"RegularExpression", *regexp.MustCompile(`^/(?:[^/\\]|\\.)*/`)},
+		{"Capture", *regexp.MustCompile(`^[\w_]+=`)},
+		{"BackReference", *regexp.MustCompile(`^=[\w_]+`)},
+		{"Call", *regexp.MustCompile(`^[\w_]+(?:\.[\w_]+)*\(`)},
+		{"Keyword", *regexp.MustCompile(`^[\^!?.]?[\w_]+(?:\.[\w_]+)*`)},
+		{"String", *regexp.MustCompile(`^"(?:[^"\\]|\\.)*"`)},
+		{"Star", *regexp.MustCompile(`^\*`)},
+		{"Plus", *regexp.MustCompile(`^\+`)},
+		{"Percent", *regexp.MustCompile(`^%`)},
+		{"Comma", *regexp.MustCompile(`^,`)},
+		{"Repeat", *regexp.MustCompile(`^\{\s*\d+\s*(?:,\s*\d*\s*)?\}`)},
+		{"LeftAngleBracket", *regexp.MustCompile(`^<`)},
+		{"RightAngleBracket", *regexp.MustCompile(`^>`)},
+		{"LeftParenthesis", *regexp.MustCompile(`^\(`)},
+		{"RightParenthesis", *regexp.MustCompile(`^\)`)},
+		{"Predicate", *regexp.MustCompile(`^&\{\s*[\w_]+\s*\}`)},
+		{"AtSign", *regexp.MustCompile(`^@`)},
+		{"Whitespace", *regexp.MustCompile(`^[\t\f\v ]+`)},
 	}
 }
 
+// Lex splits text into tokens, leaving out whitespace and comments. An error is a
+// GrammarError at the text that doesn't make up a token.
 func (p *Parser) Lex(text string) ([]LexerToken, error) {
 	var tokens []LexerToken
 	var found bool
+	pos := 0
 
 	for len(text) > 0 {
 		found = false
 
-		for tokenName, tokenPattern := range tokenDefinitions {
-			match := tokenPattern.FindStringSubmatchIndex(text)
+		for _, tokenDefinition := range tokenDefinitions {
+			match := tokenDefinition.Pattern.FindStringSubmatchIndex(text)
 
 			if match == nil {
 				continue
@@ -138,39 +334,103 @@ func (p *Parser) Lex(text string) ([]LexerToken, error) {
 
 			found = true
 			contents := text[match[0]:match[1]]
-			token := LexerToken{Name: tokenName, Contents: contents}
+			token := LexerToken{Name: tokenDefinition.Name, Contents: contents, Pos: pos}
 			text = text[match[1]:]
+			pos += match[1]
 
-			if tokenName != "Whitespace" && tokenName != "LineComment" {
+			if tokenDefinition.Name != "Whitespace" && tokenDefinition.Name != "LineComment" {
 				tokens = append(tokens, token)
 			}
+
+			break
 		}
 
 		if !found {
-			return tokens, fmt.Errorf("could not find token matching %s", text)
+			rest, _, _ := strings.Cut(text, "\n")
+			return tokens, GrammarError{p.loc(pos), fmt.Errorf("could not find token matching %s", rest)}
 		}
 	}
 
 	return tokens, nil
 }
 
+// popToken and peekToken return a token named EOF once there are no tokens left, so that a
+// file that stops partway through a rule is an error like any other.
 func (p *Parser) popToken() LexerToken {
-	token := p.tokens[0]
-	p.tokens = p.tokens[1:]
+	token := p.peekToken()
+
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+
+	p.last = token
 	return token
 }
 
 func (p *Parser) peekToken() LexerToken {
+	if len(p.tokens) == 0 {
+		return LexerToken{Name: "EOF", Pos: p.last.Pos + len(p.last.Contents)}
+	}
+
 	return p.tokens[0]
 }
 
+// atLineEnd reports whether the next token ends a line, which the end of the file does too.
+func (p *Parser) atLineEnd() bool {
+	name := p.peekToken().Name
+	return name == "Newline" || name == "EOF"
+}
+
+// loc resolves an offset into the file being read to a position.
+func (p *Parser) loc(pos int) common.StringPos {
+	if p.source == nil {
+		return common.StringPos{Pos: pos}
+	}
+
+	return p.source.Position(pos)
+}
+
+// errorAt turns an error found while reading the file into a GrammarError at the token that
+// was read last.
+func (p *Parser) errorAt(err error) error {
+	if _, isGrammarError := err.(GrammarError); isGrammarError {
+		return err
+	}
+
+	return GrammarError{p.loc(p.last.Pos), err}
+}
+
 func (p *Parser) parseRuleExpression() (common.Expression, error) {
 	name := p.popToken()
 
-	if name.Name != "Keyword" {
+	var params []string
+
+	switch name.Name {
+	case "Keyword":
+	case "Call":
+		var err error
+		name.Contents = strings.TrimSuffix(name.Contents, "(")
+		params, err = p.parseRuleParams()
+
+		if err != nil {
+			return common.Empty, fmt.Errorf("error when parsing parameters for rule %s: %v", name.Contents, err)
+		}
+	default:
 		return common.Empty, fmt.Errorf("rule name cannot be %s", name.Name)
 	}
 
+	var label string
+	labeled := p.atLabel()
+
+	if labeled {
+		var err error
+		label, err = p.parseLabel()
+
+		if err != nil {
+			return common.Empty, fmt.Errorf("error when parsing label for rule %s: %v", name.Contents, err)
+		}
+	}
+
 	sep := p.popToken()
 
 	if sep.Name != "Colon" {
@@ -179,7 +439,7 @@ func (p *Parser) parseRuleExpression() (common.Expression, error) {
 
 	var contents []common.Expression
 
-	for p.peekToken().Name != "Newline" {
+	for !p.atLineEnd() {
 		item, err := p.parseExpression()
 
 		if err != nil {
@@ -189,9 +449,65 @@ func (p *Parser) parseRuleExpression() (common.Expression, error) {
 		contents = append(contents, item)
 	}
 
+	// A rule's position is that of its name, and it ends where its line does
+	values := map[string]any{"name": name.Contents, "text": name.Contents, "contents": contents, "loc": p.loc(name.Pos), "end": p.loc(p.popToken().Pos)}
+
+	if params != nil {
+		values["params"] = params
+	}
+
+	if labeled {
+		values["label"] = label
+	}
+
+	return common.Expression{Definition: &Rule, Values: values}, nil
+}
+
+// atLabel reports whether the next tokens are a failure label, `@error("message")`. This
+// means that there can't be a primitive called error.
+func (p *Parser) atLabel() bool {
+	return len(p.tokens) > 1 && p.tokens[0].Name == "AtSign" && p.tokens[1].Name == "Call" && p.tokens[1].Contents == "error("
+}
+
+func (p *Parser) parseLabel() (string, error) {
+	p.popToken()
+	p.popToken()
+
+	if len(p.tokens) < 2 || p.tokens[0].Name != "String" || p.tokens[1].Name != "RightParenthesis" {
+		return "", errors.New("@error takes a single string")
+	}
+
+	message, err := strconv.Unquote(p.popToken().Contents)
 	p.popToken()
 
-	return common.Expression{Definition: &Rule, Values: map[string]any{"name": name.Contents, "contents": contents}}, nil
+	if err != nil {
+		return "", fmt.Errorf("invalid message for @error: %v", err)
+	}
+
+	return message, nil
+}
+
+func (p *Parser) parseRuleParams() ([]string, error) {
+	var params []string
+
+	for {
+		param := p.popToken()
+
+		if param.Name != "Keyword" {
+			return nil, fmt.Errorf("parameter name cannot be %s", param.Name)
+		}
+
+		params = append(params, param.Contents)
+
+		switch sep := p.popToken(); sep.Name {
+		case "Comma":
+			continue
+		case "RightParenthesis":
+			return params, nil
+		default:
+			return nil, fmt.Errorf("expected comma or closing parenthesis after parameter, found %s instead", sep.Name)
+		}
+	}
 }
 
 func (p *Parser) parseUnionExpression() (common.Expression, error) {
@@ -230,26 +546,220 @@ func (p *Parser) parseGroupExpression() (common.Expression, error) {
 	return common.Expression{Definition: &Group, Values: map[string]any{"groupItems": groupItems}}, nil
 }
 
+// parseCallArguments reads comma-separated arguments up to the closing parenthesis. An
+// argument made of several expressions is treated as a group.
+func (p *Parser) parseCallArguments() ([]common.Expression, error) {
+	var args []common.Expression
+	var argItems []common.Expression
+
+	for {
+		if len(p.tokens) == 0 {
+			return nil, errors.New("expected closing parenthesis after arguments")
+		}
+
+		switch p.peekToken().Name {
+		case "Comma", "RightParenthesis":
+			if len(argItems) == 0 {
+				return nil, errors.New("arguments cannot be empty")
+			}
+
+			if len(argItems) == 1 {
+				args = append(args, argItems[0])
+			} else {
+				args = append(args, common.Expression{Definition: &Group, Values: map[string]any{"groupItems": argItems}})
+			}
+
+			argItems = nil
+
+			if p.popToken().Name == "RightParenthesis" {
+				return args, nil
+			}
+		default:
+			argItem, err := p.parseExpression()
+
+			if err != nil {
+				return nil, err
+			}
+
+			argItems = append(argItems, argItem)
+		}
+	}
+}
+
+func (p *Parser) parseCallExpression(name string) (common.Expression, error) {
+	args, err := p.parseCallArguments()
+
+	if err != nil {
+		return common.Empty, fmt.Errorf("error when parsing arguments for %s: %v", name, err)
+	}
+
+	switch name {
+	case "sep":
+		if len(args) < 2 {
+			return common.Empty, fmt.Errorf("sep takes an item and a separator, found %d arguments", len(args))
+		}
+
+		trailing, nonEmpty := false, false
+
+		for _, arg := range args[2:] {
+			option, _ := arg.Values["ref"].(string)
+
+			switch {
+			case arg.Definition == &RuleRef && option == "trailing":
+				trailing = true
+			case arg.Definition == &RuleRef && option == "nonempty":
+				nonEmpty = true
+			default:
+				return common.Empty, fmt.Errorf("unknown option %s for sep, expected trailing or nonempty", arg)
+			}
+		}
+
+		return newSeparated(args[0], args[1], trailing, nonEmpty), nil
+	case "embed":
+		if len(args) != 2 || args[0].Definition != &RuleRef {
+			return common.Empty, errors.New("embed takes the name of an embedded grammar and an expression")
+		}
+
+		return common.Expression{Definition: &Embedded, Values: map[string]any{"grammar": args[0].Values["ref"], "expr": args[1]}}, nil
+	}
+
+	// Anything else is an instantiation of a rule template, which can only be resolved once
+	// the whole file has been read.
+	return common.Expression{Definition: &MacroCall, Values: map[string]any{"name": name, "args": args}}, nil
+}
+
+// callable reports whether name followed by a parenthesis is a call. Only builtins and
+// rule templates are, and any other name followed by a parenthesis is a reference to a rule
+// followed by a group, the way it was before there were calls. Namespaced names can only be
+// calls, since they only exist in grammars that came after calls did.
+func (p *Parser) callable(name string) bool {
+	return name == "sep" || name == "embed" || strings.Contains(name, ".") || p.templates[name]
+}
+
+// splitCall turns a Call token back into the name it starts with, and puts the
+// parenthesis after the name back in front of the remaining tokens.
+func (p *Parser) splitCall(token LexerToken) LexerToken {
+	name := strings.TrimSuffix(token.Contents, "(")
+	p.tokens = slices.Insert(p.tokens, 0, LexerToken{Name: "LeftParenthesis", Contents: "(", Pos: token.Pos + len(name)})
+
+	return LexerToken{Name: "Keyword", Contents: name, Pos: token.Pos}
+}
+
+// scanTemplates finds the rule templates that can be called from the file, before any of
+// it is read, since templates can be called before they are declared. A declaration is a
+// name with a parenthesis, parameters, and a colon after them.
+func (p *Parser) scanTemplates() error {
+	if p.templates == nil {
+		p.templates = map[string]bool{}
+	}
+
+	for i, token := range p.tokens {
+		switch {
+		case token.Name == "Call":
+			j := i + 1
+
+			for j < len(p.tokens) && (p.tokens[j].Name == "Keyword" || p.tokens[j].Name == "Comma") {
+				j++
+			}
+
+			// A template declaration can have a failure label between its parameters and the colon
+			if j+1 < len(p.tokens) && p.tokens[j].Name == "RightParenthesis" && (p.tokens[j+1].Name == "Colon" || p.tokens[j+1].Name == "AtSign") {
+				p.templates[strings.TrimSuffix(token.Contents, "(")] = true
+			}
+		case p.importedTemplates != nil && token.Name == "Keyword" && (token.Contents == "import" || token.Contents == "extend") && p.startsLine(i):
+			if i+1 >= len(p.tokens) || p.tokens[i+1].Name != "String" {
+				continue
+			}
+
+			// The templates of namespaced imports are called with their namespace
+			if i+2 < len(p.tokens) && p.tokens[i+2].Name == "Keyword" && p.tokens[i+2].Contents == "as" {
+				continue
+			}
+
+			path := p.tokens[i+1].Contents
+			names, err := p.importedTemplates(path[1 : len(path)-1])
+
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				p.templates[name] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// startsLine reports whether the token at i is the first thing on its line.
+func (p *Parser) startsLine(i int) bool {
+	return i == 0 || p.tokens[i-1].Name == "Newline"
+}
+
+// templateNames returns the names of the rule templates among rules.
+func templateNames(rules []common.Expression) []string {
+	var names []string
+
+	for _, rule := range rules {
+		if _, isTemplate := rule.Values["params"]; isTemplate {
+			names = append(names, rule.Values["name"].(string))
+		}
+	}
+
+	return names
+}
+
+func newSeparated(item, separator common.Expression, trailing, nonEmpty bool) common.Expression {
+	values := map[string]any{"item": item, "separator": separator, "trailing": trailing, "nonEmpty": nonEmpty}
+	return common.Expression{Definition: &Separated, Values: values}
+}
+
 func (p *Parser) parseExpression() (common.Expression, error) {
 	var expr common.Expression
 	var err error
 
 	token := p.popToken()
 
+	if token.Name == "Call" && !p.callable(strings.TrimSuffix(token.Contents, "(")) {
+		token = p.splitCall(token)
+	}
+
 	switch token.Name {
 	case "LeftParenthesis":
 		expr, err = p.parseGroupExpression()
 	case "LeftAngleBracket":
 		expr, err = p.parseUnionExpression()
+	case "Call":
+		expr, err = p.parseCallExpression(strings.TrimSuffix(token.Contents, "("))
+
+		if err == nil && expr.Definition == &MacroCall {
+			expr.Values["loc"] = p.loc(token.Pos)
+		}
 	case "Keyword":
-		expr = common.Expression{Definition: &RuleRef, Values: map[string]any{"ref": token.Contents}}
+		if builtin, found := builtinExpressions[token.Contents]; found {
+			expr = common.Expression{Definition: builtin, Values: map[string]any{}}
+		} else {
+			expr = common.Expression{Definition: &RuleRef, Values: map[string]any{"ref": token.Contents, "text": token.Contents, "loc": p.loc(token.Pos)}}
+		}
+	case "AtSign":
+		expr, err = p.parsePrimitiveExpression()
+	case "Capture":
+		var captured common.Expression
+		captured, err = p.parseExpression()
+		expr = common.Expression{Definition: &Capture, Values: map[string]any{"name": strings.TrimSuffix(token.Contents, "="), "expr": captured}}
+	case "BackReference":
+		expr = common.Expression{Definition: &BackReference, Values: map[string]any{"name": token.Contents[1:]}}
+	case "Predicate":
+		name := strings.TrimSpace(token.Contents[2 : len(token.Contents)-1])
+		expr = common.Expression{Definition: &SemanticPredicate, Values: map[string]any{"name": name}}
 	case "String":
 		val := token.Contents[1 : len(token.Contents)-1]
 		expr = common.Expression{Definition: &StringLiteral, Values: map[string]any{"val": val}}
 	case "RegularExpression":
 		var val *regexp.Regexp
-		val, err = regexp.Compile(`\s*(` + token.Contents[1:len(token.Contents)-1] + ")")
-		expr = common.Expression{Definition: &RegularExpression, Values: map[string]any{"val": val}}
+		val, err = regexp.Compile(`^\s*(` + token.Contents[1:len(token.Contents)-1] + ")")
+		expr = common.Expression{Definition: &RegularExpression, Values: map[string]any{"val": val, "source": token.Contents[1 : len(token.Contents)-1]}}
 	default:
 		return common.Empty, fmt.Errorf("unexpected token of type %s", token.Name)
 	}
@@ -281,6 +791,15 @@ func (p *Parser) parseExpression() (common.Expression, error) {
 		}
 
 		expr = common.Expression{Definition: &ExclusiveOr, Values: map[string]any{"lhs": expr, "rhs": rhs}}
+	case "Percent":
+		p.popToken()
+		separator, err := p.parseExpression()
+
+		if err != nil {
+			return common.Empty, err
+		}
+
+		expr = newSeparated(expr, separator, false, false)
 	}
 
 	// Postfix operators
@@ -297,15 +816,152 @@ func (p *Parser) parseExpression() (common.Expression, error) {
 	case "QuestionMark":
 		p.popToken()
 		expr = common.Expression{Definition: &ZeroOrOne, Values: map[string]any{"expr": expr}}
+	case "Repeat":
+		p.popToken()
+		minCount, maxCount, err := parseRepeatBounds(postfixToken.Contents)
+
+		if err != nil {
+			return common.Empty, err
+		}
+
+		expr = common.Expression{Definition: &Repeat, Values: map[string]any{"expr": expr, "min": minCount, "max": maxCount}}
+	}
+
+	// Failure labels
+
+	if p.atLabel() {
+		message, err := p.parseLabel()
+
+		if err != nil {
+			return common.Empty, err
+		}
+
+		expr = common.Expression{Definition: &Labeled, Values: map[string]any{"expr": expr, "message": message}}
 	}
 
 	return expr, nil
 }
 
+// parseRepeatBounds reads the bounds out of a repetition count, which is one of `{n}`,
+// `{n,}` or `{n,m}`. An open upper bound is returned as -1.
+func parseRepeatBounds(contents string) (int, int, error) {
+	bounds := strings.Split(contents[1:len(contents)-1], ",")
+	minCount, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(bounds) == 1 {
+		return minCount, minCount, nil
+	}
+
+	upper := strings.TrimSpace(bounds[1])
+
+	if upper == "" {
+		return minCount, -1, nil
+	}
+
+	maxCount, err := strconv.Atoi(upper)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if maxCount < minCount {
+		return 0, 0, fmt.Errorf("repetition count %s has a maximum below its minimum", contents)
+	}
+
+	return minCount, maxCount, nil
+}
+
+// atDirective reports whether the next tokens are a file-level directive such as
+// `import "path"`, as opposed to a rule that happens to have the same name.
+func (p *Parser) atDirective(keyword string) bool {
+	return len(p.tokens) > 1 && p.tokens[0].Name == "Keyword" && p.tokens[0].Contents == keyword && p.tokens[1].Name == "String"
+}
+
+func (p *Parser) parseDirectiveEnd(path LexerToken) error {
+	if len(p.tokens) > 0 {
+		if end := p.popToken(); end.Name != "Newline" {
+			return fmt.Errorf("expected newline after %s, found %s instead", path.Contents, end.Name)
+		}
+	}
+
+	return nil
+}
+
+func (p *Parser) parseExtendExpression() (common.Expression, error) {
+	p.popToken()
+	path := p.popToken()
+
+	if err := p.parseDirectiveEnd(path); err != nil {
+		return common.Empty, err
+	}
+
+	return common.Expression{Definition: &Extend, Values: map[string]any{"path": path.Contents[1 : len(path.Contents)-1]}}, nil
+}
+
+func (p *Parser) parseImportExpression() (common.Expression, error) {
+	p.popToken()
+	path := p.popToken()
+	values := map[string]any{"path": path.Contents[1 : len(path.Contents)-1]}
+
+	if len(p.tokens) > 1 && p.peekToken().Name == "Keyword" && p.peekToken().Contents == "as" {
+		p.popToken()
+		namespace := p.popToken()
+
+		if namespace.Name != "Keyword" {
+			return common.Empty, fmt.Errorf("namespace for import %s cannot be %s", path.Contents, namespace.Name)
+		}
+
+		values["namespace"] = namespace.Contents
+	}
+
+	if err := p.parseDirectiveEnd(path); err != nil {
+		return common.Empty, err
+	}
+
+	return common.Expression{Definition: &Import, Values: values}, nil
+}
+
 func (p *Parser) parseFileExpression() (common.Expression, error) {
+	var extends *common.Expression
+	var imports []common.Expression
 	var rules []common.Expression
 
 	for len(p.tokens) > 0 {
+		if p.peekToken().Name == "Newline" {
+			p.popToken()
+			continue
+		}
+
+		if p.atDirective("extend") {
+			if extends != nil {
+				return common.Empty, errors.New("a grammar can only extend one other grammar")
+			}
+
+			ext, err := p.parseExtendExpression()
+
+			if err != nil {
+				return common.Empty, err
+			}
+
+			extends = &ext
+			continue
+		}
+
+		if p.atDirective("import") {
+			imp, err := p.parseImportExpression()
+
+			if err != nil {
+				return common.Empty, err
+			}
+
+			imports = append(imports, imp)
+			continue
+		}
+
 		rule, err := p.parseRuleExpression()
 
 		if err != nil {
@@ -315,30 +971,150 @@ func (p *Parser) parseFileExpression() (common.Expression, error) {
 		rules = append(rules, rule)
 	}
 
-	return common.Expression{Definition: &File, Values: map[string]any{"rules": rules}}, nil
+	values := map[string]any{"rules": rules}
+
+	if extends != nil {
+		values["extends"] = *extends
+	}
+
+	if imports != nil {
+		values["imports"] = imports
+	}
+
+	return common.Expression{Definition: &File, Values: values}, nil
 }
 
-func ParseGrammar(contents string) (*Grammar, error) {
-	parser := Parser{}
+// ParseGrammarFile reads a single grammar file the way it is written, without loading what
+// it imports or extends and without expanding rule templates, and returns its File
+// expression. Rules, and the references to rules and templates in them, have a "loc"
+// value with their position, and rules an "end" value with the position of the end of
+// their line. Rules and references to rules also have a "text" value with their name as
+// it is written, which stays the same when loading a grammar prefixes it with a
+// namespace. It's meant for tools that work with grammar files, like editors.
+//
+// Since other files aren't loaded, calls to rule templates from imported or extended
+// files are read as a reference to a rule followed by a group.
+func ParseGrammarFile(name, contents string) (common.Expression, error) {
+	return parseGrammarFile(&Parser{source: common.NewSource(name, contents)}, contents)
+}
+
+// parseGrammarFile is ParseGrammarFile with a parser that may know about templates from
+// elsewhere.
+func parseGrammarFile(parser *Parser, contents string) (common.Expression, error) {
 	tokens, err := parser.Lex(contents)
 
 	if err != nil {
-		return nil, err
+		return common.Empty, err
 	}
 
 	parser.tokens = tokens
+
+	// Errors from loading an import already name the file they happened in
+	if err := parser.scanTemplates(); err != nil {
+		return common.Empty, err
+	}
+
 	fileExpr, err := parser.parseFileExpression()
 
+	if err != nil {
+		return common.Empty, parser.errorAt(err)
+	}
+
+	return fileExpr, nil
+}
+
+// ParseGrammar reads a grammar from a string. Grammars read this way can't import other
+// grammars, use ParseGrammarFS for that.
+func ParseGrammar(contents string) (*Grammar, error) {
+	loader := grammarLoader{}
+	fileExpr, err := loader.parse("", contents)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newGrammar(fileExpr)
+}
+
+// ParseGrammarFS reads the grammar file with the given name from fsys, along with every
+// grammar it imports. Import paths are relative to the file doing the importing.
+func ParseGrammarFS(fsys fs.FS, name string) (*Grammar, error) {
+	loader := grammarLoader{fsys: fsys, files: map[string]common.Expression{}}
+	fileExpr, err := loader.load(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newGrammar(fileExpr)
+}
+
+// Extend reads contents as a grammar that extends g. Rules in contents replace the rules in
+// g with the same name, and can refer to the rule they replaced as `super.name`.
+func (g Grammar) Extend(contents string) (*Grammar, error) {
+	loader := grammarLoader{inherited: templateNames(g.topLevelExpr.Values["rules"].([]common.Expression))}
+	fileExpr, err := loader.parse("", contents)
+
 	if err != nil {
 		return nil, err
 	}
 
+	rules, err := extendRules(g.topLevelExpr.Values["rules"].([]common.Expression), fileExpr.Values["rules"].([]common.Expression))
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileExpr.Values["rules"] = rules
+	grammar, err := newGrammar(fileExpr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	grammar.tabWidth = g.tabWidth
+	grammar.embedded = maps.Clone(g.embedded)
+	grammar.actions = maps.Clone(g.actions)
+	grammar.predicates = maps.Clone(g.predicates)
+
+	return grammar, nil
+}
+
+func newGrammar(fileExpr common.Expression) (*Grammar, error) {
 	rules := fileExpr.Values["rules"].([]common.Expression)
 	globals := map[string]any{}
+	templates := map[string]common.Expression{}
 
 	for _, rule := range rules {
-		globals[rule.Values["name"].(string)] = rule.Values["contents"].([]common.Expression)
+		if _, isTemplate := rule.Values["params"]; isTemplate {
+			templates[rule.Values["name"].(string)] = rule
+		} else {
+			globals[rule.Values["name"].(string)] = rule.Values["contents"].([]common.Expression)
+
+			if label, labeled := rule.Values["label"].(string); labeled {
+				globals[labelKey(rule.Values["name"].(string))] = label
+			}
+		}
 	}
 
-	return &Grammar{fileExpr, globals}, nil
+	expander := macroExpander{templates: templates, globals: globals}
+
+	for i, rule := range rules {
+		if _, isTemplate := rule.Values["params"]; isTemplate {
+			continue
+		}
+
+		expanded, err := expander.expand(rule)
+
+		if err != nil {
+			return nil, fmt.Errorf("error when expanding rule %s: %v", rule.Values["name"], err)
+		}
+
+		rules[i] = expanded
+		globals[expanded.Values["name"].(string)] = expanded.Values["contents"].([]common.Expression)
+	}
+
+	fileExpr.Values["rules"] = append(rules, expander.instances...)
+
+	return &Grammar{topLevelExpr: fileExpr, rules: globals}, nil
 }
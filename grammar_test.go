@@ -0,0 +1,297 @@
+package parsley
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+func TestRuleFollowedByGroup(t *testing.T) {
+	runParseCases(t, []parseCase{
+		{
+			name:    "rule followed by a group",
+			grammar: "input: name(\",\" name)*\nname: /[a-z]+/\n",
+			input:   "a,b",
+			want:    "input<[name<[String<a>]>, [[name<[String<b>]>]]]>",
+		},
+		{
+			name:    "sep is still a call",
+			grammar: "input: sep(name, \",\")\nname: /[a-z]+/\n",
+			input:   "a,b",
+			want:    "input<[[name<[String<a>]>, name<[String<b>]>]]>",
+		},
+		{
+			name:    "template declared after its call",
+			grammar: "input: pair(name)\npair(x): x \",\" x\nname: /[a-z]+/\n",
+			input:   "a,b",
+			want:    "input<[pair(name)<[name<[String<a>]>, name<[String<b>]>]>]>",
+		},
+	})
+}
+
+func TestGrammarWithoutTrailingNewline(t *testing.T) {
+	runParseCases(t, []parseCase{
+		{name: "rule", grammar: "input: name*\nname: /[a-z]+/", input: "a b", want: "input<[[name<[String<a>]>, name<[String<b>]>]]>"},
+		{name: "comment", grammar: "input: name*\nname: /[a-z]+/\n# done", input: "a", want: "input<[[name<[String<a>]>]]>"},
+		{name: "comment after a rule", grammar: "input: /[a-z]+/ # letters", input: "ab", want: "input<[String<ab>]>"},
+		{name: "empty comment", grammar: "#\ninput: /[a-z]+/", input: "a", want: "input<[String<a>]>"},
+		{name: "file ends partway through a rule", grammar: "input: name\nname: (", wantErr: "unexpected token of type EOF"},
+		{name: "file ends before a colon", grammar: "input: name\nname", wantErr: "expected colon after rule name, found EOF instead"},
+	})
+}
+
+func TestParseContextLimits(t *testing.T) {
+	grammar, err := ParseGrammar("input: word*\nword: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := strings.Repeat("a ", 2000)
+
+	if _, err := grammar.ParseContext(context.Background(), input, ParseOptions{MaxDepth: 10, MaxSteps: 100_000, MaxInputSize: len(input)}); err != nil {
+		t.Errorf("unexpected error within the limits: %v", err)
+	}
+
+	var depthErr common.DepthLimitError
+
+	if _, err := grammar.ParseWithOptions(input, ParseOptions{MaxDepth: 2}); !errors.As(err, &depthErr) || depthErr.Max != 2 {
+		t.Errorf("got error %v, want a DepthLimitError", err)
+	}
+
+	var stepErr common.StepLimitError
+
+	if _, err := grammar.ParseWithOptions(input, ParseOptions{MaxSteps: 100}); !errors.As(err, &stepErr) || stepErr.Max != 100 {
+		t.Errorf("got error %v, want a StepLimitError", err)
+	}
+
+	var sizeErr common.InputSizeError
+
+	if _, err := grammar.ParseWithOptions(input, ParseOptions{MaxInputSize: 10}); !errors.As(err, &sizeErr) || sizeErr.Size != len(input) {
+		t.Errorf("got error %v, want an InputSizeError", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := grammar.ParseContext(ctx, input, ParseOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
+
+// minLimit returns the smallest limit that parse succeeds with.
+func minLimit(t *testing.T, parse func(limit int) error) int {
+	t.Helper()
+
+	for limit := 1; limit < 10_000; limit++ {
+		if parse(limit) == nil {
+			return limit
+		}
+	}
+
+	t.Fatal("parse didn't succeed with any limit")
+	return 0
+}
+
+func TestEmbeddedLimits(t *testing.T) {
+	embedded, err := ParseGrammar("input: expr\nexpr: \"(\" expr? \")\"\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grammar, err := ParseGrammar("input: \"[\" embed(parens, /[()]*/) \"]\"\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grammar.Embed("parens", embedded)
+
+	parens := strings.Repeat("(", 20) + strings.Repeat(")", 20)
+	input := "[" + parens + "]"
+
+	// Limits that are just enough for the embedded text on its own aren't enough once the
+	// parse around it counts too
+	maxDepth := minLimit(t, func(limit int) error {
+		_, err := embedded.ParseWithOptions(parens, ParseOptions{MaxDepth: limit})
+		return err
+	})
+
+	var depthErr common.DepthLimitError
+
+	if _, err := grammar.ParseWithOptions(input, ParseOptions{MaxDepth: maxDepth}); !errors.As(err, &depthErr) {
+		t.Errorf("got error %v, want a DepthLimitError", err)
+	}
+
+	maxSteps := minLimit(t, func(limit int) error {
+		_, err := embedded.ParseWithOptions(parens, ParseOptions{MaxSteps: limit})
+		return err
+	})
+
+	var stepErr common.StepLimitError
+
+	if _, err := grammar.ParseWithOptions(input, ParseOptions{MaxSteps: maxSteps}); !errors.As(err, &stepErr) {
+		t.Errorf("got error %v, want a StepLimitError", err)
+	}
+}
+
+func TestLeftRecursion(t *testing.T) {
+	grammar, err := ParseGrammar("input: expr\nexpr: <(expr \"+\" number) number>\nnumber: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var depthErr common.DepthLimitError
+
+	if _, err := grammar.Parse("1+2"); !errors.As(err, &depthErr) || depthErr.Max != common.DefaultMaxDepth {
+		t.Errorf("got error %v, want a DepthLimitError", err)
+	}
+}
+
+// BenchmarkParseFlim parses 500 copies of the flim example, about 300KB.
+func BenchmarkParseFlim(b *testing.B) {
+	grammarContents, err := os.ReadFile("example/flim.parsley")
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	demo, err := os.ReadFile("example/demo.flim")
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	grammar, err := ParseGrammar(string(grammarContents))
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	input := strings.Repeat(string(demo)+"\n", 500)
+
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+
+	for range b.N {
+		if _, err := grammar.Parse(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseLongLine parses a single line of 120KB with characters wider than a byte,
+// whose columns have to be counted by the rune.
+func BenchmarkParseLongLine(b *testing.B) {
+	grammar, err := ParseGrammar("input: word*\nword: /[^ ]+/\n")
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	input := strings.Repeat("é ", 40_000)
+
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+
+	for range b.N {
+		if _, err := grammar.Parse(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	grammar, err := ParseGrammar("input: name*\nname: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = grammar.ParseSource(common.NewSource("words.txt", "ab\ncd 12"))
+
+	if err == nil || err.Error() != "words.txt:2:4: unknown token" {
+		t.Errorf("got error %v", err)
+	}
+
+	_, err = grammar.Parse("ab\ncd 12")
+
+	if err == nil || err.Error() != "2:4: unknown token" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestParseGrammarFile(t *testing.T) {
+	fileExpr, err := ParseGrammarFile("main.parsley", "import \"lexer.parsley\"\ninput: list(word)\n\nlist(x): x (\",\" x)*\nword: name\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+
+	for _, rule := range fileExpr.Values["rules"].([]common.Expression) {
+		got = append(got, fmt.Sprintf("%s %s-%s", rule.Values["name"], rule.Values["loc"], rule.Values["end"]))
+
+		walkExpression(rule, func(expr common.Expression) {
+			switch expr.Definition {
+			case &RuleRef:
+				got = append(got, fmt.Sprintf("\t%s %s", expr.Values["ref"], expr.Values["loc"]))
+			case &MacroCall:
+				got = append(got, fmt.Sprintf("\t%s() %s", expr.Values["name"], expr.Values["loc"]))
+			}
+		})
+	}
+
+	// Imports aren't loaded, and templates aren't expanded
+	want := []string{
+		"input main.parsley:2:1-main.parsley:2:18",
+		"\tlist() main.parsley:2:8",
+		"\tword main.parsley:2:13",
+		"list main.parsley:4:1-main.parsley:4:20",
+		"\tx main.parsley:4:10",
+		"\tx main.parsley:4:17",
+		"word main.parsley:5:1-main.parsley:5:11",
+		"\tname main.parsley:5:7",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGrammarErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"token that doesn't lex", "input: name\nname: $\n", "bad.parsley:2:7: could not find token matching $"},
+		{"unclosed group", "input: name\nname: (\"a\"\n", "bad.parsley:2:11: error when parsing contents for rule name: unexpected token of type Newline"},
+		{"file ends partway through a rule", "input: name\nname: (", "bad.parsley:2:8: error when parsing contents for rule name: unexpected token of type EOF"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseGrammarFile("bad.parsley", tc.contents)
+
+			var grammarErr GrammarError
+
+			if !errors.As(err, &grammarErr) || err.Error() != tc.want {
+				t.Errorf("got error %v, want a GrammarError %q", err, tc.want)
+			}
+		})
+	}
+
+	// Grammars that aren't read from a file don't have a name
+	if _, err := ParseGrammar("input: name\nname: $\n"); err == nil || err.Error() != "<grammar>:2:7: could not find token matching $" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package parsley
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// grammarLoader reads grammar files and flattens their imports into a single File, with
+// the rules of namespaced imports renamed to `namespace.rule`.
+type grammarLoader struct {
+	fsys    fs.FS
+	loading []string
+	files   map[string]common.Expression
+
+	// inherited are the templates of a grammar that the file being loaded extends without
+	// going through fsys, see Grammar.Extend.
+	inherited []string
+}
+
+func (l *grammarLoader) load(name string) (common.Expression, error) {
+	if i := slices.Index(l.loading, name); i >= 0 {
+		cycle := append(slices.Clone(l.loading[i:]), name)
+		return common.Empty, fmt.Errorf("%s: import cycle: %s", l.loading[len(l.loading)-1], strings.Join(cycle, " -> "))
+	}
+
+	if fileExpr, found := l.files[name]; found {
+		return fileExpr, nil
+	}
+
+	contents, err := fs.ReadFile(l.fsys, name)
+
+	if err != nil {
+		return common.Empty, err
+	}
+
+	l.loading = append(l.loading, name)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+	fileExpr, err := l.parse(name, string(contents))
+
+	if err != nil {
+		return common.Empty, err
+	}
+
+	l.files[name] = fileExpr
+
+	return fileExpr, nil
+}
+
+func (l *grammarLoader) parse(name, contents string) (common.Expression, error) {
+	parser := Parser{source: common.NewSource(name, contents), templates: map[string]bool{}}
+
+	for _, template := range l.inherited {
+		parser.templates[template] = true
+	}
+
+	parser.importedTemplates = func(importPath string) ([]string, error) {
+		return l.templateNames(path.Join(path.Dir(name), importPath))
+	}
+
+	fileExpr, err := parseGrammarFile(&parser, contents)
+
+	if err != nil {
+		return common.Empty, err
+	}
+
+	var parentRules []common.Expression
+
+	if extends, ok := fileExpr.Values["extends"].(common.Expression); ok {
+		if l.fsys == nil {
+			return common.Empty, fileError(name, fmt.Errorf("can't extend %s without a file system, use ParseGrammarFS or Grammar.Extend", extends.Values["path"]))
+		}
+
+		parentExpr, err := l.load(path.Join(path.Dir(name), extends.Values["path"].(string)))
+
+		if err != nil {
+			return common.Empty, err
+		}
+
+		parentRules = parentExpr.Values["rules"].([]common.Expression)
+	}
+
+	var rules []common.Expression
+	origins := map[string]string{}
+
+	addRule := func(rule common.Expression) error {
+		ruleName := rule.Values["name"].(string)
+		file := rule.Values["file"].(string)
+
+		if origin, found := origins[ruleName]; found {
+			// The same file can be imported along more than one path
+			if origin == file {
+				return nil
+			}
+
+			return fmt.Errorf("rule %s from %s is already defined in %s", ruleName, displayName(file), displayName(origin))
+		}
+
+		origins[ruleName] = file
+		rules = append(rules, rule)
+		return nil
+	}
+
+	imports, _ := fileExpr.Values["imports"].([]common.Expression)
+
+	for _, imp := range imports {
+		if l.fsys == nil {
+			return common.Empty, fileError(name, fmt.Errorf("can't import %s without a file system, use ParseGrammarFS", imp.Values["path"]))
+		}
+
+		importedExpr, err := l.load(path.Join(path.Dir(name), imp.Values["path"].(string)))
+
+		if err != nil {
+			return common.Empty, err
+		}
+
+		importedRules := importedExpr.Values["rules"].([]common.Expression)
+
+		if namespace, ok := imp.Values["namespace"].(string); ok {
+			importedRules, err = namespaceRules(importedRules, namespace)
+
+			if err != nil {
+				return common.Empty, fileError(name, err)
+			}
+		}
+
+		for _, rule := range importedRules {
+			if err := addRule(rule); err != nil {
+				return common.Empty, fileError(name, err)
+			}
+		}
+	}
+
+	for _, rule := range fileExpr.Values["rules"].([]common.Expression) {
+		rule.Values["file"] = name
+
+		if err := addRule(rule); err != nil {
+			return common.Empty, fileError(name, err)
+		}
+	}
+
+	if parentRules != nil {
+		rules, err = extendRules(parentRules, rules)
+
+		if err != nil {
+			return common.Empty, fileError(name, err)
+		}
+	}
+
+	fileExpr.Values["rules"] = rules
+
+	return fileExpr, nil
+}
+
+// templateNames returns the names of the rule templates that the file with the given name
+// declares, imports or extends, so that calls to them can be told apart from a rule followed by a
+// group.
+func (l *grammarLoader) templateNames(name string) ([]string, error) {
+	if l.fsys == nil {
+		return nil, nil
+	}
+
+	fileExpr, err := l.load(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return templateNames(fileExpr.Values["rules"].([]common.Expression)), nil
+}
+
+// extendRules adds rules on top of the rules of a parent grammar. Overriding a rule keeps
+// the parent's version around as `super.name`, which pushes any older versions back to
+// `super.super.name` and so on. References to the plain name always resolve to the newest
+// version, including the ones in the parent's rules.
+func extendRules(parentRules, rules []common.Expression) ([]common.Expression, error) {
+	extended := slices.Clone(parentRules)
+
+	for _, rule := range rules {
+		ruleName := rule.Values["name"].(string)
+		overrides := slices.ContainsFunc(extended, func(parentRule common.Expression) bool {
+			return parentRule.Values["name"] == ruleName
+		})
+
+		if overrides {
+			var err error
+			extended, err = shiftSuper(extended, ruleName)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		extended = append(extended, rule)
+	}
+
+	names := map[string]bool{}
+
+	for _, rule := range extended {
+		names[rule.Values["name"].(string)] = true
+	}
+
+	for _, rule := range rules {
+		_, err := rewriteExpression(rule, func(expr common.Expression) (common.Expression, bool, error) {
+			var ref string
+
+			switch expr.Definition {
+			case &RuleRef:
+				ref = expr.Values["ref"].(string)
+			case &MacroCall:
+				ref = expr.Values["name"].(string)
+			}
+
+			if strings.HasPrefix(ref, "super.") && !names[ref] {
+				return expr, true, fmt.Errorf("rule %s refers to %s, but there is no parent rule to refer to", rule.Values["name"], ref)
+			}
+
+			return expr, false, nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return extended, nil
+}
+
+// shiftSuper renames the rule with the given name to `super.name`, and moves everything
+// that was already a super version of it back by one more `super.`.
+func shiftSuper(rules []common.Expression, name string) ([]common.Expression, error) {
+	isSuper := func(ref string) bool {
+		for strings.HasPrefix(ref, "super.") {
+			ref = strings.TrimPrefix(ref, "super.")
+
+			if ref == name {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	shifted := make([]common.Expression, len(rules))
+
+	var shift func(expr common.Expression) (common.Expression, bool, error)
+
+	shift = func(expr common.Expression) (common.Expression, bool, error) {
+		switch expr.Definition {
+		case &RuleRef:
+			if ref := expr.Values["ref"].(string); isSuper(ref) {
+				// Where the reference is and how it is written stay the same
+				values := maps.Clone(expr.Values)
+				values["ref"] = "super." + ref
+
+				return common.Expression{Definition: &RuleRef, Values: values}, true, nil
+			}
+		case &MacroCall:
+			if callName := expr.Values["name"].(string); isSuper(callName) {
+				args, err := rewriteExpressions(expr.Values["args"].([]common.Expression), shift)
+				values := maps.Clone(expr.Values)
+				values["name"] = "super." + callName
+				values["args"] = args
+
+				return common.Expression{Definition: &MacroCall, Values: values}, true, err
+			}
+		}
+
+		return expr, false, nil
+	}
+
+	for i, rule := range rules {
+		renamed, err := rewriteExpression(rule, shift)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ruleName := rule.Values["name"].(string); ruleName == name || isSuper(ruleName) {
+			renamed.Values["name"] = "super." + ruleName
+		}
+
+		shifted[i] = renamed
+	}
+
+	return shifted, nil
+}
+
+// namespaceRules prefixes the names of rules, and every reference between them, with the
+// given namespace.
+func namespaceRules(rules []common.Expression, namespace string) ([]common.Expression, error) {
+	namespaced := make([]common.Expression, len(rules))
+
+	for i, rule := range rules {
+		params, _ := rule.Values["params"].([]string)
+
+		var prefix func(expr common.Expression) (common.Expression, bool, error)
+
+		prefix = func(expr common.Expression) (common.Expression, bool, error) {
+			switch expr.Definition {
+			case &RuleRef:
+				ref := expr.Values["ref"].(string)
+
+				if slices.Contains(params, ref) {
+					return expr, true, nil
+				}
+
+				// Where the reference is and how it is written stay the same
+				values := maps.Clone(expr.Values)
+				values["ref"] = namespace + "." + ref
+
+				return common.Expression{Definition: &RuleRef, Values: values}, true, nil
+			case &MacroCall:
+				args, err := rewriteExpressions(expr.Values["args"].([]common.Expression), prefix)
+				values := maps.Clone(expr.Values)
+				values["name"] = namespace + "." + expr.Values["name"].(string)
+				values["args"] = args
+
+				return common.Expression{Definition: &MacroCall, Values: values}, true, err
+			}
+
+			return expr, false, nil
+		}
+
+		renamed, err := rewriteExpression(rule, prefix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		renamed.Values["name"] = namespace + "." + rule.Values["name"].(string)
+		namespaced[i] = renamed
+	}
+
+	return namespaced, nil
+}
+
+func displayName(file string) string {
+	if file == "" {
+		return "<grammar>"
+	}
+
+	return file
+}
+
+func fileError(name string, err error) error {
+	return fmt.Errorf("%s: %w", displayName(name), err)
+}
@@ -0,0 +1,341 @@
+package parsley
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+func TestImports(t *testing.T) {
+	lexer := "name: /[a-z]+/\nnumber: /[0-9]+/\nlist(x): x (\",\" x)*\n"
+
+	cases := []struct {
+		name    string
+		files   fstest.MapFS
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "import",
+			files: fstest.MapFS{
+				"main.parsley":  {Data: []byte("import \"lexer.parsley\"\ninput: name number\n")},
+				"lexer.parsley": {Data: []byte(lexer)},
+			},
+			input: "a 1",
+			want:  "input<[name<[String<a>]>, number<[String<1>]>]>",
+		},
+		{
+			name: "namespaced import",
+			files: fstest.MapFS{
+				"main.parsley":  {Data: []byte("import \"lexer.parsley\" as lex\ninput: lex.name name\nname: /[0-9]+/\n")},
+				"lexer.parsley": {Data: []byte(lexer)},
+			},
+			input: "a 1",
+			want:  "input<[lex.name<[String<a>]>, name<[String<1>]>]>",
+		},
+		{
+			name: "path relative to the importing file",
+			files: fstest.MapFS{
+				"main.parsley":        {Data: []byte("import \"lib/words.parsley\"\ninput: word\n")},
+				"lib/words.parsley":   {Data: []byte("import \"letters.parsley\"\nword: letter+\n")},
+				"lib/letters.parsley": {Data: []byte("letter: /[a-z]/\n")},
+			},
+			input: "ab",
+			want:  "input<[word<[[letter<[String<a>]>, letter<[String<b>]>]]>]>",
+		},
+		{
+			name: "imported template",
+			files: fstest.MapFS{
+				"main.parsley":  {Data: []byte("import \"lexer.parsley\"\ninput: list(name)\n")},
+				"lexer.parsley": {Data: []byte(lexer)},
+			},
+			input: "a,b",
+			want:  "input<[list(name)<[name<[String<a>]>, [[name<[String<b>]>]]]>]>",
+		},
+		{
+			name: "namespaced template",
+			files: fstest.MapFS{
+				"main.parsley":  {Data: []byte("import \"lexer.parsley\" as lex\ninput: lex.list(lex.number)\n")},
+				"lexer.parsley": {Data: []byte(lexer)},
+			},
+			input: "1,2",
+			want:  "input<[lex.list(lex.number)<[lex.number<[String<1>]>, [[lex.number<[String<2>]>]]]>]>",
+		},
+		{
+			name: "back-references in a namespaced import",
+			files: fstest.MapFS{
+				"main.parsley": {Data: []byte("import \"tags.parsley\" as tags\ninput: tags.element\n")},
+				"tags.parsley": {Data: []byte("element: \"<\" tag=name \">\" =tag\nname: /[a-z]+/\n")},
+			},
+			input: "<a>a",
+			want:  "input<[tags.element<[tags.name<[String<a>]>]>]>",
+		},
+		{
+			name: "same file imported twice",
+			files: fstest.MapFS{
+				"main.parsley":  {Data: []byte("import \"a.parsley\"\nimport \"lexer.parsley\"\ninput: pair\n")},
+				"a.parsley":     {Data: []byte("import \"lexer.parsley\"\npair: name number\n")},
+				"lexer.parsley": {Data: []byte(lexer)},
+			},
+			input: "a 1",
+			want:  "input<[pair<[name<[String<a>]>, number<[String<1>]>]>]>",
+		},
+		{
+			name: "import cycle",
+			files: fstest.MapFS{
+				"main.parsley": {Data: []byte("import \"a.parsley\"\ninput: a\n")},
+				"a.parsley":    {Data: []byte("import \"b.parsley\"\na: b\n")},
+				"b.parsley":    {Data: []byte("import \"a.parsley\"\nb: \"b\"\n")},
+			},
+			wantErr: "b.parsley: import cycle: a.parsley -> b.parsley -> a.parsley",
+		},
+		{
+			name: "rule defined twice",
+			files: fstest.MapFS{
+				"main.parsley":  {Data: []byte("import \"lexer.parsley\"\ninput: name\nname: /[A-Z]+/\n")},
+				"lexer.parsley": {Data: []byte(lexer)},
+			},
+			wantErr: "main.parsley: rule name from main.parsley is already defined in lexer.parsley",
+		},
+		{
+			name: "missing import",
+			files: fstest.MapFS{
+				"main.parsley": {Data: []byte("import \"missing.parsley\"\ninput: name\n")},
+			},
+			wantErr: "missing.parsley: file does not exist",
+		},
+		{
+			name: "error in an imported file",
+			files: fstest.MapFS{
+				"main.parsley":   {Data: []byte("import \"broken.parsley\" as b\ninput: b.name\n")},
+				"broken.parsley": {Data: []byte("name: /[a-z]+/ |\n")},
+			},
+			wantErr: "broken.parsley:1:17: ",
+		},
+		{
+			name: "namespace that isn't a name",
+			files: fstest.MapFS{
+				"main.parsley":  {Data: []byte("import \"lexer.parsley\" as \"lex\"\ninput: name\n")},
+				"lexer.parsley": {Data: []byte(lexer)},
+			},
+			wantErr: "main.parsley:1:27: namespace for import \"lexer.parsley\" cannot be String",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			grammar, err := ParseGrammarFS(c.files, "main.parsley")
+
+			if err == nil {
+				var got string
+				got, err = condensed(grammar, c.input)
+
+				if err == nil && got != c.want {
+					t.Errorf("got %s, want %s", got, c.want)
+				}
+			}
+
+			if c.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+				t.Fatalf("got error %v, want one containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestNamespacedImportKeepsPositions(t *testing.T) {
+	files := fstest.MapFS{
+		"main.parsley":  {Data: []byte("import \"lexer.parsley\" as lex\ninput: lex.word\n")},
+		"lexer.parsley": {Data: []byte("word: name+\nname: /[a-z]+/\n")},
+	}
+
+	grammar, err := ParseGrammarFS(files, "main.parsley")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+
+	// The reference is prefixed with the namespace, but is still where it was and written
+	// the way it was
+	for _, contents := range grammar.rules["lex.word"].([]common.Expression) {
+		walkExpression(contents, func(expr common.Expression) {
+			if expr.Definition != &RuleRef || expr.Values["ref"] != "lex.name" {
+				return
+			}
+
+			found = true
+			loc, _ := expr.Values["loc"].(common.StringPos)
+
+			if loc.File != "lexer.parsley" || loc.Line != 0 || loc.Col != 6 || expr.Values["text"] != "name" {
+				t.Errorf("got loc %+v and text %v", loc, expr.Values["text"])
+			}
+		})
+	}
+
+	if !found {
+		t.Error("no reference to lex.name")
+	}
+}
+
+func TestImportWithoutFS(t *testing.T) {
+	_, err := ParseGrammar("import \"lexer.parsley\"\ninput: name\n")
+
+	if err == nil || !strings.Contains(err.Error(), "can't import lexer.parsley without a file system") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	base := "input: item+\nitem: name\nname: /[a-z]+/\nlist(x): x (\",\" x)*\n"
+
+	cases := []struct {
+		name    string
+		files   fstest.MapFS
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "override",
+			files: fstest.MapFS{
+				"main.parsley": {Data: []byte("extend \"base.parsley\"\nname: /[A-Z]+/\n")},
+				"base.parsley": {Data: []byte(base)},
+			},
+			input: "A B",
+			want:  "input<[[item<[name<[String<A>]>]>, item<[name<[String<B>]>]>]]>",
+		},
+		{
+			name: "super",
+			files: fstest.MapFS{
+				"main.parsley": {Data: []byte("extend \"base.parsley\"\nname: <super.name /[0-9]+/>\n")},
+				"base.parsley": {Data: []byte(base)},
+			},
+			input: "a 1",
+			want:  "input<[[item<[name<[super.name<[String<a>]>]>]>, item<[name<[String<1>]>]>]]>",
+		},
+		{
+			name: "super of super",
+			files: fstest.MapFS{
+				"main.parsley":   {Data: []byte("extend \"middle.parsley\"\nname: <super.name \"!\">\n")},
+				"middle.parsley": {Data: []byte("extend \"base.parsley\"\nname: <super.name /[0-9]+/>\n")},
+				"base.parsley":   {Data: []byte(base)},
+			},
+			input: "a 1",
+			want:  "input<[[item<[name<[super.name<[super.super.name<[String<a>]>]>]>]>, item<[name<[super.name<[String<1>]>]>]>]]>",
+		},
+		{
+			name: "inherited template",
+			files: fstest.MapFS{
+				"main.parsley": {Data: []byte("extend \"base.parsley\"\ninput: list(name)\n")},
+				"base.parsley": {Data: []byte(base)},
+			},
+			input: "a,b",
+			want:  "input<[list(name)<[name<[String<a>]>, [[name<[String<b>]>]]]>]>",
+		},
+		{
+			name: "super without a parent rule",
+			files: fstest.MapFS{
+				"main.parsley": {Data: []byte("extend \"base.parsley\"\nword: super.word\n")},
+				"base.parsley": {Data: []byte(base)},
+			},
+			wantErr: "main.parsley: rule word refers to super.word, but there is no parent rule to refer to",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			grammar, err := ParseGrammarFS(c.files, "main.parsley")
+
+			if err == nil {
+				var got string
+				got, err = condensed(grammar, c.input)
+
+				if err == nil && got != c.want {
+					t.Errorf("got %s, want %s", got, c.want)
+				}
+			}
+
+			if c.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+				t.Fatalf("got error %v, want one containing %q", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestGrammarExtend(t *testing.T) {
+	base, err := ParseGrammar("input: list(item)\nitem: name\nname: /[a-z]+/\nlist(x): x (\",\" x)*\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extended, err := base.Extend("item: list(number)\nnumber: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := condensed(extended, "1,2")
+	want := "input<[list(item)<[item<[list(number)<[number<[String<1>]>, [[number<[String<2>]>]]]>]>, []]>]>"
+
+	if err != nil || got != want {
+		t.Errorf("got %s, %v, want %s", got, err, want)
+	}
+
+	// The base grammar is unchanged
+	if _, err := condensed(base, "a,b"); err != nil {
+		t.Errorf("base grammar: %v", err)
+	}
+
+	if _, err := base.Extend("extend \"other.parsley\"\n"); err == nil || !strings.Contains(err.Error(), "can't extend other.parsley without a file system") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestExtendKeepsPositions(t *testing.T) {
+	files := fstest.MapFS{
+		"main.parsley":   {Data: []byte("extend \"middle.parsley\"\nname: <super.name \"!\">\n")},
+		"middle.parsley": {Data: []byte("extend \"base.parsley\"\nname: <super.name /[0-9]+/>\n")},
+		"base.parsley":   {Data: []byte("input: name+\nname: /[a-z]+/\n")},
+	}
+
+	grammar, err := ParseGrammarFS(files, "main.parsley")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+
+	// The reference in middle.parsley is moved back by a super, but is still where it was
+	for _, contents := range grammar.rules["super.name"].([]common.Expression) {
+		walkExpression(contents, func(expr common.Expression) {
+			if expr.Definition != &RuleRef || expr.Values["ref"] != "super.super.name" {
+				return
+			}
+
+			found = true
+			loc, _ := expr.Values["loc"].(common.StringPos)
+
+			if loc.File != "middle.parsley" || loc.Line != 1 || loc.Col != 7 || expr.Values["text"] != "super.name" {
+				t.Errorf("got loc %+v and text %v", loc, expr.Values["text"])
+			}
+		})
+	}
+
+	if !found {
+		t.Error("no reference to super.super.name")
+	}
+}
@@ -0,0 +1,327 @@
+package parsley
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// memoTableKey is the globals key for the memo table of a parse that can be reparsed.
+// Like common.StateKey, it can't collide with a rule name.
+const memoTableKey = "$memo"
+
+// Edit replaces the bytes from Start up to End with Text.
+type Edit struct {
+	Start, End int
+	Text       string
+}
+
+// Tree is the result of a parse that remembers enough about how it went to be reparsed
+// cheaply after an edit.
+type Tree struct {
+	Result   common.EvaluateResult
+	contents string
+	memo     map[memoPos]*memoEntry
+}
+
+// Contents returns the input the tree was parsed from.
+func (t *Tree) Contents() string {
+	return t.contents
+}
+
+// ParseTree parses contents like Parse does, keeping the tree around for Reparse. If the
+// contents don't parse, the tree is still returned along with the ParseError, just without
+// a Result, so that later edits can still be applied to it.
+func (g Grammar) ParseTree(contents string) (*Tree, error) {
+	return g.parseTree(contents, map[memoPos]*memoEntry{})
+}
+
+// Reparse applies edit to the input of old and parses the result, reusing every rule match
+// from earlier parses that didn't look at any of the edited text. The result is the same
+// as parsing the edited input from scratch would give. old has to come from this grammar,
+// and is left as it was.
+//
+// A rule match can only be reused if it depended on nothing but its own input, so rules
+// that use INDENT, DEDENT or NEWLINE, predicates, primitives or embedded grammars are
+// always parsed again. If the edited input doesn't parse, it is parsed once more without
+// the earlier matches, so that the error is the same as well.
+func (g Grammar) Reparse(old *Tree, edit Edit) (*Tree, error) {
+	if edit.Start < 0 || edit.Start > edit.End || edit.End > len(old.contents) {
+		return nil, fmt.Errorf("edit of %d:%d is out of range for input of length %d", edit.Start, edit.End, len(old.contents))
+	}
+
+	contents := old.contents[:edit.Start] + edit.Text + old.contents[edit.End:]
+	shift := len(edit.Text) - (edit.End - edit.Start)
+	memo := make(map[memoPos]*memoEntry, len(old.memo))
+
+	for pos, entry := range old.memo {
+		if entry.examined <= edit.Start {
+			memo[pos] = entry.moved(0)
+		} else if pos.pos >= edit.End {
+			memo[memoPos{pos.rule, pos.pos + shift}] = entry.moved(shift)
+		}
+	}
+
+	return g.parseTree(contents, memo)
+}
+
+func (g Grammar) parseTree(contents string, memo map[memoPos]*memoEntry) (*Tree, error) {
+	globals := g.newGlobals(context.Background(), ParseOptions{})
+	table := &memoTable{entries: memo}
+	globals[memoTableKey] = table
+
+	result, err := g.topLevelExpr.Evaluate(common.NewMetaString(contents), globals)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &Tree{contents: contents, memo: memo}
+
+	if failure := unconsumed(result); failure != nil {
+		// Matches reused from the memo table don't record what was expected inside them, so
+		// the error comes from parsing again without it
+		if table.reused {
+			if _, err := g.parse(context.Background(), common.NewMetaString(contents), ParseOptions{}); err != nil {
+				return tree, err
+			}
+		}
+
+		return tree, newParseError(contents, *failure, globals)
+	}
+
+	tree.Result = result
+
+	return tree, nil
+}
+
+type memoPos struct {
+	rule string
+	pos  int
+}
+
+// memoEntry is a successful match of a rule. The positions in result are off by delta
+// from where the match is now, and suffixes of the input in it end at end.
+type memoEntry struct {
+	result common.RuleResult
+	end    int
+	delta  int
+	stale  bool
+
+	// examined is one past the furthest position the match looked at. It is one past the
+	// end of the input if the match depended on where the input ended.
+	examined int
+}
+
+// moved copies the entry for an input where everything it looked at has moved by shift.
+func (e *memoEntry) moved(shift int) *memoEntry {
+	return &memoEntry{e.result, e.end, e.delta + shift, true, e.examined + shift}
+}
+
+// memoTable records rule matches while parsing, along with what each one depended on. A
+// table without entries only keeps track of how far the input was looked at, which is
+// what ParseReader needs to know whether a match could change once more input is read.
+type memoTable struct {
+	entries map[memoPos]*memoEntry
+
+	// examined is one past the furthest position looked at so far by the rule being
+	// evaluated, and opaque is whether it depended on anything other than its input.
+	examined int
+	opaque   bool
+
+	// reused is whether any match was taken from entries.
+	reused bool
+}
+
+type memoFrame struct {
+	examined int
+	opaque   bool
+}
+
+func getMemoTable(globals map[string]any) *memoTable {
+	memo, _ := globals[memoTableKey].(*memoTable)
+	return memo
+}
+
+// lookup returns an earlier match of rule at input, if there is one.
+func (m *memoTable) lookup(rule string, input common.MetaString) (common.RuleResult, bool) {
+	entry, found := m.entries[memoPos{rule, input.Pos()}]
+
+	if !found {
+		return common.RuleResult{}, false
+	}
+
+	if entry.stale {
+		s := shifter{delta: entry.delta, end: entry.end, start: input.Pos() - entry.delta, base: input}
+		entry.result = s.rule(entry.result)
+		entry.end = input.Pos() + len(input.Val())
+		entry.delta = 0
+		entry.stale = false
+	}
+
+	m.examine(entry.examined)
+	m.reused = true
+
+	return entry.result, true
+}
+
+// begin starts tracking a rule evaluation, returning what has to be handed to end.
+func (m *memoTable) begin() memoFrame {
+	outer := memoFrame{m.examined, m.opaque}
+	m.examined, m.opaque = 0, false
+	return outer
+}
+
+// end records the result of the rule evaluation started by begin, if it can be reused.
+func (m *memoTable) end(outer memoFrame, rule string, input common.MetaString, result common.EvaluateResult) {
+	if ruleResult, ok := result.(common.RuleResult); ok && !m.opaque && m.entries != nil {
+		m.entries[memoPos{rule, input.Pos()}] = &memoEntry{
+			result:   ruleResult,
+			end:      input.Pos() + len(input.Val()),
+			examined: m.examined,
+		}
+	}
+
+	m.examined = max(m.examined, outer.examined)
+	m.opaque = m.opaque || outer.opaque
+}
+
+func (m *memoTable) examine(pos int) {
+	m.examined = max(m.examined, pos)
+}
+
+// notReusable marks the rule being evaluated, if there is one being tracked, as depending
+// on more than its input.
+func notReusable(globals map[string]any) {
+	if memo := getMemoTable(globals); memo != nil {
+		memo.opaque = true
+	}
+}
+
+// examineRest records that whatever was evaluated could have looked at all of input, up to
+// and including where it ends.
+func examineRest(globals map[string]any, input common.MetaString) {
+	if memo := getMemoTable(globals); memo != nil {
+		memo.examine(input.Pos() + len(input.Val()) + 1)
+	}
+}
+
+// examineLine records looking through the whitespace at the start of input and at what
+// comes after it, which is how nextLine finds the next line.
+func examineLine(globals map[string]any, input common.MetaString) {
+	if memo := getMemoTable(globals); memo != nil {
+		memo.examinePrefix(input, "")
+	}
+}
+
+// examinePrefix records comparing text against input after skipping whitespace.
+func (m *memoTable) examinePrefix(input common.MetaString, text string) {
+	contents := input.Val()
+	skipped := len(contents) - len(strings.TrimLeft(contents, " \t\f\v\r\n"))
+
+	if skipped == len(contents) {
+		m.examine(input.Pos() + len(contents) + 1)
+		return
+	}
+
+	m.examine(input.Pos() + min(skipped+max(len(text), 1), len(contents)+1))
+}
+
+// findRegexp is FindStringSubmatchIndex that records how far the regular expression had
+// to read.
+func (m *memoTable) findRegexp(expr *regexp.Regexp, input common.MetaString) []int {
+	reader := &examiningReader{contents: input.Val()}
+	idx := expr.FindReaderSubmatchIndex(reader)
+	m.examine(input.Pos() + reader.pos)
+	return idx
+}
+
+// examiningReader reads runes from a string, remembering how far it got. Reading past the
+// end leaves pos one past the end.
+type examiningReader struct {
+	contents string
+	pos      int
+}
+
+func (r *examiningReader) ReadRune() (rune, int, error) {
+	if r.pos >= len(r.contents) {
+		r.pos = len(r.contents) + 1
+		return 0, 0, io.EOF
+	}
+
+	ch, size := utf8.DecodeRuneInString(r.contents[r.pos:])
+	r.pos += size
+
+	return ch, size, nil
+}
+
+// shifter rebuilds a memoized result for the input it is now found in. Every position in
+// the result is moved by delta and taken from base instead.
+type shifter struct {
+	delta int
+	end   int
+	start int
+	base  common.MetaString
+}
+
+func (s *shifter) string(m common.MetaString) common.MetaString {
+	// Nothing in a match comes from before it, except the empty MetaString that some
+	// failures are reported with
+	if m.Pos() < s.start {
+		return m
+	}
+
+	moved := s.base.FromStartPos(m.Pos() + s.delta - s.base.Pos())
+
+	if m.Pos()+len(m.Val()) == s.end {
+		return moved
+	}
+
+	return moved.FromPosRange(0, len(m.Val()))
+}
+
+func (s *shifter) rule(r common.RuleResult) common.RuleResult {
+	start := s.string(r.Start())
+	result := s.multiple(r.Result())
+
+	return common.NewRuleResult(result, start, s.string(r.Remaining()), r.Identifier())
+}
+
+func (s *shifter) multiple(r common.MultipleResult) common.MultipleResult {
+	results := make([]common.EvaluateResult, len(r.Results()))
+
+	for i, result := range r.Results() {
+		results[i] = s.result(result)
+	}
+
+	var next *common.MetaString
+
+	if r.Next() != nil {
+		moved := s.string(*r.Next())
+		next = &moved
+	}
+
+	return common.NewMultipleResult(results, s.string(r.Remaining()), next)
+}
+
+func (s *shifter) result(r common.EvaluateResult) common.EvaluateResult {
+	switch r := r.(type) {
+	case common.RuleResult:
+		return s.rule(r)
+	case common.MultipleResult:
+		return s.multiple(r)
+	case common.StringResult:
+		return common.NewStringResult(s.string(r.Val()), s.string(r.Remaining()))
+	case common.DiscardResult:
+		return common.NewDiscardResult(s.string(r.Remaining()))
+	case common.NoMatchResult:
+		return common.NewNoMatchResult(s.string(r.Remaining()))
+	}
+
+	return r
+}
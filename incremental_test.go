@@ -0,0 +1,178 @@
+package parsley
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+const incrementalGrammar = "input: stmt*\nstmt: name args? \";\"\nargs: \"(\" sep(name, \",\") \")\"\nname: /[a-z]+/\n"
+
+// describe prints a result along with the position of everything it matched, which is
+// what a reparse has to get right on top of the tree itself.
+func describe(result common.EvaluateResult) string {
+	var b strings.Builder
+	var walk func(result common.EvaluateResult)
+
+	walk = func(result common.EvaluateResult) {
+		switch result := result.(type) {
+		case common.RuleResult:
+			fmt.Fprintf(&b, "%s@%s(", result.Identifier(), result.Start().Loc)
+			walk(result.Result())
+			b.WriteString(")")
+		case common.MultipleResult:
+			for _, subResult := range result.Results() {
+				walk(subResult)
+			}
+		case common.StringResult:
+			fmt.Fprintf(&b, "%q@%s ", result.Val().Val(), result.Val().Loc)
+		}
+	}
+
+	walk(result)
+
+	return b.String()
+}
+
+func TestReparse(t *testing.T) {
+	grammar, err := ParseGrammar(incrementalGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := "a;\nb(c, d);\ne;\n"
+
+	edits := []struct {
+		name string
+		edit Edit
+	}{
+		{"insert at the start", Edit{0, 0, "x;\n"}},
+		{"insert in the middle", Edit{3, 3, "x;"}},
+		{"insert at the end", Edit{len(original), len(original), "x;"}},
+		{"extend a name", Edit{4, 4, "bb"}},
+		{"replace an argument", Edit{5, 6, "zz"}},
+		{"delete a statement", Edit{0, 3, ""}},
+		{"join two lines", Edit{11, 12, " "}},
+	}
+
+	for _, c := range edits {
+		t.Run(c.name, func(t *testing.T) {
+			old, err := grammar.ParseTree(original)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tree, err := grammar.Reparse(old, c.edit)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := grammar.ParseTree(tree.Contents())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := describe(tree.Result), describe(want.Result); got != want {
+				t.Errorf("got\n\t%s\nwant\n\t%s", got, want)
+			}
+
+			if old.Contents() != original {
+				t.Error("the old tree changed")
+			}
+		})
+	}
+}
+
+func TestReparseAfterError(t *testing.T) {
+	grammar, err := ParseGrammar(incrementalGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broken, err := grammar.ParseTree("a;\nb(c;\n")
+
+	if err == nil || broken == nil {
+		t.Fatalf("got %v, %v, want a tree and an error", broken, err)
+	}
+
+	fixed, err := grammar.Reparse(broken, Edit{6, 6, ")"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := grammar.ParseTree("a;\nb(c);\n")
+
+	if describe(fixed.Result) != describe(want.Result) {
+		t.Errorf("got %s, want %s", describe(fixed.Result), describe(want.Result))
+	}
+
+	if _, err := grammar.Reparse(fixed, Edit{5, 100, ""}); err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestReparseErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		grammar  string
+		original string
+		edit     Edit
+	}{
+		{
+			// stmt is reused at the start, but it is where the furthest failure was
+			name:     "failure inside a reused match",
+			grammar:  "input: stmt+\nstmt: name args?\nargs: \"(\" name \")\" @error(\"unclosed args\")\nname: /[a-z]+/\n",
+			original: "b(c d          ",
+			edit:     Edit{15, 15, "e"},
+		},
+		{
+			name:     "failure after reused matches",
+			grammar:  incrementalGrammar,
+			original: "a;\nb(c, d);\ne;\n",
+			edit:     Edit{15, 15, "f(;"},
+		},
+		{
+			name:     "failure in the edit",
+			grammar:  incrementalGrammar,
+			original: "a;\nb(c, d);\ne;\n",
+			edit:     Edit{8, 9, ""},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			grammar, err := ParseGrammar(c.grammar)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			old, _ := grammar.ParseTree(c.original)
+			tree, err := grammar.Reparse(old, c.edit)
+
+			var got, want ParseError
+
+			if !errors.As(err, &got) {
+				t.Fatalf("got error %v, want a ParseError", err)
+			}
+
+			if _, err := grammar.ParseTree(tree.Contents()); !errors.As(err, &want) {
+				t.Fatalf("got error %v, want a ParseError", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testClient talks to a Server over pipes the way an editor would, one request at a time.
+// Notifications from the server are queued until the test asks for them.
+type testClient struct {
+	t        *testing.T
+	conn     *conn
+	out      *io.PipeWriter
+	messages chan *message
+	queued   []*message
+	served   chan error
+	nextID   int
+}
+
+// clientTimeout is how long the client waits for the server before failing the test.
+const clientTimeout = 5 * time.Second
+
+func startServer(t *testing.T, server *Server) *testClient {
+	t.Helper()
+
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	server.Log = log.New(io.Discard, "", 0)
+
+	c := &testClient{
+		t:        t,
+		conn:     newConn(clientIn, clientOut),
+		out:      clientOut,
+		messages: make(chan *message),
+		served:   make(chan error, 1),
+	}
+
+	go func() {
+		c.served <- server.Serve(serverIn, serverOut)
+		serverOut.Close()
+	}()
+
+	go func() {
+		defer close(c.messages)
+
+		for {
+			msg, err := c.conn.read()
+
+			if err != nil {
+				return
+			}
+
+			c.messages <- msg
+		}
+	}()
+
+	t.Cleanup(func() { clientOut.Close() })
+
+	return c
+}
+
+// receive returns the next message from the server.
+func (c *testClient) receive() *message {
+	c.t.Helper()
+
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("server closed the connection")
+		}
+
+		return msg
+	case <-time.After(clientTimeout):
+		c.t.Fatal("timed out waiting for the server")
+		return nil
+	}
+}
+
+// request sends a request and decodes its result into result, which can be nil. A response
+// error is returned as a *ResponseError.
+func (c *testClient) request(method string, params, result any) error {
+	c.t.Helper()
+
+	c.nextID++
+	id := json.RawMessage(strconv.Itoa(c.nextID))
+	c.send(&message{ID: &id, Method: method, Params: c.marshal(params)})
+
+	for {
+		msg := c.receive()
+
+		if msg.ID == nil {
+			c.queued = append(c.queued, msg)
+			continue
+		}
+
+		if string(*msg.ID) != string(id) {
+			c.t.Fatalf("got a response to request %s while waiting for %s", *msg.ID, id)
+		}
+
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		if result != nil {
+			if err := json.Unmarshal(c.marshal(msg.Result), result); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+
+		return nil
+	}
+}
+
+func (c *testClient) notify(method string, params any) {
+	c.t.Helper()
+	c.send(&message{Method: method, Params: c.marshal(params)})
+}
+
+// notification waits for the next notification with the given method and decodes its
+// params into params. Other notifications before it are dropped.
+func (c *testClient) notification(method string, params any) {
+	c.t.Helper()
+
+	for {
+		var msg *message
+
+		if len(c.queued) > 0 {
+			msg, c.queued = c.queued[0], c.queued[1:]
+		} else {
+			msg = c.receive()
+		}
+
+		if msg.ID != nil {
+			c.t.Fatalf("got a response to request %s without having sent one", *msg.ID)
+		}
+
+		if msg.Method == method {
+			if err := json.Unmarshal(msg.Params, params); err != nil {
+				c.t.Fatal(err)
+			}
+
+			return
+		}
+	}
+}
+
+// shutdown shuts the server down the way a client should, and returns what Serve
+// returned.
+func (c *testClient) shutdown() error {
+	c.t.Helper()
+
+	if err := c.request("shutdown", nil, nil); err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.notify("exit", nil)
+
+	select {
+	case err := <-c.served:
+		return err
+	case <-time.After(clientTimeout):
+		return errors.New("timed out waiting for the server to exit")
+	}
+}
+
+func (c *testClient) send(msg *message) {
+	c.t.Helper()
+
+	if err := c.conn.write(msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) marshal(v any) json.RawMessage {
+	c.t.Helper()
+
+	if raw, ok := v.(json.RawMessage); ok {
+		return raw
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	out, err := json.Marshal(v)
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return out
+}
@@ -0,0 +1,132 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// Error codes from JSON-RPC and LSP.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeRequestFailed  = -32803
+)
+
+// ResponseError is an error that is sent back as the response to a request. Handlers can
+// return one to choose the error code, anything else is sent as CodeRequestFailed.
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+// message is any JSON-RPC message. Requests have an ID and a method, notifications only a
+// method, and responses only an ID.
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  any              `json:"result,omitempty"`
+	Error   *ResponseError   `json:"error,omitempty"`
+}
+
+// conn reads and writes JSON-RPC messages framed with a Content-Length header, which is how
+// LSP sends them over stdio.
+type conn struct {
+	r *textproto.Reader
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newConn(r io.Reader, w io.Writer) *conn {
+	return &conn{r: textproto.NewReader(bufio.NewReader(r)), w: w}
+}
+
+func (c *conn) read() (*message, error) {
+	header, err := c.r.ReadMIMEHeader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length %q", header.Get("Content-Length"))
+	}
+
+	body := make([]byte, length)
+
+	if _, err := io.ReadFull(c.r.R, body); err != nil {
+		return nil, err
+	}
+
+	var msg message
+
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return &message{}, &ResponseError{CodeParseError, err.Error()}
+	}
+
+	return &msg, nil
+}
+
+func (c *conn) write(msg *message) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+
+	_, err = c.w.Write(body)
+	return err
+}
+
+func (c *conn) reply(id *json.RawMessage, result any, err error) error {
+	if err == nil {
+		// A request that succeeds has to have a result, even if it is null
+		if result == nil {
+			result = json.RawMessage("null")
+		}
+
+		return c.write(&message{ID: id, Result: result})
+	}
+
+	responseErr, ok := err.(*ResponseError)
+
+	if !ok {
+		responseErr = &ResponseError{CodeRequestFailed, err.Error()}
+	}
+
+	return c.write(&message{ID: id, Error: responseErr})
+}
+
+func (c *conn) notify(method string, params any) error {
+	body, err := json.Marshal(params)
+
+	if err != nil {
+		return err
+	}
+
+	return c.write(&message{Method: method, Params: body})
+}
@@ -0,0 +1,132 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/l-donovan/parsley"
+	"github.com/l-donovan/parsley/common"
+)
+
+// Document is an open text document, as the client last sent it.
+type Document struct {
+	URI        string
+	LanguageID string
+	Version    int
+	Text       string
+
+	// lineStarts are the offsets that every line but the first starts at.
+	lineStarts []int
+}
+
+func newDocument(item TextDocumentItem) *Document {
+	doc := &Document{URI: item.URI, LanguageID: item.LanguageID, Version: item.Version}
+	doc.setText(item.Text)
+	return doc
+}
+
+func (d *Document) setText(text string) {
+	d.Text = text
+	d.lineStarts = d.lineStarts[:0]
+
+	for offset := 0; ; {
+		next := strings.IndexByte(text[offset:], '\n')
+
+		if next == -1 {
+			break
+		}
+
+		offset += next + 1
+		d.lineStarts = append(d.lineStarts, offset)
+	}
+}
+
+// Offset turns a position into a byte offset. Positions past the end of a line are taken
+// to be at the end of it, and positions past the last line at the end of the document.
+func (d *Document) Offset(pos Position) int {
+	if pos.Line < 0 {
+		return 0
+	}
+
+	if pos.Line > len(d.lineStarts) {
+		return len(d.Text)
+	}
+
+	offset, end := 0, len(d.Text)
+
+	if pos.Line > 0 {
+		offset = d.lineStarts[pos.Line-1]
+	}
+
+	if pos.Line < len(d.lineStarts) {
+		end = d.lineStarts[pos.Line] - 1
+	}
+
+	for units := 0; offset < end && units < pos.Character; {
+		ch, size := utf8.DecodeRuneInString(d.Text[offset:])
+		offset += size
+		units += utf16Width(ch)
+	}
+
+	return offset
+}
+
+// Position turns a byte offset into a position.
+func (d *Document) Position(offset int) Position {
+	offset = max(0, min(offset, len(d.Text)))
+	line := sort.SearchInts(d.lineStarts, offset+1)
+	lineStart := 0
+
+	if line > 0 {
+		lineStart = d.lineStarts[line-1]
+	}
+
+	return Position{line, utf16Len(d.Text[lineStart:offset])}
+}
+
+// Range returns the range of text from start up to end.
+func (d *Document) Range(start, end int) Range {
+	return Range{d.Position(start), d.Position(end)}
+}
+
+// apply makes a change the client sent, returning it as an edit to the text before it.
+func (d *Document) apply(change TextDocumentContentChangeEvent) (parsley.Edit, error) {
+	edit := parsley.Edit{Start: 0, End: len(d.Text), Text: change.Text}
+
+	if change.Range != nil {
+		edit.Start, edit.End = d.Offset(change.Range.Start), d.Offset(change.Range.End)
+
+		if edit.Start > edit.End {
+			return edit, fmt.Errorf("change of %v in %s ends before it starts", *change.Range, d.URI)
+		}
+	}
+
+	d.setText(d.Text[:edit.Start] + edit.Text + d.Text[edit.End:])
+
+	return edit, nil
+}
+
+// metaStringRange is the range of m, which has to be a slice of the document's text.
+func (d *Document) metaStringRange(m common.MetaString) Range {
+	return d.Range(m.Pos(), m.Pos()+len(m.Val()))
+}
+
+func utf16Width(ch rune) int {
+	if ch >= 0x10000 {
+		return 2
+	}
+
+	return 1
+}
+
+func utf16Len(s string) int {
+	n := 0
+
+	for _, ch := range s {
+		n += utf16Width(ch)
+	}
+
+	return n
+}
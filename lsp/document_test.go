@@ -0,0 +1,39 @@
+package lsp
+
+import "testing"
+
+func TestDocumentPositions(t *testing.T) {
+	doc := newDocument(TextDocumentItem{URI: "file:///a", Text: "ab\n😀é\n\nend"})
+
+	cases := []struct {
+		offset int
+		pos    Position
+	}{
+		{0, Position{0, 0}},
+		{2, Position{0, 2}},
+		{3, Position{1, 0}},
+		// 😀 is two UTF-16 code units and é is one
+		{7, Position{1, 2}},
+		{9, Position{1, 3}},
+		{10, Position{2, 0}},
+		{11, Position{3, 0}},
+		{14, Position{3, 3}},
+	}
+
+	for _, tc := range cases {
+		if got := doc.Position(tc.offset); got != tc.pos {
+			t.Errorf("Position(%d) = %+v, want %+v", tc.offset, got, tc.pos)
+		}
+
+		if got := doc.Offset(tc.pos); got != tc.offset {
+			t.Errorf("Offset(%+v) = %d, want %d", tc.pos, got, tc.offset)
+		}
+	}
+
+	// Positions past the end of a line or of the document are clamped
+	for pos, want := range map[Position]int{{0, 10}: 2, {1, 10}: 9, {9, 0}: 14, {-1, 5}: 0} {
+		if got := doc.Offset(pos); got != want {
+			t.Errorf("Offset(%+v) = %d, want %d", pos, got, want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package lsp
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/l-donovan/parsley"
+	"github.com/l-donovan/parsley/common"
+)
+
+// DSLOptions says how NewDSLServer presents documents parsed by its grammar.
+type DSLOptions struct {
+	// Symbols are the rules that make up the document outline. A match of one inside a
+	// match of another shows up nested inside it.
+	Symbols map[string]SymbolRule
+
+	// Tokens gives rules a semantic token type, one of SemanticTokenTypes. The text of the
+	// innermost rules that have one is highlighted as that type. Rules named after a token
+	// type, like string or comment, don't have to be listed.
+	Tokens map[string]string
+}
+
+// SymbolRule is how a rule shows up in the document outline.
+type SymbolRule struct {
+	// NameRule is the rule whose first match inside the symbol names it. Without one, or if
+	// it doesn't match, the symbol is named after the first line of its text.
+	NameRule string
+
+	// Kind defaults to SymbolKindObject.
+	Kind SymbolKind
+}
+
+// maxSymbolName is how long a symbol named after its text can be.
+const maxSymbolName = 40
+
+type dslServer struct {
+	*Server
+	grammar *parsley.Grammar
+	opts    DSLOptions
+	trees   map[string]*parsley.Tree
+}
+
+// NewDSLServer returns a language server for documents in the language that grammar
+// parses. It publishes parse errors as diagnostics, and gives clients a document outline,
+// folding ranges for every rule that spans several lines, and semantic tokens. Documents
+// are reparsed with Reparse as they change.
+func NewDSLServer(name string, grammar *parsley.Grammar, opts DSLOptions) *Server {
+	d := &dslServer{Server: NewServer(name), grammar: grammar, opts: opts, trees: map[string]*parsley.Tree{}}
+
+	d.OnChange(d.parse)
+	d.OnClose(func(uri string) { delete(d.trees, uri) })
+
+	d.SetCapability("documentSymbolProvider", true)
+	d.SetCapability("foldingRangeProvider", true)
+	d.SetCapability("semanticTokensProvider", map[string]any{
+		"legend": SemanticTokensLegend{TokenTypes: SemanticTokenTypes, TokenModifiers: []string{}},
+		"full":   true,
+	})
+
+	d.Handle("textDocument/documentSymbol", d.documentSymbol)
+	d.Handle("textDocument/foldingRange", d.foldingRange)
+	d.Handle("textDocument/semanticTokens/full", d.semanticTokens)
+
+	return d.Server
+}
+
+// parse brings the tree for doc up to date and publishes what was wrong with it.
+func (d *dslServer) parse(doc *Document, edits []parsley.Edit) {
+	tree, found := d.trees[doc.URI]
+	var err error
+
+	if found && edits != nil {
+		for _, edit := range edits {
+			if tree, err = d.grammar.Reparse(tree, edit); tree == nil {
+				break
+			}
+		}
+	}
+
+	// Anything that went wrong other than the document not parsing leaves nothing to
+	// reparse from, so it's parsed from scratch instead
+	if tree == nil || edits == nil || tree.Contents() != doc.Text {
+		tree, err = d.grammar.ParseTree(doc.Text)
+	}
+
+	if tree != nil {
+		d.trees[doc.URI] = tree
+	} else {
+		delete(d.trees, doc.URI)
+	}
+
+	var diagnostics []Diagnostic
+
+	if err != nil {
+		diagnostics = append(diagnostics, parseDiagnostic(doc, err))
+	}
+
+	d.PublishDiagnostics(doc, diagnostics)
+}
+
+// parseDiagnostic converts an error from parsing doc into a Diagnostic. Errors that aren't
+// about a particular place in it are shown at the start.
+func parseDiagnostic(doc *Document, err error) Diagnostic {
+	diagnostic := parsley.ErrorDiagnostic(documentName(doc.URI), err)
+	converted := Diagnostic{Severity: SeverityError, Code: diagnostic.RuleID, Source: "parsley", Message: diagnostic.Message}
+
+	if span := diagnostic.Span; span != nil {
+		converted.Range = doc.Range(span.Start.Offset, span.End.Offset)
+	}
+
+	return converted
+}
+
+// result returns the parse result for the document a request is about, or nil if it
+// didn't parse.
+func (d *dslServer) result(params json.RawMessage) (*Document, common.EvaluateResult, error) {
+	doc, err := d.textDocument(params)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tree := d.trees[doc.URI]; tree != nil {
+		return doc, tree.Result, nil
+	}
+
+	return doc, nil, nil
+}
+
+func (d *dslServer) documentSymbol(params json.RawMessage) (any, error) {
+	doc, result, err := d.result(params)
+
+	if err != nil || result == nil {
+		return []DocumentSymbol{}, err
+	}
+
+	symbols := d.symbols(doc, result)
+
+	if symbols == nil {
+		symbols = []DocumentSymbol{}
+	}
+
+	return symbols, nil
+}
+
+func (d *dslServer) symbols(doc *Document, result common.EvaluateResult) []DocumentSymbol {
+	switch result := result.(type) {
+	case common.RuleResult:
+		rule, isSymbol := d.opts.Symbols[result.Identifier()]
+
+		if !isSymbol {
+			return d.symbols(doc, result.Result())
+		}
+
+		start, end := ruleSpan(result)
+		symbol := DocumentSymbol{Detail: result.Identifier(), Kind: rule.Kind, Range: doc.Range(start, end)}
+
+		if symbol.Kind == 0 {
+			symbol.Kind = SymbolKindObject
+		}
+
+		if name, found := d.symbolName(result.Result(), rule.NameRule); found {
+			nameStart, nameEnd := ruleSpan(name)
+			symbol.Name = strings.TrimSpace(doc.Text[nameStart:nameEnd])
+			symbol.SelectionRange = doc.Range(nameStart, nameEnd)
+		} else {
+			symbol.Name = firstLine(doc.Text[start:end], maxSymbolName)
+			symbol.SelectionRange = symbol.Range
+		}
+
+		// Clients won't show a symbol without a name
+		if symbol.Name == "" {
+			symbol.Name = result.Identifier()
+		}
+
+		symbol.Children = d.symbols(doc, result.Result())
+
+		return []DocumentSymbol{symbol}
+	case common.MultipleResult:
+		var symbols []DocumentSymbol
+
+		for _, item := range result.Results() {
+			symbols = append(symbols, d.symbols(doc, item)...)
+		}
+
+		return symbols
+	}
+
+	return nil
+}
+
+// symbolName finds the first match of nameRule in result, without looking inside other
+// symbols.
+func (d *dslServer) symbolName(result common.EvaluateResult, nameRule string) (common.RuleResult, bool) {
+	if nameRule == "" {
+		return common.RuleResult{}, false
+	}
+
+	switch result := result.(type) {
+	case common.RuleResult:
+		if result.Identifier() == nameRule {
+			return result, true
+		}
+
+		if _, isSymbol := d.opts.Symbols[result.Identifier()]; isSymbol {
+			return common.RuleResult{}, false
+		}
+
+		return d.symbolName(result.Result(), nameRule)
+	case common.MultipleResult:
+		for _, item := range result.Results() {
+			if name, found := d.symbolName(item, nameRule); found {
+				return name, true
+			}
+		}
+	}
+
+	return common.RuleResult{}, false
+}
+
+func (d *dslServer) foldingRange(params json.RawMessage) (any, error) {
+	doc, result, err := d.result(params)
+
+	if err != nil || result == nil {
+		return []FoldingRange{}, err
+	}
+
+	// Only the largest range starting on each line is kept, since a client can only fold a
+	// line one way
+	endLines := map[int]int{}
+
+	// Folding the whole document isn't any use
+	if input, ok := result.(common.RuleResult); ok {
+		result = input.Result()
+	}
+
+	walkRules(result, func(rule common.RuleResult) {
+		start, end := ruleSpan(rule)
+
+		if end <= start {
+			return
+		}
+
+		startLine, endLine := doc.Position(start).Line, doc.Position(end-1).Line
+
+		if endLine > startLine && endLine > endLines[startLine] {
+			endLines[startLine] = endLine
+		}
+	})
+
+	ranges := []FoldingRange{}
+
+	for startLine, endLine := range endLines {
+		ranges = append(ranges, FoldingRange{StartLine: startLine, EndLine: endLine})
+	}
+
+	slices.SortFunc(ranges, func(a, b FoldingRange) int { return a.StartLine - b.StartLine })
+
+	return ranges, nil
+}
+
+// tokenSpan is text that is highlighted as a semantic token type.
+type tokenSpan struct {
+	start, end, tokenType int
+}
+
+func (d *dslServer) semanticTokens(params json.RawMessage) (any, error) {
+	doc, result, err := d.result(params)
+
+	if err != nil || result == nil {
+		return SemanticTokens{Data: []int{}}, err
+	}
+
+	return encodeTokens(doc, d.tokenSpans(result, nil)), nil
+}
+
+// tokenSpans appends the spans of the innermost rules in result that have a token type to
+// spans, in order.
+func (d *dslServer) tokenSpans(result common.EvaluateResult, spans []tokenSpan) []tokenSpan {
+	switch result := result.(type) {
+	case common.RuleResult:
+		before := len(spans)
+		spans = d.tokenSpans(result.Result(), spans)
+
+		if tokenType := d.tokenType(result.Identifier()); tokenType != -1 && len(spans) == before {
+			start, end := ruleSpan(result)
+			spans = append(spans, tokenSpan{start, end, tokenType})
+		}
+	case common.MultipleResult:
+		for _, item := range result.Results() {
+			spans = d.tokenSpans(item, spans)
+		}
+	}
+
+	return spans
+}
+
+// tokenType returns the index in SemanticTokenTypes of the token type of rule, or -1 if it
+// doesn't have one.
+func (d *dslServer) tokenType(rule string) int {
+	if tokenType, found := d.opts.Tokens[rule]; found {
+		return slices.Index(SemanticTokenTypes, tokenType)
+	}
+
+	return slices.Index(SemanticTokenTypes, rule)
+}
+
+// encodeTokens encodes spans the way LSP expects. Tokens can't span lines, so spans are
+// split into one token per line.
+func encodeTokens(doc *Document, spans []tokenSpan) SemanticTokens {
+	data := []int{}
+	var last Position
+
+	for _, span := range spans {
+		for start := span.start; start < span.end; {
+			end := span.end
+
+			if lineEnd := strings.IndexByte(doc.Text[start:end], '\n'); lineEnd != -1 {
+				end = start + lineEnd
+			}
+
+			text := strings.TrimRight(doc.Text[start:end], "\r")
+
+			if text != "" {
+				pos := doc.Position(start)
+				deltaStart := pos.Character
+
+				if pos.Line == last.Line {
+					deltaStart -= last.Character
+				}
+
+				data = append(data, pos.Line-last.Line, deltaStart, utf16Len(text), span.tokenType, 0)
+				last = pos
+			}
+
+			start = end + 1
+		}
+	}
+
+	return SemanticTokens{Data: data}
+}
+
+// walkRules calls visit for every rule match in result, outermost first.
+func walkRules(result common.EvaluateResult, visit func(common.RuleResult)) {
+	switch result := result.(type) {
+	case common.RuleResult:
+		visit(result)
+		walkRules(result.Result(), visit)
+	case common.MultipleResult:
+		for _, item := range result.Results() {
+			walkRules(item, visit)
+		}
+	}
+}
+
+// ruleSpan returns the offsets of the text a rule matched, leaving out the whitespace
+// before it.
+func ruleSpan(rule common.RuleResult) (start, end int) {
+	end = rule.Remaining().Pos()
+	start = min(rule.Start().FromFirstNotMatching(" \t\f\v\r\n").Pos(), end)
+
+	return start, end
+}
@@ -0,0 +1,207 @@
+package lsp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/l-donovan/parsley"
+)
+
+const iniGrammar = `input: section*
+section: "[" name "]" pair*
+pair: key "=" string
+key: /[a-z]+/
+name: /[a-z]+/
+string: /"[^"]*"/
+`
+
+func startINIServer(t *testing.T) *testClient {
+	t.Helper()
+
+	grammar, err := parsley.ParseGrammar(iniGrammar)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DSLOptions{
+		Symbols: map[string]SymbolRule{"section": {NameRule: "name"}, "pair": {NameRule: "key", Kind: SymbolKindProperty}},
+		Tokens:  map[string]string{"key": "property"},
+	}
+
+	c := startServer(t, NewDSLServer("test", grammar, opts))
+
+	var init InitializeResult
+
+	if err := c.request("initialize", map[string]any{}, &init); err != nil {
+		t.Fatal(err)
+	}
+
+	if init.ServerInfo.Name != "test" || init.Capabilities["documentSymbolProvider"] != true {
+		t.Fatalf("got %+v", init)
+	}
+
+	return c
+}
+
+func TestDSLServerSession(t *testing.T) {
+	c := startINIServer(t)
+	uri := "file:///settings.ini"
+	doc := TextDocumentParams{TextDocument: TextDocumentIdentifier{uri}}
+
+	c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{
+		URI:        uri,
+		LanguageID: "ini",
+		Version:    1,
+		Text:       "[alpha]\nx = \"1\"\ny = \"2\"\n[beta]\nz = \"é\"\n",
+	}})
+
+	var published PublishDiagnosticsParams
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	if published.URI != uri || *published.Version != 1 || len(published.Diagnostics) != 0 {
+		t.Errorf("got diagnostics %+v for a document that parses", published)
+	}
+
+	var symbols []DocumentSymbol
+
+	if err := c.request("textDocument/documentSymbol", doc, &symbols); err != nil {
+		t.Fatal(err)
+	}
+
+	pair := func(name string, line int) DocumentSymbol {
+		return DocumentSymbol{
+			Name:           name,
+			Detail:         "pair",
+			Kind:           SymbolKindProperty,
+			Range:          Range{Position{line, 0}, Position{line, 7}},
+			SelectionRange: Range{Position{line, 0}, Position{line, 1}},
+		}
+	}
+
+	wantSymbols := []DocumentSymbol{
+		{
+			Name:           "alpha",
+			Detail:         "section",
+			Kind:           SymbolKindObject,
+			Range:          Range{Position{0, 0}, Position{2, 7}},
+			SelectionRange: Range{Position{0, 1}, Position{0, 6}},
+			Children:       []DocumentSymbol{pair("x", 1), pair("y", 2)},
+		},
+		{
+			Name:           "beta",
+			Detail:         "section",
+			Kind:           SymbolKindObject,
+			Range:          Range{Position{3, 0}, Position{4, 7}},
+			SelectionRange: Range{Position{3, 1}, Position{3, 5}},
+			Children:       []DocumentSymbol{pair("z", 4)},
+		},
+	}
+
+	if !reflect.DeepEqual(symbols, wantSymbols) {
+		t.Errorf("got symbols\n\t%+v\nwant\n\t%+v", symbols, wantSymbols)
+	}
+
+	var folds []FoldingRange
+
+	if err := c.request("textDocument/foldingRange", doc, &folds); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []FoldingRange{{StartLine: 0, EndLine: 2}, {StartLine: 3, EndLine: 4}}; !reflect.DeepEqual(folds, want) {
+		t.Errorf("got folding ranges %+v, want %+v", folds, want)
+	}
+
+	var tokens SemanticTokens
+
+	if err := c.request("textDocument/semanticTokens/full", doc, &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are properties and strings are strings. "é" is three UTF-16 code units long.
+	wantTokens := []int{
+		1, 0, 1, 9, 0, 0, 4, 3, 18, 0,
+		1, 0, 1, 9, 0, 0, 4, 3, 18, 0,
+		2, 0, 1, 9, 0, 0, 4, 3, 18, 0,
+	}
+
+	if !reflect.DeepEqual(tokens.Data, wantTokens) {
+		t.Errorf("got semantic tokens %v, want %v", tokens.Data, wantTokens)
+	}
+
+	// Taking the quotes off "2" breaks the document
+	change := Range{Position{2, 4}, Position{2, 7}}
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{uri, 2},
+		ContentChanges: []TextDocumentContentChangeEvent{{Range: &change, Text: "2"}},
+	})
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	wantDiagnostics := []Diagnostic{{
+		Range:    Range{Position{2, 4}, Position{2, 5}},
+		Severity: SeverityError,
+		Code:     parsley.RuleSyntaxError,
+		Source:   "parsley",
+		Message:  "unknown token",
+	}}
+
+	if *published.Version != 2 || !reflect.DeepEqual(published.Diagnostics, wantDiagnostics) {
+		t.Errorf("got diagnostics %+v, want %+v", published.Diagnostics, wantDiagnostics)
+	}
+
+	// A document that doesn't parse has no symbols
+	if err := c.request("textDocument/documentSymbol", doc, &symbols); err != nil || len(symbols) != 0 {
+		t.Errorf("got symbols %+v, %v", symbols, err)
+	}
+
+	// Putting them back fixes it, and the whole text can be replaced too
+	change = Range{Position{2, 4}, Position{2, 5}}
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument: VersionedTextDocumentIdentifier{uri, 3},
+		ContentChanges: []TextDocumentContentChangeEvent{
+			{Range: &change, Text: "\"2\""},
+			{Text: "[gamma]\n"},
+		},
+	})
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	if *published.Version != 3 || len(published.Diagnostics) != 0 {
+		t.Errorf("got diagnostics %+v after fixing the document", published)
+	}
+
+	if err := c.request("textDocument/documentSymbol", doc, &symbols); err != nil || len(symbols) != 1 || symbols[0].Name != "gamma" {
+		t.Errorf("got symbols %+v, %v", symbols, err)
+	}
+
+	c.notify("textDocument/didClose", DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{uri}})
+
+	var responseErr *ResponseError
+
+	if err := c.request("textDocument/documentSymbol", doc, &symbols); !errors.As(err, &responseErr) || responseErr.Code != CodeInvalidParams {
+		t.Errorf("got error %v for a closed document, want invalid params", err)
+	}
+
+	if err := c.request("textDocument/hover", doc, nil); !errors.As(err, &responseErr) || responseErr.Code != CodeMethodNotFound {
+		t.Errorf("got error %v for an unsupported method, want method not found", err)
+	}
+
+	if err := c.shutdown(); err != nil {
+		t.Errorf("got error %v from Serve after shutting down", err)
+	}
+}
+
+func TestServerExitWithoutShutdown(t *testing.T) {
+	c := startINIServer(t)
+	c.notify("exit", nil)
+
+	select {
+	case err := <-c.served:
+		if err == nil {
+			t.Error("Serve returned nil when the client exited without shutting the server down")
+		}
+	case <-time.After(clientTimeout):
+		t.Fatal("timed out waiting for the server to exit")
+	}
+}
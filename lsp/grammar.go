@@ -0,0 +1,639 @@
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/l-donovan/parsley"
+	"github.com/l-donovan/parsley/common"
+)
+
+// builtinKeywords are the keywords that look like rule names but aren't.
+var builtinKeywords = []string{"NEWLINE", "INDENT", "DEDENT"}
+
+var ruleNamePattern = regexp.MustCompile(`^[\w_]+$`)
+
+type grammarServer struct {
+	*Server
+	indexes map[string]*grammarIndex
+}
+
+// grammarIndex is what a grammar file defines and refers to, as of a version of it.
+type grammarIndex struct {
+	version int
+	file    common.Expression
+	rules   map[string]ruleDef
+	refs    []ruleRef
+}
+
+// ruleDef is a rule or rule template as it is defined in a grammar file.
+type ruleDef struct {
+	name      string
+	uri       string
+	nameRange Range
+
+	// start and end are the offsets of the rule's name in its file.
+	start, end int
+
+	// source is the rule as written, and comments are the comment lines right before it.
+	source   string
+	comments []string
+}
+
+// ruleRef is a reference to a rule or a rule template, at the given offsets.
+type ruleRef struct {
+	name       string
+	start, end int
+}
+
+// NewGrammarServer returns a language server for parsley grammar files. It publishes
+// problems that reading or validating a grammar turns up as diagnostics, and supports going
+// to the definition of a rule, finding references to it, renaming it, hovering over it to
+// see its definition and completing rule names.
+//
+// Definitions are looked up in the files a grammar imports and extends as well, which are
+// read from disk unless they are open. References only cover the file a request is about.
+// Renaming a rule also renames it in the open files that import or extend the file it's
+// in.
+func NewGrammarServer(name string) *Server {
+	g := &grammarServer{Server: NewServer(name), indexes: map[string]*grammarIndex{}}
+
+	g.OnChange(func(doc *Document, _ []parsley.Edit) { g.check(doc) })
+	g.OnClose(func(uri string) { delete(g.indexes, uri) })
+
+	g.SetCapability("definitionProvider", true)
+	g.SetCapability("referencesProvider", true)
+	g.SetCapability("renameProvider", true)
+	g.SetCapability("hoverProvider", true)
+	g.SetCapability("completionProvider", map[string]any{})
+
+	g.Handle("textDocument/definition", g.definition)
+	g.Handle("textDocument/references", g.references)
+	g.Handle("textDocument/rename", g.rename)
+	g.Handle("textDocument/hover", g.hover)
+	g.Handle("textDocument/completion", g.completion)
+
+	return g.Server
+}
+
+// check reads doc as a grammar, and publishes everything that is wrong with it.
+func (g *grammarServer) check(doc *Document) {
+	name := documentName(doc.URI)
+	index, err := indexGrammar(doc.URI, name, doc.Text)
+
+	if err != nil {
+		g.PublishDiagnostics(doc, []Diagnostic{grammarErrorDiagnostic(doc, name, err)})
+		return
+	}
+
+	index.version = doc.Version
+	g.indexes[doc.URI] = index
+
+	var grammar *parsley.Grammar
+
+	if dir, isFile := documentDir(doc.URI); isFile {
+		grammar, err = parsley.ParseGrammarFS(overlayFS{g.Server, dir}, name)
+	} else {
+		grammar, err = parsley.ParseGrammar(doc.Text)
+	}
+
+	if err != nil {
+		g.PublishDiagnostics(doc, []Diagnostic{grammarErrorDiagnostic(doc, name, err)})
+		return
+	}
+
+	var diagnostics []Diagnostic
+
+	for _, diagnostic := range grammar.Validate() {
+		// A file without an input rule is only meant to be imported
+		if _, hasStart := index.rules["input"]; diagnostic.RuleID == parsley.RuleMissingStart && !hasStart {
+			continue
+		}
+
+		// Problems in other files are shown when those are open
+		if diagnostic.Span != nil && diagnostic.Span.File != name && diagnostic.Span.File != "" {
+			continue
+		}
+
+		diagnostics = append(diagnostics, convertDiagnostic(diagnostic))
+	}
+
+	g.PublishDiagnostics(doc, diagnostics)
+}
+
+// grammarErrorDiagnostic converts an error from reading the grammar in doc into a
+// Diagnostic. Errors in other files, like the ones it imports, are shown at the start.
+func grammarErrorDiagnostic(doc *Document, name string, err error) Diagnostic {
+	var grammarErr parsley.GrammarError
+
+	if errors.As(err, &grammarErr) && grammarErr.Loc.File == name {
+		pos := grammarErr.Loc.Pos
+		return Diagnostic{Range: doc.Range(pos, pos), Severity: SeverityError, Code: parsley.RuleGrammarError, Source: "parsley", Message: grammarErr.Err.Error()}
+	}
+
+	return Diagnostic{Severity: SeverityError, Code: parsley.RuleGrammarError, Source: "parsley", Message: err.Error()}
+}
+
+func convertDiagnostic(diagnostic parsley.Diagnostic) Diagnostic {
+	converted := Diagnostic{Severity: SeverityError, Code: diagnostic.RuleID, Source: "parsley", Message: diagnostic.Message}
+
+	if diagnostic.Severity == parsley.SeverityWarning {
+		converted.Severity = SeverityWarning
+	}
+
+	if span := diagnostic.Span; span != nil && span.Start.Line > 0 {
+		converted.Range = Range{
+			Position{span.Start.Line - 1, span.Start.UTF16Column},
+			Position{span.End.Line - 1, span.End.UTF16Column},
+		}
+	}
+
+	return converted
+}
+
+// indexGrammar reads the grammar file at uri, called name, and finds its rules and the
+// references to them.
+func indexGrammar(uri, name, text string) (*grammarIndex, error) {
+	fileExpr, err := parsley.ParseGrammarFile(name, text)
+
+	if err != nil {
+		return nil, err
+	}
+
+	index := &grammarIndex{file: fileExpr, rules: map[string]ruleDef{}}
+
+	for _, rule := range fileExpr.Values["rules"].([]common.Expression) {
+		ruleName := rule.Values["name"].(string)
+		loc := rule.Values["loc"].(common.StringPos)
+		end := rule.Values["end"].(common.StringPos)
+
+		index.rules[ruleName] = ruleDef{
+			name:      ruleName,
+			uri:       uri,
+			nameRange: Range{Position{loc.Line, loc.UTF16Col}, Position{loc.Line, loc.UTF16Col + len(ruleName)}},
+			start:     loc.Pos,
+			end:       loc.Pos + len(ruleName),
+			source:    strings.TrimSpace(text[loc.Pos:end.Pos]),
+			comments:  commentsBefore(text, loc.Pos),
+		}
+
+		// Template parameters look like rules, but only stand for the arguments
+		params, _ := rule.Values["params"].([]string)
+
+		for _, expr := range rule.Values["contents"].([]common.Expression) {
+			walkExpression(expr, func(expr common.Expression) {
+				var ref string
+
+				switch expr.Definition {
+				case &parsley.RuleRef:
+					ref = expr.Values["ref"].(string)
+				case &parsley.MacroCall:
+					ref = expr.Values["name"].(string)
+				default:
+					return
+				}
+
+				if loc, found := expr.Values["loc"].(common.StringPos); found && !slices.Contains(params, ref) {
+					index.refs = append(index.refs, ruleRef{ref, loc.Pos, loc.Pos + len(ref)})
+				}
+			})
+		}
+	}
+
+	return index, nil
+}
+
+// commentsBefore returns the text of the comment lines right before the line that offset is
+// on.
+func commentsBefore(text string, offset int) []string {
+	var comments []string
+	lineStart := strings.LastIndexByte(text[:offset], '\n') + 1
+
+	for lineStart > 0 {
+		prevStart := strings.LastIndexByte(text[:lineStart-1], '\n') + 1
+		line := strings.TrimSpace(text[prevStart : lineStart-1])
+
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+
+		comments = append([]string{strings.TrimSpace(strings.TrimPrefix(line, "#"))}, comments...)
+		lineStart = prevStart
+	}
+
+	return comments
+}
+
+func walkExpression(expr common.Expression, visit func(common.Expression)) {
+	visit(expr)
+
+	// Going through the values in order keeps references in the same order every time
+	for _, key := range slices.Sorted(maps.Keys(expr.Values)) {
+		switch val := expr.Values[key].(type) {
+		case common.Expression:
+			walkExpression(val, visit)
+		case []common.Expression:
+			for _, subExpr := range val {
+				walkExpression(subExpr, visit)
+			}
+		}
+	}
+}
+
+// definitions returns every rule that can be referred to from the file that index is for,
+// including the ones it imports and extends.
+func (g *grammarServer) definitions(uri string, index *grammarIndex) map[string]ruleDef {
+	defs := map[string]ruleDef{}
+
+	if dir, isFile := documentDir(uri); isFile {
+		g.addExternal(defs, dir, index.file, map[string]bool{})
+	}
+
+	maps.Copy(defs, index.rules)
+
+	return defs
+}
+
+// addExternal adds the rules that fileExpr imports and extends to defs, the way the grammar
+// loader names them. Files that can't be read are left out, since checking the file will
+// have said what's wrong with them.
+func (g *grammarServer) addExternal(defs map[string]ruleDef, dir string, fileExpr common.Expression, seen map[string]bool) {
+	load := func(relPath string) (map[string]ruleDef, bool) {
+		filePath := filepath.Join(dir, filepath.FromSlash(relPath))
+
+		if seen[filePath] {
+			return nil, false
+		}
+
+		seen[filePath] = true
+		text, err := g.readFile(filePath)
+
+		if err != nil {
+			return nil, false
+		}
+
+		index, err := indexGrammar(pathToURI(filePath), path.Base(relPath), text)
+
+		if err != nil {
+			return nil, false
+		}
+
+		loaded := map[string]ruleDef{}
+		g.addExternal(loaded, filepath.Dir(filePath), index.file, seen)
+		maps.Copy(loaded, index.rules)
+
+		return loaded, true
+	}
+
+	if extends, ok := fileExpr.Values["extends"].(common.Expression); ok {
+		if parentDefs, loaded := load(extends.Values["path"].(string)); loaded {
+			for name, def := range parentDefs {
+				defs[name] = def
+				defs["super."+name] = def
+			}
+		}
+	}
+
+	imports, _ := fileExpr.Values["imports"].([]common.Expression)
+
+	for _, imp := range imports {
+		importedDefs, loaded := load(imp.Values["path"].(string))
+
+		if !loaded {
+			continue
+		}
+
+		prefix := ""
+
+		if namespace, ok := imp.Values["namespace"].(string); ok {
+			prefix = namespace + "."
+		}
+
+		for name, def := range importedDefs {
+			defs[prefix+name] = def
+		}
+	}
+}
+
+// readFile returns the contents of the file at filePath, as it is in the editor if it's
+// open there.
+func (g *grammarServer) readFile(filePath string) (string, error) {
+	if doc := g.Document(pathToURI(filePath)); doc != nil {
+		return doc.Text, nil
+	}
+
+	contents, err := os.ReadFile(filePath)
+	return string(contents), err
+}
+
+// nameAt returns the rule name at pos in the document a request is about, along with the
+// offsets it's at.
+func (g *grammarServer) nameAt(params TextDocumentPositionParams) (*Document, *grammarIndex, ruleRef, error) {
+	doc := g.Document(params.TextDocument.URI)
+	index := g.indexes[params.TextDocument.URI]
+
+	if doc == nil {
+		return nil, nil, ruleRef{}, &ResponseError{CodeInvalidParams, params.TextDocument.URI + " isn't open"}
+	}
+
+	if index == nil {
+		return doc, nil, ruleRef{}, nil
+	}
+
+	// The index can be from an older version if the document doesn't read right now, in
+	// which case offsets are only looked up if they're still in range
+	offset := doc.Offset(params.Position)
+
+	for _, ref := range index.refs {
+		if ref.start <= offset && offset <= ref.end {
+			return doc, index, ref, nil
+		}
+	}
+
+	for _, def := range index.rules {
+		if def.start <= offset && offset <= def.end {
+			return doc, index, ruleRef{def.name, def.start, def.end}, nil
+		}
+	}
+
+	return doc, index, ruleRef{}, nil
+}
+
+func (g *grammarServer) definition(params json.RawMessage) (any, error) {
+	var p TextDocumentPositionParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	_, index, ref, err := g.nameAt(p)
+
+	if err != nil || ref.name == "" {
+		return nil, err
+	}
+
+	def, found := g.definitions(p.TextDocument.URI, index)[ref.name]
+
+	if !found {
+		return nil, nil
+	}
+
+	return Location{def.uri, def.nameRange}, nil
+}
+
+func (g *grammarServer) references(params json.RawMessage) (any, error) {
+	var p ReferenceParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, index, ref, err := g.nameAt(p.TextDocumentPositionParams)
+
+	if err != nil || ref.name == "" {
+		return []Location{}, err
+	}
+
+	locations := []Location{}
+
+	if def, found := index.rules[ref.name]; found && p.Context.IncludeDeclaration {
+		locations = append(locations, Location{doc.URI, def.nameRange})
+	}
+
+	for _, other := range index.refs {
+		if other.name == ref.name {
+			locations = append(locations, Location{doc.URI, doc.Range(other.start, other.end)})
+		}
+	}
+
+	return locations, nil
+}
+
+func (g *grammarServer) rename(params json.RawMessage) (any, error) {
+	var p RenameParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, index, ref, err := g.nameAt(p.TextDocumentPositionParams)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ref.name == "":
+		return nil, &ResponseError{CodeRequestFailed, "there is no rule here to rename"}
+	case index.version != doc.Version:
+		return nil, &ResponseError{CodeRequestFailed, "the grammar has to read correctly before rules can be renamed"}
+	case !ruleNamePattern.MatchString(p.NewName) || slices.Contains(builtinKeywords, p.NewName):
+		return nil, &ResponseError{CodeInvalidParams, fmt.Sprintf("%q can't be the name of a rule", p.NewName)}
+	}
+
+	def, found := index.rules[ref.name]
+
+	if !found {
+		return nil, &ResponseError{CodeRequestFailed, fmt.Sprintf("rule %s isn't defined in this file", ref.name)}
+	}
+
+	if _, taken := g.definitions(doc.URI, index)[p.NewName]; taken {
+		return nil, &ResponseError{CodeRequestFailed, fmt.Sprintf("there is already a rule called %s", p.NewName)}
+	}
+
+	edits := []TextEdit{{def.nameRange, p.NewName}}
+
+	for _, other := range index.refs {
+		if other.name == ref.name {
+			edits = append(edits, TextEdit{doc.Range(other.start, other.end), p.NewName})
+		}
+	}
+
+	changes := map[string][]TextEdit{doc.URI: edits}
+
+	for uri, dependentIndex := range g.indexes {
+		if uri == doc.URI {
+			continue
+		}
+
+		dependentEdits, err := g.renameIn(g.Document(uri), dependentIndex, def, p.NewName)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(dependentEdits) > 0 {
+			changes[uri] = dependentEdits
+		}
+	}
+
+	return WorkspaceEdit{Changes: changes}, nil
+}
+
+// renameIn returns the edits that renaming def to newName takes in another open document,
+// which can refer to it if it imports or extends the file def is in. There it goes by
+// whatever names the imports give it, like `namespace.name` or `super.name`.
+func (g *grammarServer) renameIn(doc *Document, index *grammarIndex, def ruleDef, newName string) ([]TextEdit, error) {
+	defs := g.definitions(doc.URI, index)
+	prefixes := map[string]string{}
+
+	for name, other := range defs {
+		if other.uri == def.uri && other.name == def.name {
+			prefixes[name] = strings.TrimSuffix(name, def.name)
+		}
+	}
+
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+
+	file := documentName(doc.URI)
+
+	if index.version != doc.Version {
+		return nil, &ResponseError{CodeRequestFailed, fmt.Sprintf("%s uses rule %s, and has to read correctly before it can be renamed", file, def.name)}
+	}
+
+	// A rule of the same name in a file that extends this one takes its place, which it
+	// wouldn't any more after the rename
+	if _, overridden := index.rules[def.name]; overridden && prefixes["super."+def.name] == "super." {
+		return nil, &ResponseError{CodeRequestFailed, fmt.Sprintf("rule %s is overridden in %s", def.name, file)}
+	}
+
+	for _, prefix := range prefixes {
+		if _, taken := defs[prefix+newName]; taken {
+			return nil, &ResponseError{CodeRequestFailed, fmt.Sprintf("there is already a rule called %s in %s", prefix+newName, file)}
+		}
+	}
+
+	var edits []TextEdit
+
+	for _, ref := range index.refs {
+		if prefix, found := prefixes[ref.name]; found {
+			edits = append(edits, TextEdit{doc.Range(ref.start, ref.end), prefix + newName})
+		}
+	}
+
+	return edits, nil
+}
+
+func (g *grammarServer) hover(params json.RawMessage) (any, error) {
+	var p TextDocumentPositionParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, index, ref, err := g.nameAt(p)
+
+	if err != nil || ref.name == "" {
+		return nil, err
+	}
+
+	def, found := g.definitions(doc.URI, index)[ref.name]
+
+	if !found {
+		return nil, nil
+	}
+
+	var contents strings.Builder
+	contents.WriteString("```\n" + def.source + "\n```")
+
+	if len(def.comments) > 0 {
+		contents.WriteString("\n\n" + strings.Join(def.comments, "\n"))
+	}
+
+	if def.uri != doc.URI {
+		contents.WriteString("\n\nDefined in " + path.Base(def.uri))
+	}
+
+	refRange := doc.Range(ref.start, ref.end)
+
+	return Hover{MarkupContent{"markdown", contents.String()}, &refRange}, nil
+}
+
+func (g *grammarServer) completion(params json.RawMessage) (any, error) {
+	var p TextDocumentPositionParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	items := []CompletionItem{}
+	index := g.indexes[p.TextDocument.URI]
+
+	if index != nil {
+		defs := g.definitions(p.TextDocument.URI, index)
+
+		for _, name := range slices.Sorted(maps.Keys(defs)) {
+			items = append(items, CompletionItem{Label: name, Kind: CompletionItemKindFunction, Detail: firstLine(defs[name].source, 80)})
+		}
+	}
+
+	for _, keyword := range builtinKeywords {
+		items = append(items, CompletionItem{Label: keyword, Kind: CompletionItemKindKeyword})
+	}
+
+	return items, nil
+}
+
+// overlayFS is the directory dir, where the files that are open in the server read the way
+// they are in the editor.
+type overlayFS struct {
+	server *Server
+	dir    string
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	return os.DirFS(o.dir).Open(name)
+}
+
+// ReadFile is what the grammar loader reads files with, so it's the only way of reading
+// files that sees open documents.
+func (o overlayFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	filePath := filepath.Join(o.dir, filepath.FromSlash(name))
+
+	if doc := o.server.Document(pathToURI(filePath)); doc != nil {
+		return []byte(doc.Text), nil
+	}
+
+	return os.ReadFile(filePath)
+}
+
+// documentName returns the name a document goes by in error messages, which is its file
+// name.
+func documentName(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Path != "" {
+		return path.Base(u.Path)
+	}
+
+	return uri
+}
+
+// documentDir returns the directory that the file at uri is in, if it's a file.
+func documentDir(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+
+	return filepath.Dir(filepath.FromSlash(u.Path)), true
+}
+
+func pathToURI(filePath string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filePath)}).String()
+}
@@ -0,0 +1,348 @@
+package lsp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/l-donovan/parsley"
+)
+
+const mainGrammar = `import "lexer.parsley"
+input: list(word)
+list(x): x ("," x)*
+word: name
+unused: number
+`
+
+// startGrammarServer starts a grammar server with lexer.parsley written to a directory,
+// and main.parsley from the same directory open in it.
+func startGrammarServer(t *testing.T) (*testClient, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "lexer.parsley"), []byte("# A run of letters\nname: /[a-z]+/\nnumber: /[0-9]+/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := startServer(t, NewGrammarServer("test"))
+
+	if err := c.request("initialize", map[string]any{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := pathToURI(filepath.Join(dir, "main.parsley"))
+	c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, LanguageID: "parsley", Version: 1, Text: mainGrammar}})
+
+	return c, uri
+}
+
+func at(uri string, line, character int) TextDocumentPositionParams {
+	return TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{uri}, Position: Position{line, character}}
+}
+
+func TestGrammarServerDiagnostics(t *testing.T) {
+	c, uri := startGrammarServer(t)
+
+	var published PublishDiagnosticsParams
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	want := []Diagnostic{{
+		Range:    Range{Position{4, 0}, Position{4, 6}},
+		Severity: SeverityWarning,
+		Code:     parsley.RuleUnusedRule,
+		Source:   "parsley",
+		Message:  "rule unused is never used",
+	}}
+
+	if !reflect.DeepEqual(published.Diagnostics, want) {
+		t.Errorf("got diagnostics %+v, want %+v", published.Diagnostics, want)
+	}
+
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{uri, 2},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "import \"lexer.parsley\"\ninput: word\nword: (name\n"}},
+	})
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	want = []Diagnostic{{
+		Range:    Range{Position{2, 11}, Position{2, 11}},
+		Severity: SeverityError,
+		Code:     parsley.RuleGrammarError,
+		Source:   "parsley",
+		Message:  "error when parsing contents for rule word: unexpected token of type Newline",
+	}}
+
+	if !reflect.DeepEqual(published.Diagnostics, want) {
+		t.Errorf("got diagnostics %+v, want %+v", published.Diagnostics, want)
+	}
+
+	// Rules can't be renamed while the file doesn't read
+	var responseErr *ResponseError
+
+	if err := c.request("textDocument/rename", RenameParams{at(uri, 1, 8), "item"}, nil); !errors.As(err, &responseErr) {
+		t.Errorf("got error %v renaming in a file that doesn't read", err)
+	}
+
+	// Undefined rules are errors at the reference
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{uri, 3},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "import \"lexer.parsley\"\ninput: word\nword: nam\n"}},
+	})
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	want = []Diagnostic{{
+		Range:    Range{Position{2, 6}, Position{2, 9}},
+		Severity: SeverityError,
+		Code:     parsley.RuleUndefinedRule,
+		Source:   "parsley",
+		Message:  "rule word refers to nam, which isn't defined",
+	}}
+
+	if !reflect.DeepEqual(published.Diagnostics, want) {
+		t.Errorf("got diagnostics %+v, want %+v", published.Diagnostics, want)
+	}
+
+	if err := c.shutdown(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGrammarServerNavigation(t *testing.T) {
+	c, uri := startGrammarServer(t)
+	dir, _ := documentDir(uri)
+	lexerURI := pathToURI(filepath.Join(dir, "lexer.parsley"))
+
+	var location Location
+
+	// Definitions can be in imported files
+	if err := c.request("textDocument/definition", at(uri, 3, 7), &location); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (Location{lexerURI, Range{Position{1, 0}, Position{1, 4}}}); location != want {
+		t.Errorf("got definition %+v, want %+v", location, want)
+	}
+
+	if err := c.request("textDocument/definition", at(uri, 1, 14), &location); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (Location{uri, Range{Position{3, 0}, Position{3, 4}}}); location != want {
+		t.Errorf("got definition %+v, want %+v", location, want)
+	}
+
+	var locations []Location
+	params := ReferenceParams{TextDocumentPositionParams: at(uri, 3, 1)}
+	params.Context.IncludeDeclaration = true
+
+	if err := c.request("textDocument/references", params, &locations); err != nil {
+		t.Fatal(err)
+	}
+
+	wantLocations := []Location{{uri, Range{Position{3, 0}, Position{3, 4}}}, {uri, Range{Position{1, 12}, Position{1, 16}}}}
+
+	if !reflect.DeepEqual(locations, wantLocations) {
+		t.Errorf("got references %+v, want %+v", locations, wantLocations)
+	}
+
+	var hover Hover
+
+	if err := c.request("textDocument/hover", at(uri, 3, 7), &hover); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "```\nname: /[a-z]+/\n```\n\nA run of letters\n\nDefined in lexer.parsley"; hover.Contents.Value != want {
+		t.Errorf("got hover %q, want %q", hover.Contents.Value, want)
+	}
+
+	var items []CompletionItem
+
+	if err := c.request("textDocument/completion", at(uri, 4, 8), &items); err != nil {
+		t.Fatal(err)
+	}
+
+	var labels []string
+
+	for _, item := range items {
+		labels = append(labels, item.Label)
+	}
+
+	if want := []string{"input", "list", "name", "number", "unused", "word", "NEWLINE", "INDENT", "DEDENT"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("got completions %v, want %v", labels, want)
+	}
+
+	if err := c.shutdown(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGrammarServerRename(t *testing.T) {
+	c, uri := startGrammarServer(t)
+
+	var edit WorkspaceEdit
+
+	if err := c.request("textDocument/rename", RenameParams{at(uri, 1, 13), "item"}, &edit); err != nil {
+		t.Fatal(err)
+	}
+
+	want := WorkspaceEdit{Changes: map[string][]TextEdit{uri: {
+		{Range{Position{3, 0}, Position{3, 4}}, "item"},
+		{Range{Position{1, 12}, Position{1, 16}}, "item"},
+	}}}
+
+	if !reflect.DeepEqual(edit, want) {
+		t.Errorf("got edit %+v, want %+v", edit, want)
+	}
+
+	var responseErr *ResponseError
+
+	for _, tc := range []struct {
+		name    string
+		params  RenameParams
+		wantErr string
+	}{
+		{"name that is taken", RenameParams{at(uri, 3, 1), "name"}, "there is already a rule called name"},
+		{"name that isn't a rule name", RenameParams{at(uri, 3, 1), "a b"}, `"a b" can't be the name of a rule`},
+		{"keyword", RenameParams{at(uri, 3, 1), "INDENT"}, `"INDENT" can't be the name of a rule`},
+		{"rule from another file", RenameParams{at(uri, 3, 7), "letters"}, "rule name isn't defined in this file"},
+		{"nothing to rename", RenameParams{at(uri, 0, 0), "letters"}, "there is no rule here to rename"},
+	} {
+		if err := c.request("textDocument/rename", tc.params, nil); !errors.As(err, &responseErr) || responseErr.Message != tc.wantErr {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+
+	if err := c.shutdown(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGrammarServerRenameAcrossFiles(t *testing.T) {
+	c, uri := startGrammarServer(t)
+	dir, _ := documentDir(uri)
+
+	// Each document that is opened or changed gets its diagnostics, which have to be read
+	// for the server to go on
+	var published PublishDiagnosticsParams
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	open := func(name, text string) string {
+		fileURI := pathToURI(filepath.Join(dir, name))
+		c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: fileURI, LanguageID: "parsley", Version: 1, Text: text}})
+		c.notification("textDocument/publishDiagnostics", &published)
+		return fileURI
+	}
+
+	lexerURI := open("lexer.parsley", "# A run of letters\nname: /[a-z]+/\nnumber: /[0-9]+/\n")
+	nsURI := open("ns.parsley", "import \"lexer.parsley\" as lex\ninput: lex.name lex.number\n")
+
+	var edit WorkspaceEdit
+
+	if err := c.request("textDocument/rename", RenameParams{at(lexerURI, 1, 1), "letters"}, &edit); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files that import the rule refer to it by whatever name the import gives it
+	want := WorkspaceEdit{Changes: map[string][]TextEdit{
+		lexerURI: {{Range{Position{1, 0}, Position{1, 4}}, "letters"}},
+		uri:      {{Range{Position{3, 6}, Position{3, 10}}, "letters"}},
+		nsURI:    {{Range{Position{1, 7}, Position{1, 15}}, "lex.letters"}},
+	}}
+
+	if !reflect.DeepEqual(edit, want) {
+		t.Errorf("got edit %+v, want %+v", edit, want)
+	}
+
+	open("child.parsley", "extend \"lexer.parsley\"\nname: <super.name /[0-9]+/>\n")
+
+	var responseErr *ResponseError
+
+	for _, tc := range []struct {
+		name    string
+		params  RenameParams
+		wantErr string
+	}{
+		{"name that is taken in a file that imports the rule", RenameParams{at(lexerURI, 2, 1), "word"}, "there is already a rule called word in main.parsley"},
+		{"rule that is overridden", RenameParams{at(lexerURI, 1, 1), "letters"}, "rule name is overridden in child.parsley"},
+	} {
+		if err := c.request("textDocument/rename", tc.params, nil); !errors.As(err, &responseErr) || responseErr.Message != tc.wantErr {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+
+	// A file that uses the rule has to read to be sure where it does
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{nsURI, 2},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "import \"lexer.parsley\" as lex\ninput: (lex.number\n"}},
+	})
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	wantErr := "ns.parsley uses rule number, and has to read correctly before it can be renamed"
+
+	if err := c.request("textDocument/rename", RenameParams{at(lexerURI, 2, 1), "digits"}, nil); !errors.As(err, &responseErr) || responseErr.Message != wantErr {
+		t.Errorf("got error %v, want %q", err, wantErr)
+	}
+
+	if err := c.shutdown(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGrammarServerRenameReferences(t *testing.T) {
+	c, uri := startGrammarServer(t)
+	dir, _ := documentDir(uri)
+
+	var published PublishDiagnosticsParams
+	c.notification("textDocument/publishDiagnostics", &published)
+
+	for _, tc := range []struct {
+		name string
+		text string
+		want []Range
+	}{
+		{
+			name: "rule name right before a group, which is written like a template call",
+			text: "input: name(\";\" name)*\nname: /[a-z]+/\n",
+			want: []Range{{Position{0, 7}, Position{0, 11}}, {Position{0, 16}, Position{0, 20}}},
+		},
+		{
+			name: "references in the order they're written",
+			text: "input: sep(name, <name \",\">) | name\nname: /[a-z]+/\n",
+			want: []Range{{Position{0, 11}, Position{0, 15}}, {Position{0, 18}, Position{0, 22}}, {Position{0, 31}, Position{0, 35}}},
+		},
+	} {
+		docURI := pathToURI(filepath.Join(dir, "refs.parsley"))
+		want := []TextEdit{{Range{Position{1, 0}, Position{1, 4}}, "item"}}
+
+		for _, r := range tc.want {
+			want = append(want, TextEdit{r, "item"})
+		}
+
+		// Reading the document more than once shows whether the order changes between reads
+		for version := 1; version <= 10; version++ {
+			c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: docURI, LanguageID: "parsley", Version: version, Text: tc.text}})
+			c.notification("textDocument/publishDiagnostics", &published)
+
+			var edit WorkspaceEdit
+
+			if err := c.request("textDocument/rename", RenameParams{at(docURI, 1, 1), "item"}, &edit); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(edit.Changes[docURI], want) {
+				t.Errorf("%s: got edits %+v, want %+v", tc.name, edit.Changes[docURI], want)
+				break
+			}
+		}
+
+		c.notify("textDocument/didClose", DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{docURI}})
+	}
+
+	if err := c.shutdown(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,305 @@
+// Package lsp implements language servers on top of parsley grammars. Server speaks the
+// protocol and keeps track of open documents, and NewDSLServer and NewGrammarServer set one
+// up for a particular kind of file.
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/l-donovan/parsley"
+)
+
+// Handler answers a request, or handles a notification, with the given params. What it
+// returns is sent back as the result of a request, and ignored for a notification.
+type Handler func(params json.RawMessage) (any, error)
+
+// ChangeFunc is called after a document is opened or changed. edits are the changes made to
+// it since the last call, in order, or nil if it was just opened.
+type ChangeFunc func(doc *Document, edits []parsley.Edit)
+
+// Server is a language server that talks to a single client. It handles the lifecycle of
+// the connection and of documents by itself, and hands everything else to the handlers
+// registered with Handle. Messages are handled one at a time, in the order they arrive.
+type Server struct {
+	name         string
+	capabilities map[string]any
+	handlers     map[string]Handler
+	onChange     ChangeFunc
+	onClose      func(uri string)
+	docs         map[string]*Document
+	conn         *conn
+
+	// Log is where problems that can't be sent to the client go. It defaults to a logger
+	// that writes to stderr, since stdout is usually the connection.
+	Log *log.Logger
+
+	shutdown bool
+}
+
+// errExit is returned by the exit handler to stop serving.
+var errExit = errors.New("exit")
+
+func NewServer(name string) *Server {
+	s := &Server{
+		name:         name,
+		capabilities: map[string]any{},
+		handlers:     map[string]Handler{},
+		docs:         map[string]*Document{},
+		Log:          log.New(os.Stderr, name+": ", log.LstdFlags),
+	}
+
+	s.handlers["initialize"] = s.initialize
+	s.handlers["shutdown"] = func(json.RawMessage) (any, error) {
+		s.shutdown = true
+		return nil, nil
+	}
+	s.handlers["exit"] = func(json.RawMessage) (any, error) {
+		return nil, errExit
+	}
+	s.handlers["textDocument/didOpen"] = s.didOpen
+	s.handlers["textDocument/didChange"] = s.didChange
+	s.handlers["textDocument/didClose"] = s.didClose
+
+	// Documents are kept in sync with every change, so that rules that didn't change can be
+	// reused when parsing them again
+	s.capabilities["textDocumentSync"] = map[string]any{"openClose": true, "change": 2}
+
+	return s
+}
+
+// Handle registers handler for requests and notifications with the given method. It
+// replaces whatever was registered for the method before, including the handlers Server
+// has of its own.
+func (s *Server) Handle(method string, handler Handler) {
+	s.handlers[method] = handler
+}
+
+// SetCapability sets a server capability that is sent to the client when it connects, such
+// as "hoverProvider".
+func (s *Server) SetCapability(name string, value any) {
+	s.capabilities[name] = value
+}
+
+// OnChange sets the function that is called whenever a document is opened or changed.
+func (s *Server) OnChange(fn ChangeFunc) {
+	s.onChange = fn
+}
+
+// OnClose sets the function that is called whenever a document is closed.
+func (s *Server) OnClose(fn func(uri string)) {
+	s.onClose = fn
+}
+
+// Document returns the open document with the given URI, or nil if it isn't open.
+func (s *Server) Document(uri string) *Document {
+	return s.docs[uri]
+}
+
+// Documents returns the open documents, sorted by URI.
+func (s *Server) Documents() []*Document {
+	docs := make([]*Document, 0, len(s.docs))
+
+	for _, uri := range slices.Sorted(maps.Keys(s.docs)) {
+		docs = append(docs, s.docs[uri])
+	}
+
+	return docs
+}
+
+// PublishDiagnostics replaces the diagnostics the client shows for doc.
+func (s *Server) PublishDiagnostics(doc *Document, diagnostics []Diagnostic) {
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+
+	version := doc.Version
+	params := PublishDiagnosticsParams{URI: doc.URI, Version: &version, Diagnostics: diagnostics}
+
+	if err := s.conn.notify("textDocument/publishDiagnostics", params); err != nil {
+		s.Log.Printf("could not publish diagnostics for %s: %v", doc.URI, err)
+	}
+}
+
+// Serve handles messages from r and writes responses to w until the client says to exit or
+// r runs out. It returns nil if the client shut the server down properly first.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.conn = newConn(r, w)
+
+	for {
+		msg, err := s.conn.read()
+
+		if err != nil {
+			var responseErr *ResponseError
+
+			if !errors.As(err, &responseErr) {
+				if errors.Is(err, io.EOF) && s.shutdown {
+					return nil
+				}
+
+				return err
+			}
+
+			// The message couldn't be read, so there's no telling which request it was
+			if err := s.conn.reply(nil, nil, responseErr); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := s.handle(msg); err != nil {
+			if err == errExit {
+				if !s.shutdown {
+					return errors.New("client exited without shutting the server down")
+				}
+
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg *message) error {
+	handler, found := s.handlers[msg.Method]
+
+	if msg.ID == nil {
+		// Unknown notifications, including all of the optional $/ ones, are ignored
+		if !found {
+			return nil
+		}
+
+		if _, err := handler(msg.Params); err != nil {
+			if err == errExit {
+				return err
+			}
+
+			s.Log.Printf("%s: %v", msg.Method, err)
+		}
+
+		return nil
+	}
+
+	switch {
+	case msg.Method == "":
+		return s.conn.reply(msg.ID, nil, &ResponseError{CodeInvalidRequest, "request has no method"})
+	case !found:
+		return s.conn.reply(msg.ID, nil, &ResponseError{CodeMethodNotFound, "method " + msg.Method + " isn't supported"})
+	}
+
+	result, err := handler(msg.Params)
+	return s.conn.reply(msg.ID, result, err)
+}
+
+func (s *Server) initialize(json.RawMessage) (any, error) {
+	return InitializeResult{Capabilities: maps.Clone(s.capabilities), ServerInfo: ServerInfo{Name: s.name}}, nil
+}
+
+func (s *Server) didOpen(params json.RawMessage) (any, error) {
+	var p DidOpenTextDocumentParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc := newDocument(p.TextDocument)
+	s.docs[doc.URI] = doc
+
+	if s.onChange != nil {
+		s.onChange(doc, nil)
+	}
+
+	return nil, nil
+}
+
+func (s *Server) didChange(params json.RawMessage) (any, error) {
+	var p DidChangeTextDocumentParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, found := s.docs[p.TextDocument.URI]
+
+	if !found {
+		return nil, errors.New("change to " + p.TextDocument.URI + ", which isn't open")
+	}
+
+	edits := make([]parsley.Edit, 0, len(p.ContentChanges))
+
+	for _, change := range p.ContentChanges {
+		edit, err := doc.apply(change)
+
+		if err != nil {
+			return nil, err
+		}
+
+		edits = append(edits, edit)
+	}
+
+	doc.Version = p.TextDocument.Version
+
+	if s.onChange != nil {
+		s.onChange(doc, edits)
+	}
+
+	return nil, nil
+}
+
+func (s *Server) didClose(params json.RawMessage) (any, error) {
+	var p DidCloseTextDocumentParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	delete(s.docs, p.TextDocument.URI)
+
+	if s.onClose != nil {
+		s.onClose(p.TextDocument.URI)
+	}
+
+	// The client stops showing diagnostics for closed documents on its own
+	return nil, nil
+}
+
+// textDocument returns the open document a request is about.
+func (s *Server) textDocument(params json.RawMessage) (*Document, error) {
+	var p TextDocumentParams
+
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	doc, found := s.docs[p.TextDocument.URI]
+
+	if !found {
+		return nil, &ResponseError{CodeInvalidParams, p.TextDocument.URI + " isn't open"}
+	}
+
+	return doc, nil
+}
+
+// firstLine returns the first line of text with surrounding whitespace trimmed, cut down to
+// at most limit runes.
+func firstLine(text string, limit int) string {
+	text = strings.TrimSpace(text)
+
+	if end := strings.IndexAny(text, "\r\n"); end != -1 {
+		text = strings.TrimSpace(text[:end])
+	}
+
+	if runes := []rune(text); len(runes) > limit {
+		text = string(runes[:limit-1]) + "…"
+	}
+
+	return text
+}
@@ -0,0 +1,174 @@
+package parsley
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// maxMacroDepth bounds how deeply rule templates can instantiate each other, which catches
+// templates that keep instantiating themselves with ever-larger arguments.
+const maxMacroDepth = 64
+
+// rewriteExpression rebuilds an expression tree bottom-up. Whenever rewrite reports that it
+// replaced an expression, its replacement is used as-is and its children are left alone.
+func rewriteExpression(expr common.Expression, rewrite func(common.Expression) (common.Expression, bool, error)) (common.Expression, error) {
+	replacement, replaced, err := rewrite(expr)
+
+	if err != nil || replaced {
+		return replacement, err
+	}
+
+	values := make(map[string]any, len(expr.Values))
+
+	for key, val := range expr.Values {
+		switch val := val.(type) {
+		case common.Expression:
+			subExpr, err := rewriteExpression(val, rewrite)
+
+			if err != nil {
+				return common.Empty, err
+			}
+
+			values[key] = subExpr
+		case []common.Expression:
+			subExprs, err := rewriteExpressions(val, rewrite)
+
+			if err != nil {
+				return common.Empty, err
+			}
+
+			values[key] = subExprs
+		default:
+			values[key] = val
+		}
+	}
+
+	return common.Expression{Definition: expr.Definition, Values: values}, nil
+}
+
+func rewriteExpressions(exprs []common.Expression, rewrite func(common.Expression) (common.Expression, bool, error)) ([]common.Expression, error) {
+	rewritten := make([]common.Expression, len(exprs))
+
+	for i, expr := range exprs {
+		subExpr, err := rewriteExpression(expr, rewrite)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rewritten[i] = subExpr
+	}
+
+	return rewritten, nil
+}
+
+// macroExpander replaces calls to rule templates with references to instances of those
+// templates. Each distinct instantiation becomes a rule of its own, named after the call
+// that created it, e.g. `delimited("[", item, "]")`.
+type macroExpander struct {
+	templates map[string]common.Expression
+	globals   map[string]any
+	instances []common.Expression
+	depth     int
+}
+
+func (m *macroExpander) expand(expr common.Expression) (common.Expression, error) {
+	return rewriteExpression(expr, m.rewriteCall)
+}
+
+func (m *macroExpander) rewriteCall(expr common.Expression) (common.Expression, bool, error) {
+	if expr.Definition != &MacroCall {
+		return expr, false, nil
+	}
+
+	instance, err := m.instantiate(expr)
+	return instance, true, err
+}
+
+func (m *macroExpander) instantiate(call common.Expression) (common.Expression, error) {
+	name := call.Values["name"].(string)
+	template, found := m.templates[name]
+
+	if !found {
+		return common.Empty, fmt.Errorf("could not find rule template with name %s", name)
+	}
+
+	params := template.Values["params"].([]string)
+	args, err := rewriteExpressions(call.Values["args"].([]common.Expression), m.rewriteCall)
+
+	if err != nil {
+		return common.Empty, err
+	}
+
+	if len(args) != len(params) {
+		return common.Empty, fmt.Errorf("rule template %s takes %d arguments, found %d", name, len(params), len(args))
+	}
+
+	argStrs := make([]string, len(args))
+	bindings := make(map[string]common.Expression, len(args))
+
+	for i, arg := range args {
+		argStr, err := common.Serialize(arg, false, 0)
+
+		if err != nil {
+			return common.Empty, err
+		}
+
+		argStrs[i] = argStr
+		bindings[params[i]] = arg
+	}
+
+	instanceName := fmt.Sprintf("%s(%s)", name, strings.Join(argStrs, ", "))
+	ref := common.Expression{Definition: &RuleRef, Values: map[string]any{"ref": instanceName}}
+
+	if _, found := m.globals[instanceName]; found {
+		return ref, nil
+	}
+
+	if m.depth >= maxMacroDepth {
+		return common.Empty, fmt.Errorf("rule template %s is nested more than %d levels deep", name, maxMacroDepth)
+	}
+
+	// Claim the name up front so that a template referring to itself terminates
+	m.globals[instanceName] = []common.Expression(nil)
+	m.depth++
+	defer func() { m.depth-- }()
+
+	contents, err := rewriteExpressions(template.Values["contents"].([]common.Expression), func(expr common.Expression) (common.Expression, bool, error) {
+		if expr.Definition != &RuleRef {
+			return expr, false, nil
+		}
+
+		arg, isParam := bindings[expr.Values["ref"].(string)]
+
+		if !isParam {
+			return expr, false, nil
+		}
+
+		return arg, true, nil
+	})
+
+	if err != nil {
+		return common.Empty, err
+	}
+
+	values := map[string]any{"name": instanceName, "contents": contents}
+
+	if label, labeled := template.Values["label"].(string); labeled {
+		values["label"] = label
+		m.globals[labelKey(instanceName)] = label
+	}
+
+	instance, err := m.expand(common.Expression{Definition: &Rule, Values: values})
+
+	if err != nil {
+		return common.Empty, err
+	}
+
+	m.globals[instanceName] = instance.Values["contents"].([]common.Expression)
+	m.instances = append(m.instances, instance)
+
+	return ref, nil
+}
@@ -0,0 +1,50 @@
+package parsley
+
+import "testing"
+
+func TestTemplates(t *testing.T) {
+	delimited := "delimited(open, x, close): open x* close\nitem: /[a-z]+/\nnumber: /[0-9]+/\n"
+
+	runParseCases(t, []parseCase{
+		{
+			name:    "instance is named after the call",
+			grammar: `input: delimited("[", item, "]")` + "\n" + delimited,
+			input:   "[a b]",
+			want:    `input<[delimited("[", item, "]")<[[item<[String<a>]>, item<[String<b>]>]]>]>`,
+		},
+		{
+			name:    "instances with different arguments",
+			grammar: `input: delimited("[", item, "]") delimited("(", number, ")")` + "\n" + delimited,
+			input:   "[a] (1 2)",
+			want:    `input<[delimited("[", item, "]")<[[item<[String<a>]>]]>, delimited("(", number, ")")<[[number<[String<1>]>, number<[String<2>]>]]>]>`,
+		},
+		{
+			name:    "argument made of several expressions",
+			grammar: `input: delimited("[", item ",", "]")` + "\n" + delimited,
+			input:   "[a, b,]",
+			want:    `input<[delimited("[", (item ","), "]")<[[[item<[String<a>]>], [item<[String<b>]>]]]>]>`,
+		},
+		{
+			name:    "template calling a template",
+			grammar: "input: list(item)\nlist(x): delimited(\"[\", x, \"]\")\n" + delimited,
+			input:   "[a]",
+			want:    `input<[list(item)<[delimited("[", item, "]")<[[item<[String<a>]>]]>]>]>`,
+		},
+		{
+			name:    "template referring to itself",
+			grammar: "input: chain(item)\nchain(x): x (\",\" chain(x))?\n" + delimited,
+			input:   "a,b",
+			want:    "input<[chain(item)<[item<[String<a>]>, [[chain(item)<[item<[String<b>]>, []]>]]]>]>",
+		},
+		{
+			name:    "wrong number of arguments",
+			grammar: `input: delimited("[", item)` + "\n" + delimited,
+			wantErr: "rule template delimited takes 3 arguments, found 2",
+		},
+		{
+			name:    "template that never stops growing",
+			grammar: "input: grow(item)\ngrow(x): grow((\"-\" x))\n" + delimited,
+			wantErr: "nested more than 64 levels deep",
+		},
+	})
+}
@@ -0,0 +1,114 @@
+package parsley
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+var (
+	primitivesMu sync.RWMutex
+	primitives   = map[string]*common.ExpressionDefinition{}
+)
+
+// RegisterPrimitive makes an expression definition available to grammars as `@name`, or as
+// `@name("arg", ...)` when it takes arguments. The arguments reach its Evaluate method as a
+// []string under the "args" value. Like sql.Register, it panics if the name is taken.
+func RegisterPrimitive(name string, definition *common.ExpressionDefinition) {
+	primitivesMu.Lock()
+	defer primitivesMu.Unlock()
+
+	if definition == nil || definition.Evaluate == nil {
+		panic("parsley: primitive " + name + " has no Evaluate method")
+	}
+
+	if _, found := primitives[name]; found {
+		panic("parsley: primitive " + name + " is already registered")
+	}
+
+	primitives[name] = definition
+}
+
+func lookupPrimitive(name string) (*common.ExpressionDefinition, bool) {
+	primitivesMu.RLock()
+	defer primitivesMu.RUnlock()
+
+	definition, found := primitives[name]
+	return definition, found
+}
+
+func (p *Parser) parsePrimitiveExpression() (common.Expression, error) {
+	if len(p.tokens) == 0 {
+		return common.Empty, fmt.Errorf("expected primitive name after @")
+	}
+
+	token := p.popToken()
+	name := token.Contents
+	args := []string{}
+
+	switch token.Name {
+	case "Keyword":
+	case "Call":
+		var err error
+		name = strings.TrimSuffix(name, "(")
+		args, err = p.parsePrimitiveArgs()
+
+		if err != nil {
+			return common.Empty, fmt.Errorf("error when parsing arguments for @%s: %v", name, err)
+		}
+	default:
+		return common.Empty, fmt.Errorf("primitive name cannot be %s", token.Name)
+	}
+
+	definition, found := lookupPrimitive(name)
+
+	if !found {
+		return common.Empty, fmt.Errorf("could not find primitive with name @%s", name)
+	}
+
+	return common.Expression{Definition: &Primitive, Values: map[string]any{"name": name, "args": args, "definition": definition}}, nil
+}
+
+// parsePrimitiveArgs reads the arguments of a primitive, which are strings or bare words.
+func (p *Parser) parsePrimitiveArgs() ([]string, error) {
+	var args []string
+
+	for {
+		if len(p.tokens) == 0 {
+			return nil, fmt.Errorf("expected closing parenthesis after arguments")
+		}
+
+		arg := p.popToken()
+
+		switch arg.Name {
+		case "String":
+			val, err := strconv.Unquote(arg.Contents)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %v", arg.Contents, err)
+			}
+
+			args = append(args, val)
+		case "Keyword":
+			args = append(args, arg.Contents)
+		default:
+			return nil, fmt.Errorf("argument cannot be %s", arg.Name)
+		}
+
+		if len(p.tokens) == 0 {
+			return nil, fmt.Errorf("expected closing parenthesis after arguments")
+		}
+
+		switch sep := p.popToken(); sep.Name {
+		case "Comma":
+			continue
+		case "RightParenthesis":
+			return args, nil
+		default:
+			return nil, fmt.Errorf("expected comma or closing parenthesis after argument, found %s instead", sep.Name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package parsley
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// oneOf matches any one of the words it is given.
+var oneOf = common.ExpressionDefinition{
+	Name: "OneOf",
+	Evaluate: func(values map[string]any, input common.MetaString, globals map[string]any) (common.EvaluateResult, error) {
+		trimmed := input.FromStartPos(len(input.Val()) - len(strings.TrimLeft(input.Val(), " ")))
+
+		for _, word := range values["args"].([]string) {
+			if strings.HasPrefix(trimmed.Val(), word) {
+				return common.NewStringResult(trimmed.FromPosRange(0, len(word)), trimmed.FromStartPos(len(word))), nil
+			}
+		}
+
+		return common.NewNoMatchResult(input), nil
+	},
+}
+
+func init() {
+	RegisterPrimitive("oneOf", &oneOf)
+}
+
+func TestPrimitives(t *testing.T) {
+	runParseCases(t, []parseCase{
+		{name: "arguments", grammar: `input: @oneOf("red", "green", blue)*` + "\n", input: "red blue green", want: "input<[[String<red>, String<blue>, String<green>]]>"},
+		{name: "no arguments", grammar: "input: @oneOf?\n", input: "", want: "input<[[]]>"},
+		{name: "no match", grammar: `input: @oneOf("red")*` + "\n", input: "red blue", wantErr: "1:4"},
+		{name: "unknown primitive", grammar: "input: @twoOf\n", wantErr: "could not find primitive with name @twoOf"},
+		{name: "argument that isn't a word", grammar: "input: @oneOf(/red/)\n", wantErr: "argument cannot be RegularExpression"},
+		{name: "unclosed arguments", grammar: `input: @oneOf("red"`, wantErr: "expected closing parenthesis after arguments"},
+	})
+}
+
+func TestPrimitiveSerialize(t *testing.T) {
+	grammar, err := ParseGrammar(`input: @oneOf("a b", c)` + "\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := grammar.topLevelExpr.Values["rules"].([]common.Expression)
+	out, err := common.Serialize(rules[0].Values["contents"].([]common.Expression)[0], false, 0)
+
+	if err != nil || out != `@oneOf("a b", "c")` {
+		t.Errorf("got %s, %v", out, err)
+	}
+}
+
+func TestRegisterPrimitivePanics(t *testing.T) {
+	for name, definition := range map[string]*common.ExpressionDefinition{"oneOf": &oneOf, "empty": {Name: "Empty"}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %s didn't panic", name)
+				}
+			}()
+
+			RegisterPrimitive(name, definition)
+		}()
+	}
+}
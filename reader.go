@@ -0,0 +1,272 @@
+package parsley
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// readerChunkSize is how much is read from the reader at a time.
+const readerChunkSize = 64 << 10
+
+// ParseReader parses everything read from r. If the start rule is a single repetition,
+// like `input: item+`, the input is parsed one item at a time through a sliding buffer
+// that only holds on to input that hasn't been parsed yet, along with the rest of the line
+// it starts on. An item is only taken as final once it didn't need to look past what has
+// been read so far, so the result is the same as Parse would give however the input is
+// split up. Any other start rule reads the whole input first.
+//
+// Errors can only show the input that is still being held on to. Lines before that are
+// empty in the error's Contents.
+func (g Grammar) ParseReader(r io.Reader) (common.EvaluateResult, error) {
+	return g.ParseReaderContext(context.Background(), r, ParseOptions{})
+}
+
+// ParseReaderContext is ParseReader with the cancellation and limits of ParseContext. The
+// input size limit is checked against how much has been read so far.
+func (g Grammar) ParseReaderContext(ctx context.Context, r io.Reader, opts ParseOptions) (common.EvaluateResult, error) {
+	repetition, ok := g.startRepetition()
+
+	if !ok {
+		contents, err := readAll(r, opts.MaxInputSize)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return g.ParseContext(ctx, contents, opts)
+	}
+
+	var results []common.EvaluateResult
+
+	stream := newItemStream(g, ctx, r, opts, repetition)
+
+	for {
+		result, err := stream.next()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if result == nil {
+			break
+		}
+
+		if !common.Discard(result) {
+			results = append(results, result)
+		}
+	}
+
+	return stream.finish(results)
+}
+
+// startRepetition returns the repetition that makes up the start rule, if that's all the
+// start rule is.
+func (g Grammar) startRepetition() (common.Expression, bool) {
+	contents, _ := g.rules["input"].([]common.Expression)
+
+	if len(contents) != 1 {
+		return common.Empty, false
+	}
+
+	if contents[0].Definition != &ZeroOrMore && contents[0].Definition != &OneOrMore {
+		return common.Empty, false
+	}
+
+	return contents[0], true
+}
+
+// itemStream parses the items of the start rule's repetition one at a time, reading more
+// input whenever the items run out of it.
+type itemStream struct {
+	reader     io.Reader
+	opts       ParseOptions
+	repetition common.Expression
+	item       common.Expression
+	globals    map[string]any
+	memo       *memoTable
+
+	// doc is all of the input that is still held on to, from the start of the line that
+	// buffer starts on, and buffer is what hasn't been parsed yet. start is the start of
+	// the input, which is kept for the result.
+	doc    common.MetaString
+	buffer common.MetaString
+	start  common.MetaString
+
+	read      int
+	eof       bool
+	count     int
+	deepest   common.MetaString
+	exhausted bool
+}
+
+func newItemStream(g Grammar, ctx context.Context, r io.Reader, opts ParseOptions, repetition common.Expression) *itemStream {
+	// The memo table doesn't keep any matches, it only tells how far each item looked
+	memo := &memoTable{}
+	globals := g.newGlobals(ctx, opts)
+	globals[memoTableKey] = memo
+	empty := common.NewMetaString("")
+
+	return &itemStream{
+		reader:     r,
+		opts:       opts,
+		repetition: repetition,
+		item:       repetition.Values["expr"].(common.Expression),
+		globals:    globals,
+		memo:       memo,
+		doc:        empty,
+		buffer:     empty,
+		start:      empty,
+	}
+}
+
+// setInput gives the stream all of its input up front.
+func (s *itemStream) setInput(contents string) {
+	s.doc = common.NewMetaString(contents)
+	s.buffer = s.doc
+	s.start = s.doc
+	s.eof = true
+}
+
+// fill reads at least another chunk, or as much again as is already buffered if that is
+// more, so that retrying a large item doesn't take quadratic time.
+func (s *itemStream) fill() error {
+	want := max(readerChunkSize, len(s.buffer.Val()))
+	chunk := make([]byte, want)
+	n, err := io.ReadFull(s.reader, chunk)
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		s.eof = true
+	} else if err != nil {
+		return err
+	}
+
+	s.read += n
+
+	if s.opts.MaxInputSize > 0 && s.read > s.opts.MaxInputSize {
+		return common.InputSizeError{Max: s.opts.MaxInputSize, Size: s.read}
+	}
+
+	// Building a new string lets go of everything before the line the buffer starts on
+	lineStart := s.buffer.Pos() - s.buffer.Loc.ByteCol
+	prefix := s.doc.Val()[lineStart-s.doc.Pos() : s.buffer.Pos()-s.doc.Pos()]
+	loc := common.StringPos{File: s.buffer.Loc.File, Pos: lineStart, Line: s.buffer.Loc.Line}
+
+	s.doc = common.NewMetaStringAt(prefix+s.buffer.Val()+string(chunk[:n]), loc)
+	s.buffer = s.doc.FromStartPos(len(prefix))
+
+	if s.read == n {
+		s.start = s.buffer
+	}
+
+	return nil
+}
+
+// next returns the next item, or nil once the repetition has ended.
+func (s *itemStream) next() (common.EvaluateResult, error) {
+	if s.exhausted {
+		return nil, nil
+	}
+
+	for {
+		if !s.eof && s.buffer.Val() == "" {
+			if err := s.fill(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		state := common.GetState(s.globals)
+		snapshot := state.Snapshot()
+		failure := state.SnapshotFailure()
+		s.memo.examined = 0
+		result, err := s.item.Evaluate(s.buffer, s.globals)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Whether or not the item matched, it might not have if it had seen more of the input
+		if !s.eof && s.memo.examined > s.buffer.Pos()+len(s.buffer.Val()) {
+			state.Restore(snapshot)
+			state.RestoreFailure(failure)
+
+			if err := s.fill(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if !common.Match(result) {
+			s.deepest = result.Remaining()
+			s.exhausted = true
+
+			return nil, nil
+		}
+
+		s.buffer = result.Remaining()
+		s.count++
+
+		return result, nil
+	}
+}
+
+// finish checks that nothing but whitespace followed the items and builds the same tree
+// that Parse would have built out of them.
+func (s *itemStream) finish(results []common.EvaluateResult) (common.EvaluateResult, error) {
+	if err := s.end(); err != nil {
+		return nil, err
+	}
+
+	start := s.start
+	repetitionResult := common.NewMultipleResult(results, s.buffer, &s.deepest)
+	ruleResult := common.NewMultipleResult([]common.EvaluateResult{repetitionResult}, s.buffer, &s.deepest)
+
+	return common.NewRuleResult(ruleResult, start, s.buffer, "input"), nil
+}
+
+// end checks that nothing but whitespace followed the items.
+func (s *itemStream) end() error {
+	if s.count == 0 && s.repetition.Definition == &OneOrMore {
+		return newParseError(s.errorContents(), s.deepest, s.globals)
+	}
+
+	if strings.TrimSpace(s.buffer.Val()) != "" {
+		if s.deepest.Pos() > s.buffer.Pos() {
+			return newParseError(s.errorContents(), s.deepest, s.globals)
+		}
+
+		return newParseError(s.errorContents(), s.buffer, s.globals)
+	}
+
+	return nil
+}
+
+// errorContents is the input for errors, as far as it is still held on to. The lines that
+// are gone are left empty, so that lines are where an error's position says they are.
+func (s *itemStream) errorContents() string {
+	return strings.Repeat("\n", s.doc.Loc.Line) + s.doc.Val()
+}
+
+func readAll(r io.Reader, maxSize int) (string, error) {
+	if maxSize > 0 {
+		r = io.LimitReader(r, int64(maxSize)+1)
+	}
+
+	contents, err := io.ReadAll(r)
+
+	if err != nil {
+		return "", err
+	}
+
+	if maxSize > 0 && len(contents) > maxSize {
+		return "", common.InputSizeError{Max: maxSize, Size: len(contents)}
+	}
+
+	return string(contents), nil
+}
@@ -0,0 +1,200 @@
+package parsley
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+func TestParseReader(t *testing.T) {
+	grammar, err := ParseGrammar("input: item*\nitem: name \"=\" value \";\"\nname: /[a-z]+/\nvalue: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+
+	// Enough items to go through several chunks
+	for i := 0; b.Len() < 3*readerChunkSize; i++ {
+		b.WriteString("abc = 123;\n")
+	}
+
+	input := b.String()
+
+	for name, contents := range map[string]string{"empty": "", "short": "a = 1; b = 2;\n", "long": input} {
+		t.Run(name, func(t *testing.T) {
+			want, err := condensed(grammar, contents)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := grammar.ParseReader(iotest.HalfReader(strings.NewReader(contents)))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := result.Condense()
+
+			if err != nil || got.String() != want {
+				t.Errorf("ParseReader and Parse disagree")
+			}
+
+			// The result starts at the start of the input, like it does with Parse
+			if start := result.(common.RuleResult).Start(); start.Pos() != 0 || !strings.HasPrefix(contents, start.Val()) {
+				t.Errorf("got start %d, %.20q", start.Pos(), start.Val())
+			}
+		})
+	}
+
+	// The error is at the same place in the input as it is with Parse
+	broken := input + "abc = ;\n" + input
+	_, wantErr := grammar.Parse(broken)
+	_, err = grammar.ParseReader(strings.NewReader(broken))
+
+	var parseErr, wantParseErr ParseError
+
+	if !errors.As(err, &parseErr) || !errors.As(wantErr, &wantParseErr) || parseErr.Loc != wantParseErr.Loc {
+		t.Fatalf("got error %v, want %v", err, wantErr)
+	}
+
+	// The line with the error is still there to show
+	if lines := strings.Split(parseErr.Contents, "\n"); len(lines) <= parseErr.Loc.Line || lines[parseErr.Loc.Line] != "abc = ;" {
+		t.Errorf("error contents don't have the line with the error")
+	}
+}
+
+func TestParseReaderLongMatch(t *testing.T) {
+	// Until the "!" at the end has been read, the input looks like it is made of words
+	grammar, err := ParseGrammar("input: item*\nitem: sentence | word\nsentence: /[a-z ]+!/\nword: /[a-z]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := strings.Repeat("a ", 2*readerChunkSize) + "!"
+	want, err := condensed(grammar, contents)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := grammar.ParseReader(strings.NewReader(contents))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := result.Condense(); err != nil || got.String() != want {
+		t.Errorf("ParseReader and Parse disagree")
+	}
+}
+
+func TestParseReaderWholeInput(t *testing.T) {
+	// The start rule isn't a single repetition, so the input is read in one go
+	grammar, err := ParseGrammar("input: name value\nname: /[a-z]+/\nvalue: /[0-9]+/\n")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := grammar.ParseReader(strings.NewReader("a 1"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := result.Condense(); got.String() != "input<[name<[String<a>]>, value<[String<1>]>]>" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestParseReaderInputSize(t *testing.T) {
+	for _, grammarContents := range []string{"input: name*\nname: /[a-z]+/\n", "input: name\nname: /[a-z ]+/\n"} {
+		grammar, err := ParseGrammar(grammarContents)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input := strings.Repeat("a ", readerChunkSize)
+
+		var sizeErr common.InputSizeError
+
+		if _, err := grammar.ParseReaderContext(context.Background(), strings.NewReader(input), ParseOptions{MaxInputSize: 100}); !errors.As(err, &sizeErr) {
+			t.Errorf("got error %v, want an InputSizeError", err)
+		}
+	}
+}
+
+// repeatReader reads line over and over until size bytes have been read, without having
+// all of it in memory at once.
+type repeatReader struct {
+	line string
+	size int
+	read int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.read >= r.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+
+	for n < len(p) && r.read < r.size {
+		copied := copy(p[n:min(len(p), n+r.size-r.read)], r.line[r.read%len(r.line):])
+		n += copied
+		r.read += copied
+	}
+
+	return n, nil
+}
+
+// BenchmarkParseReader parses 8MB of log-like records. Besides the time and what is
+// allocated along the way, it reports how much memory the returned tree holds on to for
+// every byte of input, which includes the input the tree's strings point into.
+func BenchmarkParseReader(b *testing.B) {
+	grammar, err := ParseGrammar("input: record*\nrecord: time level field* \";\"\ntime: /[0-9:T-]+/\nlevel: /[A-Z]+/\nfield: key \"=\" value\nkey: /[a-z_]+/\nvalue: /[^ ;\\n]+/\n")
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	line := "2024-01-02T12:00:00 INFO service=api path=/users/42 status=200 latency_ms=12;\n"
+	size := 8 << 20
+	size -= size % len(line)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+
+	var stats runtime.MemStats
+	var retained uint64
+
+	for range b.N {
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		before := stats.HeapAlloc
+
+		result, err := grammar.ParseReader(&repeatReader{line: line, size: size})
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		retained += stats.HeapAlloc - before
+		runtime.KeepAlive(result)
+	}
+
+	b.ReportMetric(float64(retained)/float64(b.N)/float64(size), "retained-B/B")
+}
@@ -0,0 +1,241 @@
+package parsley
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type ColorMode int
+
+const (
+	// ColorAuto uses color when writing to a terminal, unless NO_COLOR is set or TERM is
+	// dumb.
+	ColorAuto ColorMode = iota
+	ColorAlways
+	ColorNever
+)
+
+// RenderOptions changes how a ParseError is rendered.
+type RenderOptions struct {
+	Color ColorMode
+
+	// ContextLines is how many lines are shown before and after the line with the error.
+	ContextLines int
+
+	// TabWidth expands tabs to spaces with tab stops this far apart. Zero leaves tabs as
+	// they are, which lines up as long as whatever shows the output agrees with itself.
+	TabWidth int
+
+	// Label is shown next to the marker under the error, instead of "Starting here".
+	Label string
+}
+
+const (
+	highlightStyle = "\x1b[30;47m"
+	messageStyle   = "\x1b[1;31m"
+	gutterStyle    = "\x1b[2m"
+	resetStyle     = "\x1b[m"
+)
+
+// Render writes the error message followed by the lines around the error, with the start
+// of the error marked.
+func (e ParseError) Render(w io.Writer, opts RenderOptions) error {
+	color := useColor(w, opts.Color)
+
+	if _, err := fmt.Fprintln(w, paint(color, messageStyle, e.Error())); err != nil {
+		return err
+	}
+
+	return e.renderContext(w, opts, color)
+}
+
+// PrintContext prints the lines around the error to stdout.
+func (e ParseError) PrintContext(contextLineCount int) {
+	fmt.Println("Context:")
+
+	_ = e.renderContext(os.Stdout, RenderOptions{ContextLines: contextLineCount}, useColor(os.Stdout, ColorAuto))
+}
+
+func (e ParseError) renderContext(w io.Writer, opts RenderOptions, color bool) error {
+	lines := strings.Split(e.Contents, "\n")
+	startLineNum := max(0, e.Loc.Line-opts.ContextLines)
+	endLineNum := min(e.Loc.Line+opts.ContextLines+1, len(lines))
+	maxLineNumWidth := digitCount(endLineNum + 1)
+
+	label := opts.Label
+
+	if label == "" {
+		label = "Starting here"
+	}
+
+	for i := startLineNum; i < endLineNum; i++ {
+		line := strings.TrimSuffix(lines[i], "\r")
+		gutter := paint(color, gutterStyle, fmt.Sprintf("%*d │", maxLineNumWidth, i+1))
+
+		if i != e.Loc.Line {
+			if _, err := fmt.Fprintf(w, "%s %s\n", gutter, expandTabs(line, 0, opts.TabWidth)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// An error at the end of a line or of the input gets a highlighted space
+		col := min(e.Loc.ByteCol, len(line))
+		before, at, after := line[:col], " ", ""
+
+		if col < len(line) {
+			_, size := utf8.DecodeRuneInString(line[col:])
+			at, after = line[col:col+size], line[col+size:]
+		}
+
+		// Without a tab width, tabs are kept as they are so that they line up the same way
+		// in both lines, and everything else is padded to however wide it is printed.
+		before = expandTabs(before, 0, opts.TabWidth)
+		var left strings.Builder
+
+		for _, ch := range before {
+			if ch == '\t' {
+				left.WriteRune('\t')
+			} else {
+				left.WriteString(strings.Repeat(" ", displayWidth(ch)))
+			}
+		}
+
+		// Expanding tabs only needs the column when there are no tabs left in left
+		at = expandTabs(at, left.Len(), opts.TabWidth)
+		after = expandTabs(after, left.Len()+textWidth(at), opts.TabWidth)
+
+		if _, err := fmt.Fprintf(w, "%s %s%s%s\n", gutter, before, paint(color, highlightStyle, at), after); err != nil {
+			return err
+		}
+
+		marker := paint(color, gutterStyle, fmt.Sprintf("%*s │", maxLineNumWidth, ""))
+
+		if _, err := fmt.Fprintf(w, "%s %s╰─── [%s]\n", marker, left.String(), label); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandTabs replaces tabs with spaces up to the next multiple of tabWidth, for text that
+// starts column columns into the line. A tab width of zero leaves tabs alone.
+func expandTabs(text string, column int, tabWidth int) string {
+	if tabWidth <= 0 || !strings.Contains(text, "\t") {
+		return text
+	}
+
+	var out strings.Builder
+
+	for _, ch := range text {
+		if ch == '\t' {
+			spaces := tabWidth - column%tabWidth
+			out.WriteString(strings.Repeat(" ", spaces))
+			column += spaces
+		} else {
+			out.WriteRune(ch)
+			column += displayWidth(ch)
+		}
+	}
+
+	return out.String()
+}
+
+func paint(color bool, style, text string) string {
+	if !color {
+		return text
+	}
+
+	return style + text + resetStyle
+}
+
+// useColor decides whether to write escape sequences to w.
+func useColor(w io.Writer, mode ColorMode) bool {
+	switch mode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+
+	file, ok := w.(*os.File)
+
+	if !ok {
+		return false
+	}
+
+	info, err := file.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func digitCount(input int) int {
+	if input == 0 {
+		return 1
+	}
+
+	count := 0
+
+	for input != 0 {
+		input /= 10
+		count++
+	}
+
+	return count
+}
+
+// wideChars are the characters that terminals print two columns wide: East Asian wide and
+// fullwidth characters, and most emoji.
+var wideChars = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115f, Stride: 1},
+		{Lo: 0x2e80, Hi: 0x303e, Stride: 1},
+		{Lo: 0x3041, Hi: 0x33ff, Stride: 1},
+		{Lo: 0x3400, Hi: 0x4dbf, Stride: 1},
+		{Lo: 0x4e00, Hi: 0x9fff, Stride: 1},
+		{Lo: 0xa000, Hi: 0xa4cf, Stride: 1},
+		{Lo: 0xac00, Hi: 0xd7a3, Stride: 1},
+		{Lo: 0xf900, Hi: 0xfaff, Stride: 1},
+		{Lo: 0xfe30, Hi: 0xfe4f, Stride: 1},
+		{Lo: 0xff00, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f300, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f900, Hi: 0x1f9ff, Stride: 1},
+		{Lo: 0x20000, Hi: 0x3fffd, Stride: 1},
+	},
+}
+
+func textWidth(text string) int {
+	width := 0
+
+	for _, ch := range text {
+		width += displayWidth(ch)
+	}
+
+	return width
+}
+
+// displayWidth returns roughly how many columns a terminal takes to print ch.
+func displayWidth(ch rune) int {
+	if unicode.In(ch, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+
+	if unicode.Is(wideChars, ch) {
+		return 2
+	}
+
+	return 1
+}
@@ -0,0 +1,93 @@
+package parsley
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+func TestRender(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+		loc      common.StringPos
+		opts     RenderOptions
+		want     string
+	}{
+		{
+			name:     "wide characters",
+			contents: "名前 = x\n",
+			loc:      common.StringPos{Pos: 7, Line: 0, Col: 3, ByteCol: 7},
+			opts:     RenderOptions{Color: ColorAlways},
+			want:     "\x1b[1;31m1:4: unknown token\x1b[m\n\x1b[2m1 │\x1b[m 名前 \x1b[30;47m=\x1b[m x\n\x1b[2m  │\x1b[m      ╰─── [Starting here]\n",
+		},
+		{
+			name:     "tabs",
+			contents: "\tab\n",
+			loc:      common.StringPos{Pos: 2, Line: 0, Col: 2, ByteCol: 2},
+			opts:     RenderOptions{Color: ColorNever},
+			want:     "1:3: unknown token\n1 │ \tab\n  │ \t ╰─── [Starting here]\n",
+		},
+		{
+			name:     "expanded tabs",
+			contents: "\ta\tb\n",
+			loc:      common.StringPos{Pos: 3, Line: 0, Col: 3, ByteCol: 3},
+			opts:     RenderOptions{Color: ColorNever, TabWidth: 4},
+			want:     "1:4: unknown token\n1 │     a   b\n  │         ╰─── [Starting here]\n",
+		},
+		{
+			name:     "end of the input",
+			contents: "ab",
+			loc:      common.StringPos{Pos: 2, Line: 0, Col: 2, ByteCol: 2},
+			opts:     RenderOptions{Color: ColorNever, Label: "here"},
+			want:     "1:3: unknown token\n1 │ ab \n  │   ╰─── [here]\n",
+		},
+		{
+			name:     "context lines",
+			contents: "a\nb\nc\nd\n",
+			loc:      common.StringPos{Pos: 4, Line: 2, Col: 0, ByteCol: 0},
+			opts:     RenderOptions{Color: ColorNever, ContextLines: 1},
+			want:     "3:1: unknown token\n2 │ b\n3 │ c\n  │ ╰─── [Starting here]\n4 │ d\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			if err := (ParseError{Contents: c.contents, Loc: c.loc}).Render(&out, c.opts); err != nil {
+				t.Fatal(err)
+			}
+
+			if out.String() != c.want {
+				t.Errorf("got\n%q\nwant\n%q", out.String(), c.want)
+			}
+		})
+	}
+}
+
+func TestPrintContext(t *testing.T) {
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	ParseError{Contents: "ab\n", Loc: common.StringPos{Pos: 1, Col: 1, ByteCol: 1}}.PrintContext(0)
+
+	os.Stdout = stdout
+	w.Close()
+
+	out, err := io.ReadAll(r)
+
+	// A pipe isn't a terminal, so there is no color
+	if want := "Context:\n1 │ ab\n  │  ╰─── [Starting here]\n"; err != nil || string(out) != want {
+		t.Errorf("got\n%q\nwant\n%q", out, want)
+	}
+}
@@ -0,0 +1,312 @@
+package parsley
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/l-donovan/parsley/common"
+)
+
+// Validate looks for problems with the grammar that reading it doesn't catch, and that
+// would otherwise only show up while parsing, if at all:
+//   - there is no input rule
+//   - a rule refers to a rule that doesn't exist
+//   - a rule can refer back to itself without consuming anything, which never ends
+//   - a repetition can match nothing, which never ends either
+//   - a rule can't be reached from the input rule, which is only a warning, and only for
+//     rules in the same file as the input rule
+//
+// Rule templates are checked through their instances.
+func (g Grammar) Validate() []Diagnostic {
+	v := validator{rules: map[string]common.Expression{}, nullable: map[string]bool{}}
+
+	for _, rule := range g.topLevelExpr.Values["rules"].([]common.Expression) {
+		if _, isTemplate := rule.Values["params"]; !isTemplate {
+			v.rules[rule.Values["name"].(string)] = rule
+			v.names = append(v.names, rule.Values["name"].(string))
+		}
+	}
+
+	slices.Sort(v.names)
+	v.findNullable()
+
+	start, hasStart := v.rules["input"]
+
+	if !hasStart {
+		v.report(SeverityError, RuleMissingStart, nil, "grammar has no input rule to start parsing from")
+	}
+
+	for _, name := range v.names {
+		rule := v.rules[name]
+
+		walkExpression(rule, func(expr common.Expression) {
+			switch expr.Definition {
+			case &RuleRef:
+				if ref := expr.Values["ref"].(string); !v.defined(ref) {
+					v.report(SeverityError, RuleUndefinedRule, nameSpan(expr, ref, ruleFile(rule)), fmt.Sprintf("rule %s refers to %s, which isn't defined", name, ref))
+				}
+			case &ZeroOrMore, &OneOrMore, &Repeat:
+				if max, bounded := expr.Values["max"].(int); bounded && max >= 0 {
+					return
+				}
+
+				if v.canBeEmpty(expr.Values["expr"].(common.Expression)) {
+					v.report(SeverityError, RuleEmptyRepetition, nameSpan(rule, name, ruleFile(rule)), fmt.Sprintf("rule %s repeats %s, which can match nothing", name, serialized(expr.Values["expr"].(common.Expression))))
+				}
+			case &Separated:
+				item, separator := expr.Values["item"].(common.Expression), expr.Values["separator"].(common.Expression)
+
+				if v.canBeEmpty(item) && v.canBeEmpty(separator) {
+					v.report(SeverityError, RuleEmptyRepetition, nameSpan(rule, name, ruleFile(rule)), fmt.Sprintf("rule %s separates %s with %s, which can both match nothing", name, serialized(item), serialized(separator)))
+				}
+			}
+		})
+
+		if cycle := v.leftRecursion(name); cycle != nil {
+			v.report(SeverityError, RuleLeftRecursion, nameSpan(rule, name, ruleFile(rule)), fmt.Sprintf("rule %s is left-recursive: %s", name, strings.Join(cycle, " -> ")))
+		}
+	}
+
+	if hasStart {
+		reachable := map[string]bool{"input": true}
+		pending := []string{"input"}
+
+		for len(pending) > 0 {
+			rule := v.rules[pending[len(pending)-1]]
+			pending = pending[:len(pending)-1]
+
+			walkExpression(rule, func(expr common.Expression) {
+				if ref, ok := expr.Values["ref"].(string); ok && expr.Definition == &RuleRef && v.defined(ref) && !reachable[ref] {
+					reachable[ref] = true
+					pending = append(pending, ref)
+				}
+			})
+		}
+
+		for _, name := range v.names {
+			if rule := v.rules[name]; !reachable[name] && ruleFile(rule) == ruleFile(start) {
+				v.report(SeverityWarning, RuleUnusedRule, nameSpan(rule, name, ruleFile(rule)), fmt.Sprintf("rule %s is never used", name))
+			}
+		}
+	}
+
+	return v.diagnostics
+}
+
+type validator struct {
+	rules       map[string]common.Expression
+	names       []string
+	nullable    map[string]bool
+	diagnostics []Diagnostic
+}
+
+func (v *validator) report(severity Severity, ruleID string, span *Span, message string) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{Severity: severity, RuleID: ruleID, Message: message, Span: span})
+}
+
+func (v *validator) defined(name string) bool {
+	_, found := v.rules[name]
+	return found
+}
+
+// findNullable works out which rules can match without consuming anything. Rules start
+// out as not nullable, and are marked as such until nothing changes any more.
+func (v *validator) findNullable() {
+	for changed := true; changed; {
+		changed = false
+
+		for _, name := range v.names {
+			if !v.nullable[name] && v.canBeEmpty(v.rules[name]) {
+				v.nullable[name] = true
+				changed = true
+			}
+		}
+	}
+}
+
+// canBeEmpty returns whether expr can match without consuming anything. It errs on the
+// side of no for anything it can't see into, like primitives.
+func (v *validator) canBeEmpty(expr common.Expression) bool {
+	switch expr.Definition {
+	case &Rule:
+		return v.allCanBeEmpty(expr.Values["contents"].([]common.Expression))
+	case &Group:
+		return v.allCanBeEmpty(expr.Values["groupItems"].([]common.Expression))
+	case &Or, &ExclusiveOr:
+		return v.canBeEmpty(expr.Values["lhs"].(common.Expression)) || v.canBeEmpty(expr.Values["rhs"].(common.Expression))
+	case &Union:
+		return slices.ContainsFunc(expr.Values["unionItems"].([]common.Expression), v.canBeEmpty)
+	case &ZeroOrMore, &ZeroOrOne, &SemanticPredicate, &BackReference, &Dedent:
+		return true
+	case &OneOrMore, &Capture, &Labeled, &Embedded:
+		return v.canBeEmpty(expr.Values["expr"].(common.Expression))
+	case &Repeat:
+		return expr.Values["min"].(int) == 0 || v.canBeEmpty(expr.Values["expr"].(common.Expression))
+	case &Separated:
+		return !expr.Values["nonEmpty"].(bool) || v.canBeEmpty(expr.Values["item"].(common.Expression))
+	case &RuleRef:
+		return v.nullable[expr.Values["ref"].(string)]
+	case &RegularExpression:
+		return expr.Values["val"].(*regexp.Regexp).MatchString("")
+	case &StringLiteral:
+		return expr.Values["val"].(string) == ""
+	}
+
+	return false
+}
+
+func (v *validator) allCanBeEmpty(exprs []common.Expression) bool {
+	for _, expr := range exprs {
+		if !v.canBeEmpty(expr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// leftmostRefs returns the rules that expr can start by evaluating, before consuming
+// anything.
+func (v *validator) leftmostRefs(expr common.Expression) []string {
+	switch expr.Definition {
+	case &Rule:
+		return v.leftmostRefsInSequence(expr.Values["contents"].([]common.Expression))
+	case &Group:
+		return v.leftmostRefsInSequence(expr.Values["groupItems"].([]common.Expression))
+	case &Or, &ExclusiveOr:
+		return append(v.leftmostRefs(expr.Values["lhs"].(common.Expression)), v.leftmostRefs(expr.Values["rhs"].(common.Expression))...)
+	case &Union:
+		var refs []string
+
+		for _, item := range expr.Values["unionItems"].([]common.Expression) {
+			refs = append(refs, v.leftmostRefs(item)...)
+		}
+
+		return refs
+	case &ZeroOrMore, &OneOrMore, &ZeroOrOne, &Repeat, &Capture, &Labeled, &Embedded:
+		return v.leftmostRefs(expr.Values["expr"].(common.Expression))
+	case &Separated:
+		item := expr.Values["item"].(common.Expression)
+
+		if v.canBeEmpty(item) {
+			return append(v.leftmostRefs(item), v.leftmostRefs(expr.Values["separator"].(common.Expression))...)
+		}
+
+		return v.leftmostRefs(item)
+	case &RuleRef:
+		return []string{expr.Values["ref"].(string)}
+	}
+
+	return nil
+}
+
+func (v *validator) leftmostRefsInSequence(exprs []common.Expression) []string {
+	var refs []string
+
+	for _, expr := range exprs {
+		refs = append(refs, v.leftmostRefs(expr)...)
+
+		if !v.canBeEmpty(expr) {
+			break
+		}
+	}
+
+	return refs
+}
+
+// leftRecursion returns a path of rules that leads from name back to name without
+// consuming anything, if there is one. Each cycle is only reported for the rule in it
+// that sorts first, so that it's only reported once.
+func (v *validator) leftRecursion(name string) []string {
+	visited := map[string]bool{}
+
+	var search func(path []string) []string
+
+	search = func(path []string) []string {
+		for _, ref := range v.leftmostRefs(v.rules[path[len(path)-1]]) {
+			if ref == name {
+				return append(path, ref)
+			}
+
+			// Only going through rules that sort after name finds each cycle once
+			if ref < name || visited[ref] || !v.defined(ref) {
+				continue
+			}
+
+			visited[ref] = true
+
+			if cycle := search(append(path, ref)); cycle != nil {
+				return cycle
+			}
+		}
+
+		return nil
+	}
+
+	return search([]string{name})
+}
+
+// walkExpression calls visit for expr and everything in it.
+func walkExpression(expr common.Expression, visit func(common.Expression)) {
+	visit(expr)
+
+	// Going through the values in order keeps diagnostics in the same order every time
+	for _, key := range slices.Sorted(maps.Keys(expr.Values)) {
+		switch val := expr.Values[key].(type) {
+		case common.Expression:
+			walkExpression(val, visit)
+		case []common.Expression:
+			for _, subExpr := range val {
+				walkExpression(subExpr, visit)
+			}
+		}
+	}
+}
+
+// nameSpan returns the span of name, which expr is a rule called that or a reference to
+// one. Expressions that don't know where they are, like rule template instances, only get
+// the file they're in.
+func nameSpan(expr common.Expression, name, file string) *Span {
+	loc, found := expr.Values["loc"].(common.StringPos)
+
+	if !found {
+		if file == "" {
+			return nil
+		}
+
+		return &Span{File: file}
+	}
+
+	// Names from namespaced imports are longer than they are written
+	if text, written := expr.Values["text"].(string); written {
+		name = text
+	}
+
+	// Rule names are made of ASCII characters, so they take up a column per byte however
+	// columns are counted
+	end := loc
+	end.Pos += len(name)
+	end.Col += len(name)
+	end.ByteCol += len(name)
+	end.UTF16Col += len(name)
+
+	return &Span{loc.File, newPosition(loc), newPosition(end)}
+}
+
+func ruleFile(rule common.Expression) string {
+	file, _ := rule.Values["file"].(string)
+	return file
+}
+
+func serialized(expr common.Expression) string {
+	out, err := common.Serialize(expr, false, 0)
+
+	if err != nil {
+		return expr.Definition.Name
+	}
+
+	return out
+}
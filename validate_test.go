@@ -0,0 +1,109 @@
+package parsley
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		grammar string
+		want    []string
+	}{
+		{
+			name:    "valid",
+			grammar: "input: item*\nitem: name \";\"\nname: /[a-z]+/\n",
+		},
+		{
+			name:    RuleMissingStart,
+			grammar: "start: name\nname: /[a-z]+/\n",
+			want:    []string{"error: grammar has no input rule to start parsing from [missing-start-rule]"},
+		},
+		{
+			name:    RuleUndefinedRule,
+			grammar: "input: name value\nname: /[a-z]+/\n",
+			want:    []string{"1:13: error: rule input refers to value, which isn't defined [undefined-rule]"},
+		},
+		{
+			name:    RuleLeftRecursion,
+			grammar: "input: expr\nexpr: <(term \"+\" number) number>\nterm: expr?\nnumber: /[0-9]+/\n",
+			// Each cycle is only reported once
+			want: []string{"2:1: error: rule expr is left-recursive: expr -> term -> expr [left-recursion]"},
+		},
+		{
+			name:    RuleEmptyRepetition,
+			grammar: "input: (name?)*\nname: /[a-z]+/\n",
+			want:    []string{"1:1: error: rule input repeats (name?), which can match nothing [empty-repetition]"},
+		},
+		{
+			name:    "bounded repetition of something that can be empty",
+			grammar: "input: (name?){3}\nname: /[a-z]+/\n",
+		},
+		{
+			name:    "separated list where both can be empty",
+			grammar: "input: sep(name?, \",\"?)\nname: /[a-z]+/\n",
+			want:    []string{"1:1: error: rule input separates name? with \",\"?, which can both match nothing [empty-repetition]"},
+		},
+		{
+			name:    "NEWLINE always consumes something",
+			grammar: "input: (name NEWLINE*)+\nname: /[a-z]+/\n",
+		},
+		{
+			name:    RuleUnusedRule,
+			grammar: "input: name\nname: /[a-z]+/\nnumber: /[0-9]+/\n",
+			want:    []string{"3:1: warning: rule number is never used [unused-rule]"},
+		},
+		{
+			name:    "templates are checked through their instances",
+			grammar: "input: list(name)\nlist(x): x (\",\" x)*\nname: /[a-z]+/\nunused(x): x\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			grammar, err := ParseGrammar(c.grammar)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+
+			for _, diagnostic := range grammar.Validate() {
+				got = append(got, diagnostic.String())
+			}
+
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("got\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(c.want, "\n\t"))
+			}
+		})
+	}
+}
+
+func TestValidateNamespacedImport(t *testing.T) {
+	files := fstest.MapFS{
+		"main.parsley":  {Data: []byte("import \"lexer.parsley\" as lex\ninput: lex.word\n")},
+		"lexer.parsley": {Data: []byte("word: letters\n")},
+	}
+
+	grammar, err := ParseGrammarFS(files, "main.parsley")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diagnostics := grammar.Validate()
+
+	if len(diagnostics) != 1 {
+		t.Fatalf("got %v", diagnostics)
+	}
+
+	// The reference is to lex.letters, but it's written as letters
+	want := Span{"lexer.parsley", Position{6, 1, 7, 6}, Position{13, 1, 14, 13}}
+
+	if span := diagnostics[0].Span; span == nil || *span != want {
+		t.Errorf("got span %+v, want %+v", span, want)
+	}
+}